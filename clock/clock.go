@@ -0,0 +1,122 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time.  It exists so that anything time dependent can be driven by a Mock in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+// Sleeper is a Clock which can be waited on
+type Sleeper interface {
+	Sleep(d time.Duration)
+}
+
+// Sleep waits for d to pass on c.  Clocks which are not Sleepers are waited on with the wall clock.
+func Sleep(c Clock, d time.Duration) {
+	if s, ok := c.(Sleeper); ok {
+		s.Sleep(d)
+		return
+	}
+	time.Sleep(d)
+}
+
+// Timer is a Clock which can signal once a duration has passed on it
+type Timer interface {
+	After(d time.Duration) <-chan time.Time
+}
+
+// After returns a channel which receives the time once d has passed on c.  Clocks which are not Timers are waited on
+// with the wall clock.
+func After(c Clock, d time.Duration) <-chan time.Time {
+	if t, ok := c.(Timer); ok {
+		return t.After(d)
+	}
+	return time.After(d)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// System is the wall clock
+var System Clock = systemClock{}
+
+// Mock is a Clock which only moves when told to
+type Mock struct {
+	lock    sync.RWMutex
+	now     time.Time
+	waiters []waiter
+}
+
+type waiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func NewMock(now time.Time) *Mock {
+	return &Mock{now: now}
+}
+
+func (m *Mock) Now() time.Time {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.now
+}
+
+func (m *Mock) Set(now time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.set(now)
+}
+
+func (m *Mock) Advance(d time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.set(m.now.Add(d))
+}
+
+// set moves m to now and signals the waiters which are due.  It must be called with the lock held.
+func (m *Mock) set(now time.Time) {
+	m.now = now
+	waiting := m.waiters[:0]
+	for _, w := range m.waiters {
+		if w.at.After(now) {
+			waiting = append(waiting, w)
+			continue
+		}
+		w.c <- now
+	}
+	m.waiters = waiting
+}
+
+// After signals once m has been moved d past the current time
+func (m *Mock) After(d time.Duration) <-chan time.Time {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- m.now
+		return c
+	}
+	m.waiters = append(m.waiters, waiter{at: m.now.Add(d), c: c})
+	return c
+}
+
+// Sleep advances m by d, so waiting on a Mock returns at once
+func (m *Mock) Sleep(d time.Duration) {
+	m.Advance(d)
+}
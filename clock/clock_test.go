@@ -0,0 +1,31 @@
+package clock_test
+
+import (
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMock(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := clock.NewMock(start)
+	assert.Equal(t, start, c.Now(), "Mock starts at the given time")
+	c.Advance(time.Hour)
+	assert.Equal(t, start.Add(time.Hour), c.Now(), "Mock can be advanced")
+	c.Set(start)
+	assert.Equal(t, start, c.Now(), "Mock can be set")
+	clock.Sleep(c, time.Minute)
+	assert.Equal(t, start.Add(time.Minute), c.Now(), "Sleeping advances a Mock")
+	after := clock.After(c, time.Hour)
+	c.Advance(time.Minute)
+	assert.Empty(t, after, "Mock does not signal before it has been moved far enough")
+	c.Advance(time.Hour)
+	assert.Equal(t, start.Add(time.Hour+2*time.Minute), <-after, "Mock signals once it has been moved far enough")
+}
+
+func TestSystem(t *testing.T) {
+	before := time.Now()
+	now := clock.System.Now()
+	assert.False(t, now.Before(before), "System clock tells the current time")
+}
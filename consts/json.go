@@ -0,0 +1,99 @@
+package consts
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/davidjwilkins/declarative-payments/errors"
+)
+
+// decode returns the string in data if it is one of valid, and errors.ErrInvalidEnum otherwise
+func decode(data []byte, name string, valid ...string) (string, error) {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return "", err
+	}
+	for _, v := range valid {
+		if s == v {
+			return s, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %q is not a valid %s", errors.ErrInvalidEnum, s, name)
+}
+
+// UnmarshalJSON accepts the known statuses, or an empty status for a state which has not been resolved yet
+func (s *PaymentStatus) UnmarshalJSON(data []byte) error {
+	v, err := decode(data, "payment status", "",
+		string(PaymentStatusPending), string(PaymentStatusComplete), string(PaymentStatusError),
+		string(PaymentStatusFailed), string(PaymentStatusRunning))
+	if err != nil {
+		return err
+	}
+	*s = PaymentStatus(v)
+	return nil
+}
+
+func (a *PaymentCommandAction) UnmarshalJSON(data []byte) error {
+	v, err := decode(data, "payment command action",
+		string(PaymentCommandActionAuthorize), string(PaymentCommandActionCapture), string(PaymentCommandActionRelease),
+		string(PaymentCommandActionCaptureRelease), string(PaymentCommandActionCharge), string(PaymentCommandActionRefund),
+		string(PaymentCommandActionDeposit), string(PaymentCommandActionWithdraw))
+	if err != nil {
+		return err
+	}
+	*a = PaymentCommandAction(v)
+	return nil
+}
+
+func (s *PaymentCommandStatus) UnmarshalJSON(data []byte) error {
+	v, err := decode(data, "payment command status",
+		string(PaymentCommandStatusPending), string(PaymentCommandStatusComplete), string(PaymentCommandStatusError),
+		string(PaymentCommandStatusFailed), string(PaymentCommandStatusHeld), string(PaymentCommandStatusAwaitingApproval),
+		string(PaymentCommandStatusRejected))
+	if err != nil {
+		return err
+	}
+	*s = PaymentCommandStatus(v)
+	return nil
+}
+
+// UnmarshalJSON accepts the known outcomes, or an empty outcome for a command no policy evaluated
+func (o *PolicyOutcome) UnmarshalJSON(data []byte) error {
+	v, err := decode(data, "policy outcome", "",
+		string(PolicyOutcomeAllowed), string(PolicyOutcomeTrimmed), string(PolicyOutcomeHeld))
+	if err != nil {
+		return err
+	}
+	*o = PolicyOutcome(v)
+	return nil
+}
+
+func (s *ScheduledStateStatus) UnmarshalJSON(data []byte) error {
+	v, err := decode(data, "scheduled state status",
+		string(ScheduledStateStatusPending), string(ScheduledStateStatusApplied),
+		string(ScheduledStateStatusCancelled), string(ScheduledStateStatusFailed))
+	if err != nil {
+		return err
+	}
+	*s = ScheduledStateStatus(v)
+	return nil
+}
+
+func (s *InstallmentStatus) UnmarshalJSON(data []byte) error {
+	v, err := decode(data, "installment status",
+		string(InstallmentStatusPending), string(InstallmentStatusComplete), string(InstallmentStatusFailed))
+	if err != nil {
+		return err
+	}
+	*s = InstallmentStatus(v)
+	return nil
+}
+
+func (k *AuditEventKind) UnmarshalJSON(data []byte) error {
+	v, err := decode(data, "audit event kind",
+		string(AuditEventKindReceived), string(AuditEventKindPlanned), string(AuditEventKindRan))
+	if err != nil {
+		return err
+	}
+	*k = AuditEventKind(v)
+	return nil
+}
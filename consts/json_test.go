@@ -0,0 +1,42 @@
+package consts_test
+
+import (
+	"encoding/json"
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestUnmarshalJSON(t *testing.T) {
+	t.Run("Known values decode", func(t *testing.T) {
+		var action consts.PaymentCommandAction
+		assert.NoError(t, json.Unmarshal([]byte(`"capture-release"`), &action))
+		assert.Equal(t, consts.PaymentCommandActionCaptureRelease, action)
+		var status consts.PaymentCommandStatus
+		assert.NoError(t, json.Unmarshal([]byte(`"awaiting-approval"`), &status))
+		assert.Equal(t, consts.PaymentCommandStatusAwaitingApproval, status)
+	})
+	t.Run("Unknown values are rejected", func(t *testing.T) {
+		action := consts.PaymentCommandActionCharge
+		err := json.Unmarshal([]byte(`"steal"`), &action)
+		assert.True(t, errors.Is(err, errors.ErrInvalidEnum))
+		assert.Equal(t, consts.PaymentCommandActionCharge, action, "Value is unchanged on error")
+		var status consts.PaymentCommandStatus
+		assert.True(t, errors.Is(json.Unmarshal([]byte(`"Complete"`), &status), errors.ErrInvalidEnum), "Values are case sensitive")
+		assert.True(t, errors.Is(json.Unmarshal([]byte(`""`), &status), errors.ErrInvalidEnum))
+		var scheduled consts.ScheduledStateStatus
+		assert.True(t, errors.Is(json.Unmarshal([]byte(`"done"`), &scheduled), errors.ErrInvalidEnum))
+		var installment consts.InstallmentStatus
+		assert.True(t, errors.Is(json.Unmarshal([]byte(`"done"`), &installment), errors.ErrInvalidEnum))
+		assert.Error(t, json.Unmarshal([]byte(`3`), &status), "Values must be strings")
+	})
+	t.Run("Optional values may be empty", func(t *testing.T) {
+		var status consts.PaymentStatus
+		assert.NoError(t, json.Unmarshal([]byte(`""`), &status))
+		assert.True(t, errors.Is(json.Unmarshal([]byte(`"unknown"`), &status), errors.ErrInvalidEnum))
+		var outcome consts.PolicyOutcome
+		assert.NoError(t, json.Unmarshal([]byte(`""`), &outcome))
+		assert.True(t, errors.Is(json.Unmarshal([]byte(`"denied"`), &outcome), errors.ErrInvalidEnum))
+	})
+}
@@ -6,6 +6,11 @@ const (
 	PaymentStatusPending  PaymentStatus = "pending"
 	PaymentStatusComplete PaymentStatus = "complete"
 	PaymentStatusError    PaymentStatus = "error"
+	// PaymentStatusFailed payments will not reach their desired state without someone's attention
+	PaymentStatusFailed PaymentStatus = "failed"
+	// PaymentStatusRunning payments are having commands run, so their stored balances are about to change.  Only
+	// stored states are ever running.
+	PaymentStatusRunning PaymentStatus = "running"
 )
 
 type PaymentCommandAction string
@@ -28,4 +33,108 @@ const (
 	PaymentCommandStatusComplete PaymentCommandStatus = "complete"
 	PaymentCommandStatusError    PaymentCommandStatus = "error"
 	PaymentCommandStatusFailed   PaymentCommandStatus = "failed"
+	PaymentCommandStatusHeld     PaymentCommandStatus = "held"
+	// PaymentCommandStatusAwaitingApproval commands are not run until someone approves them
+	PaymentCommandStatusAwaitingApproval PaymentCommandStatus = "awaiting-approval"
+	PaymentCommandStatusRejected         PaymentCommandStatus = "rejected"
+)
+
+// paymentCommandTransitions are the statuses each status can move to.  Complete, failed and rejected are final.
+var paymentCommandTransitions = map[PaymentCommandStatus][]PaymentCommandStatus{
+	PaymentCommandStatusPending: {
+		PaymentCommandStatusComplete,
+		PaymentCommandStatusError,
+		PaymentCommandStatusFailed,
+		PaymentCommandStatusHeld,
+		PaymentCommandStatusAwaitingApproval,
+	},
+	// Errored commands go back to pending when they are retried
+	PaymentCommandStatusError:            {PaymentCommandStatusPending},
+	PaymentCommandStatusHeld:             {PaymentCommandStatusPending},
+	PaymentCommandStatusAwaitingApproval: {PaymentCommandStatusPending, PaymentCommandStatusRejected},
+}
+
+// CanTransitionTo reports whether a command with status s may move to status to
+func (s PaymentCommandStatus) CanTransitionTo(to PaymentCommandStatus) bool {
+	for _, next := range paymentCommandTransitions[s] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Terminal reports whether s is final
+func (s PaymentCommandStatus) Terminal() bool {
+	return len(paymentCommandTransitions[s]) == 0
+}
+
+type PolicyOutcome string
+
+const (
+	PolicyOutcomeAllowed PolicyOutcome = "allowed"
+	PolicyOutcomeTrimmed PolicyOutcome = "trimmed"
+	PolicyOutcomeHeld    PolicyOutcome = "held"
+)
+
+type ScheduledStateStatus string
+
+const (
+	ScheduledStateStatusPending   ScheduledStateStatus = "pending"
+	ScheduledStateStatusApplied   ScheduledStateStatus = "applied"
+	ScheduledStateStatusCancelled ScheduledStateStatus = "cancelled"
+	ScheduledStateStatusFailed    ScheduledStateStatus = "failed"
+)
+
+type AuditEventKind string
+
+const (
+	AuditEventKindReceived AuditEventKind = "received"
+	AuditEventKindPlanned  AuditEventKind = "planned"
+	AuditEventKindRan      AuditEventKind = "ran"
+)
+
+type InstallmentStatus string
+
+const (
+	InstallmentStatusPending  InstallmentStatus = "pending"
+	InstallmentStatusComplete InstallmentStatus = "complete"
+	InstallmentStatusFailed   InstallmentStatus = "failed"
+)
+
+// Capability is something a user handler's provider can do beyond what every UserHandler must
+type Capability string
+
+const (
+	// CapabilityPartialRelease providers can release part of an authorization and leave the rest authorized
+	CapabilityPartialRelease Capability = "partial-release"
+	// CapabilityPartialCapture providers can capture part of an authorization without releasing the rest, so captures
+	// and releases need not be made together through CaptureRelease
+	CapabilityPartialCapture Capability = "partial-capture"
+	// CapabilityMultiCapture providers can capture the same authorization more than once
+	CapabilityMultiCapture Capability = "multicapture"
+	// CapabilityIncrementalAuthorization providers can increase an existing authorization
+	CapabilityIncrementalAuthorization Capability = "incremental-authorization"
+	// CapabilityRefundUncaptured providers release an authorization by refunding its uncaptured funds, which must be
+	// done before anything more is captured from it
+	CapabilityRefundUncaptured Capability = "refund-uncaptured"
+)
+
+// LedgerAccount is an account of the ledger which balance movements are posted to
+type LedgerAccount string
+
+const (
+	// LedgerAccountUserReceivable is where users' money comes from, and goes back to
+	LedgerAccountUserReceivable LedgerAccount = "user-receivable"
+	// LedgerAccountAuthorizationHolds is money authorized but not yet captured or released
+	LedgerAccountAuthorizationHolds LedgerAccount = "authorization-holds"
+	// LedgerAccountProviderClearing is money captured at the provider which has not been paid to a partner or
+	// recognized as revenue
+	LedgerAccountProviderClearing LedgerAccount = "provider-clearing"
+	// LedgerAccountProviderFees is money the provider is estimated to have taken
+	LedgerAccountProviderFees LedgerAccount = "provider-fees"
+	// LedgerAccountPartnerPayable is money paid to partners
+	LedgerAccountPartnerPayable LedgerAccount = "partner-payable"
+	// LedgerAccountPlatformRevenue is the money the platform keeps
+	LedgerAccountPlatformRevenue LedgerAccount = "platform-revenue"
 )
@@ -1,6 +1,9 @@
 package errors
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var ErrUnderflow = errors.New("underflow detected")
 var ErrDifferentBucket = errors.New("cannot resolve payment states for different buckets")
@@ -10,4 +13,40 @@ var ErrDateInFuture = errors.New("date of desired state is in the future")
 var ErrLaterStateApplied = errors.New("desired state date is not the most current")
 var ErrRetryable = errors.New("retryable")
 var ErrChargeFailed = errors.New("charge failed")
+var ErrLockHeld = errors.New("lock is held elsewhere")
+var ErrLockLost = errors.New("lock lease was lost")
+var ErrStaleState = errors.New("state has changed since the resolution was generated")
+var ErrStateNotFound = errors.New("state not found")
+var ErrStateRunning = fmt.Errorf("state is being run elsewhere: %w", ErrStaleState)
+var ErrManagerClosed = errors.New("manager is closed")
+var ErrRateLimited = fmt.Errorf("rate limited: %w", ErrRetryable)
+var ErrCircuitOpen = fmt.Errorf("circuit breaker is open: %w", ErrRetryable)
+var ErrInvalidDesiredState = errors.New("desired state is invalid")
+var ErrApprovalNotFound = errors.New("approval request not found")
+var ErrAlreadyReviewed = errors.New("approval request has already been reviewed")
+var ErrOverLimit = errors.New("command is over a policy limit")
+var ErrScheduledStateNotFound = errors.New("scheduled state not found")
+var ErrScheduledStateNotPending = errors.New("scheduled state is no longer pending")
+var ErrInvalidPlan = errors.New("plan is invalid")
+var ErrSubscriptionCancelled = errors.New("subscription is cancelled")
+var ErrChangeOutOfOrder = errors.New("change must be after the previous change")
+var ErrInvalidInstallmentPlan = errors.New("installment plan is invalid")
+var ErrInstallmentNotFound = errors.New("installment not found")
+var ErrInstallmentNotFailed = errors.New("only failed installments can be rescheduled")
+var ErrInvalidEnum = errors.New("invalid enum value")
+var ErrUnsupportedVersion = errors.New("unsupported wire format version")
+var ErrUnknownKind = errors.New("unknown wire format kind")
+var ErrSchemaMismatch = errors.New("value does not match the wire format schema")
+var ErrIllegalTransition = errors.New("illegal payment command status transition")
+var ErrAuditChainBroken = errors.New("audit log hash chain is broken")
+var ErrUnknownBucket = errors.New("no tenant is configured for the bucket")
+var ErrUnknownProvider = errors.New("provider is not registered")
+var ErrInvalidTenant = errors.New("tenant configuration is invalid")
+var ErrReplayedFailure = errors.New("an earlier call with the same idempotency key failed")
+var ErrUnattributed = errors.New("provider record cannot be attributed to a payment")
+var ErrUnbalancedTransaction = errors.New("ledger transaction does not balance")
+var ErrLedgerMismatch = errors.New("ledger does not match the actual state")
+var ErrInvalidFeeSchedule = errors.New("fee schedule is invalid")
+var ErrChargesNotListed = errors.New("storage cannot list charges")
 var Is = errors.Is
+var As = errors.As
@@ -1,11 +1,16 @@
 package payments
 
 import (
+	"context"
+	"github.com/davidjwilkins/declarative-payments/clock"
 	"github.com/davidjwilkins/declarative-payments/consts"
 	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments/fees"
+	"github.com/davidjwilkins/declarative-payments/payments/locks"
 	"github.com/davidjwilkins/declarative-payments/payments/resolver"
 	"github.com/google/uuid"
 	"math"
+	"sort"
 	"sync"
 	"time"
 )
@@ -24,40 +29,260 @@ type UserHandler interface {
 	Refund(idempotencyKey string, amount uint) (uint, error)
 }
 
+// IncrementalAuthorizer may be implemented by a UserHandler which can increase an existing authorization instead of
+// making a new one.  Run uses it to authorize more when something is already authorized.
+type IncrementalAuthorizer interface {
+	IncrementAuthorization(idempotencyKey string, amount uint) error
+}
+
+// MultiCapturer may be implemented by a UserHandler which can capture part of an authorization while leaving the rest
+// authorized.  Run uses it instead of Capture.
+type MultiCapturer interface {
+	MultiCapture(idempotencyKey string, amount uint) (uint, error)
+}
+
+// CapabilityReporter may be implemented by a UserHandler to advertise what its provider can do, so that
+// GenerateResolution and Run can plan the cheapest correct commands for it.  Handlers which do not implement it are
+// assumed to release partially but not to capture partially, and to support incremental authorization and multicapture
+// if they implement IncrementalAuthorizer and MultiCapturer.
+type CapabilityReporter interface {
+	Capabilities() []consts.Capability
+}
+
+// Annotator may be implemented by a UserHandler or PartnerHandler to attach metadata to the objects it makes at its
+// provider.  Run annotates the idempotency key of each command with its metadata before running it, and with nil once
+// it has run, so the handler can forget it.
+type Annotator interface {
+	Annotate(idempotencyKey string, metadata map[string]string)
+}
+
+// The metadata keys identifying the payment a command was run for
+const (
+	MetadataBucket         = "bucket"
+	MetadataExternalID     = "external_id"
+	MetadataUserID         = "user_id"
+	MetadataPartnerID      = "partner_id"
+	MetadataDesiredStateID = "desired_state_id"
+)
+
+// commandMetadata is what a provider should record about cmd: the metadata of d, if cmd was generated for it, then the
+// metadata of cmd, then the identifiers of the payment, which cannot be overridden.
+func commandMetadata(state ActualState, d resolver.DesiredState, cmd resolver.PaymentCommand) map[string]string {
+	metadata := make(map[string]string)
+	if d.ID == cmd.DesiredStateID {
+		for k, v := range d.Metadata {
+			metadata[k] = v
+		}
+	}
+	for k, v := range cmd.Metadata {
+		metadata[k] = v
+	}
+	metadata[MetadataBucket] = state.Bucket
+	metadata[MetadataExternalID] = state.ExternalID.String()
+	metadata[MetadataUserID] = state.UserID.String()
+	metadata[MetadataPartnerID] = state.PartnerID.String()
+	metadata[MetadataDesiredStateID] = cmd.DesiredStateID.String()
+	return metadata
+}
+
+// capabilities is the set of capabilities a user handler has
+type capabilities map[consts.Capability]bool
+
+// Capabilities returns what user can do, as GenerateResolution and Run see it.  Handlers which wrap another can
+// advertise these on its behalf.
+func Capabilities(user UserHandler) []consts.Capability {
+	var list []consts.Capability
+	for c := range capabilitiesOf(user) {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i] < list[j]
+	})
+	return list
+}
+
+// canCaptureIncrements reports whether an authorization can be increased and then captured without releasing the rest
+func (c capabilities) canCaptureIncrements() bool {
+	return c[consts.CapabilityIncrementalAuthorization] &&
+		(c[consts.CapabilityPartialCapture] || c[consts.CapabilityMultiCapture])
+}
+
+// capabilitiesOf returns the capabilities of user.  Incremental authorization and multicapture are only included if user
+// implements the interface for them.
+func capabilitiesOf(user UserHandler) capabilities {
+	caps := capabilities{}
+	if reporter, ok := user.(CapabilityReporter); ok {
+		for _, c := range reporter.Capabilities() {
+			caps[c] = true
+		}
+	} else {
+		caps[consts.CapabilityPartialRelease] = true
+		caps[consts.CapabilityIncrementalAuthorization] = true
+		caps[consts.CapabilityMultiCapture] = true
+	}
+	if _, ok := user.(IncrementalAuthorizer); !ok {
+		delete(caps, consts.CapabilityIncrementalAuthorization)
+	}
+	if _, ok := user.(MultiCapturer); !ok {
+		delete(caps, consts.CapabilityMultiCapture)
+	}
+	return caps
+}
+
+// Validator checks a desired state before it is resolved
+type Validator interface {
+	Validate(d resolver.DesiredState) error
+}
+
+// Policy is consulted between GenerateResolution and Run.  It may trim commands, or hold them so that Run skips them,
+// recording its decision on each command it evaluates.
+type Policy interface {
+	Evaluate(state ActualState, cmds []resolver.PaymentCommand) []resolver.PaymentCommand
+}
+
+// CommandObserver is told the outcome of the commands every time Run runs them
+type CommandObserver interface {
+	Observe(state ActualState, cmds []resolver.PaymentCommand)
+}
+
+// ResolutionObserver may be implemented by a CommandObserver to also be told about every desired state Resolve
+// receives, and the plan generated for it once the policies have evaluated it.  err is set if no plan was generated.
+type ResolutionObserver interface {
+	Received(state ActualState, d resolver.DesiredState)
+	Planned(state ActualState, d resolver.DesiredState, cmds []resolver.PaymentCommand, err error)
+}
+
 type ActualState struct {
 	resolver.DesiredState
-	Status consts.PaymentStatus
+	// Status is derived by Run from the outcome of the commands, and whether the balances reached LastDesiredState
+	Status consts.PaymentStatus `json:"status"`
+	// LastDesiredState is the desired state most recently resolved towards
+	LastDesiredState resolver.DesiredState `json:"last_desired_state"`
+	// Version increases every time a resolution is applied to the state
+	Version uint64 `json:"version"`
+	// ProviderFees is what the provider is estimated to have taken of the captures and charges made
+	ProviderFees uint `json:"provider_fees,omitempty"`
+	// PlatformRevenue is what the platform keeps: Amount less PartnerAmount and ProviderFees
+	PlatformRevenue int `json:"platform_revenue,omitempty"`
+}
+
+// UpdateRevenue sets PlatformRevenue from the balances and provider fees of s
+func (s *ActualState) UpdateRevenue() {
+	s.PlatformRevenue = s.Amount - s.PartnerAmount - int(s.ProviderFees)
 }
 
 type handler struct {
 	partner      PartnerHandler
 	user         UserHandler
+	capabilities capabilities
 	currentState *ActualState
+	locker       locks.Locker
+	lockTTL      time.Duration
+	store        StateStore
+	validator    Validator
+	policies     []Policy
+	observers    []CommandObserver
+	fees         map[string]fees.Fees
+	clock        clock.Clock
+	// execute runs each command of Run.  By default every command gets its own goroutine.
+	execute func(fn func())
+	// planned is the desired state GenerateResolution last generated commands for
+	planned *resolver.DesiredState
+	// resolving serializes Resolve within this process; locker serializes it across processes
+	resolving sync.Mutex
 	sync.RWMutex
 }
 
-func (h handler) UserID() uuid.UUID {
-	return h.currentState.UserID
+type Option func(h *handler)
+
+const DefaultLockTTL = 30 * time.Second
+
+// WithLocker makes Resolve hold a lease from locker, renewed every ttl/2, while it generates and runs a resolution
+func WithLocker(locker locks.Locker, ttl time.Duration) Option {
+	return func(h *handler) {
+		if ttl <= 0 {
+			ttl = DefaultLockTTL
+		}
+		h.locker = locker
+		h.lockTTL = ttl
+	}
+}
+
+// WithStateStore makes the handler persist its state to store after every Run, and refuse to run plans generated from a
+// version other than the stored one.
+func WithStateStore(store StateStore) Option {
+	return func(h *handler) {
+		h.store = store
+	}
+}
+
+// WithValidator makes GenerateResolution reject desired states which fail validation
+func WithValidator(validator Validator) Option {
+	return func(h *handler) {
+		h.validator = validator
+	}
+}
+
+// WithPolicy adds a policy to be consulted by Resolve.  Policies are consulted in the order they are added.
+func WithPolicy(policy Policy) Option {
+	return func(h *handler) {
+		h.policies = append(h.policies, policy)
+	}
+}
+
+func WithObserver(observer CommandObserver) Option {
+	return func(h *handler) {
+		h.observers = append(h.observers, observer)
+	}
+}
+
+// WithFees sets the fees of each bucket, as tenant.Registry.Fees returns them.  Provider fees are estimated for every
+// capture and charge, and desired states can ask for their partner amount to be what is left once fees are taken.
+// Buckets without fees take none.
+func WithFees(buckets map[string]fees.Fees) Option {
+	return func(h *handler) {
+		h.fees = buckets
+	}
+}
+
+// WithClock sets the clock desired state dates are compared against, and leases from WithLocker are renewed on
+func WithClock(c clock.Clock) Option {
+	return func(h *handler) {
+		h.clock = c
+	}
+}
+
+func (h *handler) UserID() uuid.UUID {
+	return h.CurrentState().UserID
 }
 
-func (h handler) PartnerID() uuid.UUID {
-	return h.currentState.PartnerID
+func (h *handler) PartnerID() uuid.UUID {
+	return h.CurrentState().PartnerID
 }
 
-func (h handler) ExternalID() uuid.UUID {
-	return h.currentState.ExternalID
+func (h *handler) ExternalID() uuid.UUID {
+	return h.CurrentState().ExternalID
 }
 
-func (h handler) Bucket() string {
-	return h.currentState.Bucket
+func (h *handler) Bucket() string {
+	return h.CurrentState().Bucket
 }
 
-func NewHandler(currentState *ActualState, partnerHandler PartnerHandler, userHandler UserHandler) *handler {
-	return &handler{
+func NewHandler(currentState *ActualState, partnerHandler PartnerHandler, userHandler UserHandler, opts ...Option) *handler {
+	h := &handler{
 		partner:      partnerHandler,
 		user:         userHandler,
 		currentState: currentState,
+		clock:        clock.System,
+		execute: func(fn func()) {
+			go fn()
+		},
+	}
+	for _, opt := range opts {
+		opt(h)
 	}
+	h.capabilities = capabilitiesOf(userHandler)
+	return h
 }
 
 func (h *handler) CurrentState() ActualState {
@@ -67,22 +292,250 @@ func (h *handler) CurrentState() ActualState {
 	return *state
 }
 
+// Run runs cmds, and stamps them with the resulting state version so that any which errored can be run again.  The
+// runnable commands must have been generated from the current version, and with a StateStore, from the stored version
+// too.  Otherwise none of them are run and errors.ErrStaleState is returned.
+//
+// With a StateStore, the state is saved as running under the next version before any command is run, so that no other
+// writer can plan from the balances the commands are changing, and its outcome is saved under the version after that.
+// If nothing is runnable, as when every command awaits approval, the version is kept, so that the commands can still
+// be run once they are released.
+//
+// If cmds were generated by GenerateResolution, the desired state they were generated for becomes the state's
+// LastDesiredState.  The state's Status is then derived from the outcome of cmds.
 func (h *handler) Run(cmds []resolver.PaymentCommand) ([]resolver.PaymentCommand, []error) {
+	anyRunnable := false
+	for _, cmd := range cmds {
+		if runnable(cmd) {
+			anyRunnable = true
+		}
+	}
+	desired, planned := h.desiredFor(cmds)
+	if !anyRunnable {
+		return h.settleUnrun(cmds, desired, planned)
+	}
+	if h.store != nil {
+		if err := h.claim(cmds); err != nil {
+			return cmds, []error{err}
+		}
+	} else if err := h.advance(cmds); err != nil {
+		return cmds, []error{err}
+	}
+	known := desired
+	if !planned {
+		// The commands may be being retried, so were likely generated for the last desired state
+		known = h.CurrentState().LastDesiredState
+	}
+	cmds, errs := h.run(cmds, known)
+	h.Lock()
+	*h.currentState = settle(*h.currentState, desired, planned, cmds)
+	if h.store != nil {
+		h.currentState.Version++
+	}
+	state := *h.currentState
+	h.Unlock()
+	if h.store != nil {
+		if err := h.store.Save(state, state.Version-1); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for i := range cmds {
+		cmds[i].StateVersion = state.Version
+	}
+	for _, observer := range h.observers {
+		observer.Observe(state, cmds)
+	}
+	return cmds, errs
+}
+
+// settleUnrun records the outcome of cmds when none of them can be run.  The balances they were generated from still
+// stand, so the version is kept.
+func (h *handler) settleUnrun(cmds []resolver.PaymentCommand, desired resolver.DesiredState, planned bool) ([]resolver.PaymentCommand, []error) {
+	state := h.CurrentState()
+	next := settle(state, desired, planned, cmds)
+	if next.Status == state.Status && next.LastDesiredState.ID == state.LastDesiredState.ID {
+		return cmds, nil
+	}
+	if h.store != nil {
+		if err := h.store.Save(next, next.Version); err != nil {
+			return cmds, []error{err}
+		}
+	}
+	h.Lock()
+	*h.currentState = next
+	h.Unlock()
+	for i := range cmds {
+		cmds[i].StateVersion = next.Version
+	}
+	for _, observer := range h.observers {
+		observer.Observe(next, cmds)
+	}
+	return cmds, nil
+}
+
+// desiredFor returns the desired state cmds were generated for, if GenerateResolution generated them
+func (h *handler) desiredFor(cmds []resolver.PaymentCommand) (resolver.DesiredState, bool) {
+	h.RLock()
+	defer h.RUnlock()
+	if h.planned == nil {
+		return resolver.DesiredState{}, false
+	}
+	for _, cmd := range cmds {
+		if cmd.DesiredStateID != h.planned.ID {
+			return resolver.DesiredState{}, false
+		}
+	}
+	return *h.planned, true
+}
+
+// settle records desired as the last desired state of state, if it is known, updates its revenue, and derives the
+// status of state from cmds.  A failed or rejected command fails the payment, and one which errored will be retried.
+// Otherwise, it is complete once the balances reach the last desired state, and pending until then.
+func settle(state ActualState, desired resolver.DesiredState, planned bool, cmds []resolver.PaymentCommand) ActualState {
+	if planned {
+		state.LastDesiredState = desired
+		state.Date = desired.Date
+	}
+	state.UpdateRevenue()
+	state.Status = consts.PaymentStatusComplete
+	for _, cmd := range cmds {
+		switch cmd.Status {
+		case consts.PaymentCommandStatusFailed, consts.PaymentCommandStatusRejected:
+			state.Status = consts.PaymentStatusFailed
+			return state
+		case consts.PaymentCommandStatusError:
+			state.Status = consts.PaymentStatusError
+		case consts.PaymentCommandStatusComplete:
+		default:
+			if state.Status == consts.PaymentStatusComplete {
+				state.Status = consts.PaymentStatusPending
+			}
+		}
+	}
+	if state.Status == consts.PaymentStatusComplete && !reached(state) {
+		state.Status = consts.PaymentStatusPending
+	}
+	return state
+}
+
+// reached reports whether the balances of state are those of its last desired state, if it has one
+func reached(state ActualState) bool {
+	d := state.LastDesiredState
+	return d.ID == uuid.Nil || (state.Amount == d.Amount && state.AuthorizedAmount == d.AuthorizedAmount &&
+		state.PartnerAmount == d.PartnerAmount)
+}
+
+// claim checks that cmds were generated from the stored version of the state, and takes the next version for them,
+// saved as running, so that no other writer can apply a plan generated from the same version, nor plan from the
+// balances the commands are about to change.
+func (h *handler) claim(cmds []resolver.PaymentCommand) error {
+	h.Lock()
+	defer h.Unlock()
+	stored, err := h.store.Load(h.currentState.ExternalID)
+	if errors.Is(err, errors.ErrStateNotFound) {
+		stored = *h.currentState
+	} else if err != nil {
+		return err
+	}
+	if stored.Status == consts.PaymentStatusRunning {
+		return errors.ErrStateRunning
+	}
+	if stored.Version != h.currentState.Version {
+		return errors.ErrStaleState
+	}
+	if err := current(cmds, stored.Version); err != nil {
+		return err
+	}
+	next := *h.currentState
+	next.Version++
+	next.Status = consts.PaymentStatusRunning
+	if err := h.store.Save(next, stored.Version); err != nil {
+		return err
+	}
+	h.currentState.Version = next.Version
+	return nil
+}
+
+// current returns errors.ErrStaleState unless every runnable command of cmds was generated from version
+func current(cmds []resolver.PaymentCommand, version uint64) error {
+	for _, cmd := range cmds {
+		if runnable(cmd) && cmd.StateVersion != version {
+			return errors.ErrStaleState
+		}
+	}
+	return nil
+}
+
+// advance moves the current state to the next version before cmds are run, when there is no StateStore to claim it in
+func (h *handler) advance(cmds []resolver.PaymentCommand) error {
+	h.Lock()
+	defer h.Unlock()
+	if err := current(cmds, h.currentState.Version); err != nil {
+		return err
+	}
+	h.currentState.Version++
+	return nil
+}
+
+// refresh replaces the current state with the stored one, if it is newer.  It returns errors.ErrStateRunning if the
+// stored state is being run, as its balances are about to change.
+func (h *handler) refresh() error {
+	if h.store == nil {
+		return nil
+	}
+	h.Lock()
+	defer h.Unlock()
+	stored, err := h.store.Load(h.currentState.ExternalID)
+	if errors.Is(err, errors.ErrStateNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if stored.Status == consts.PaymentStatusRunning {
+		return errors.ErrStateRunning
+	}
+	if stored.Version > h.currentState.Version {
+		*h.currentState = stored
+	}
+	return nil
+}
+
+// runnable reports whether Run should run cmd.  Only pending commands, and errored ones being retried, are run; those
+// which are held, awaiting approval, or in a final status are skipped.
+func runnable(cmd resolver.PaymentCommand) bool {
+	return cmd.Status.CanTransitionTo(consts.PaymentCommandStatusComplete) ||
+		cmd.Status == consts.PaymentCommandStatusError
+}
+
+// run runs the runnable cmds.  d is the desired state they are believed to be generated for, whose metadata is passed
+// on to the provider.
+func (h *handler) run(cmds []resolver.PaymentCommand, d resolver.DesiredState) ([]resolver.PaymentCommand, []error) {
 	var wg sync.WaitGroup
 	var errs []error
 	var locker sync.Mutex
-	wg.Add(len(cmds))
 
-	// Some providers release the remainder when capturing.  For these, we need to know how much to release and capture
-	// at the same time, so the handler can reauthorize as appropriate
+	// Providers which cannot capture part of an authorization release the remainder when capturing, and those which
+	// cannot release part of one reauthorize the remainder when releasing.  For these, we need to know how much to
+	// release and capture at the same time, so the handler can reauthorize as appropriate
 	var captureRelease struct{
 		capture *resolver.PaymentCommand
 		captureIndex int
 		release *resolver.PaymentCommand
 		releaseIndex int
 	}
+	caps := h.capabilities
+	incremental, _ := h.user.(IncrementalAuthorizer)
+	multi, _ := h.user.(MultiCapturer)
+	// Authorizations are run before everything else, since captures may be planned from them
+	var authorizations, others []int
 	for i := range cmds {
+		if !runnable(cmds[i]) {
+			continue
+		}
 		switch cmds[i].Action {
+		case consts.PaymentCommandActionAuthorize:
+			authorizations = append(authorizations, i)
+			continue
 		case consts.PaymentCommandActionCapture:
 			captureRelease.capture = &cmds[i]
 			captureRelease.captureIndex = i
@@ -90,136 +543,246 @@ func (h *handler) Run(cmds []resolver.PaymentCommand) ([]resolver.PaymentCommand
 			captureRelease.release = &cmds[i]
 			captureRelease.releaseIndex = i
 		}
+		others = append(others, i)
+	}
+	state := h.CurrentState()
+	providerFee := h.fees[state.Bucket].Provider
+	annotate := func(cmd resolver.PaymentCommand) (done func()) {
+		var handler interface{} = h.user
+		if cmd.Action == consts.PaymentCommandActionDeposit || cmd.Action == consts.PaymentCommandActionWithdraw {
+			handler = h.partner
+		}
+		annotator, ok := handler.(Annotator)
+		if !ok {
+			return func() {}
+		}
+		key := cmd.ID.String()
+		annotator.Annotate(key, commandMetadata(state, d, cmd))
+		return func() {
+			annotator.Annotate(key, nil)
+		}
 	}
+	paired := captureRelease.capture != nil && captureRelease.release != nil &&
+		!(caps[consts.CapabilityPartialCapture] && caps[consts.CapabilityPartialRelease])
 
 	handleErr := func(err error, i int) {
+		to := consts.PaymentCommandStatusComplete
 		if err != nil {
 			locker.Lock()
 			errs = append(errs, err)
 			locker.Unlock()
 			cmds[i].Error = err.Error()
 			if errors.Is(err, errors.ErrRetryable) {
-				cmds[i].Status = consts.PaymentCommandStatusError
+				to = consts.PaymentCommandStatusError
 			} else {
-				cmds[i].Status = consts.PaymentCommandStatusFailed
+				to = consts.PaymentCommandStatusFailed
 			}
-		} else {
-			cmds[i].Status = consts.PaymentCommandStatusComplete
+		}
+		var transitionErr error
+		if cmds[i].Status == consts.PaymentCommandStatusError {
+			// Errored commands are retried from pending
+			transitionErr = cmds[i].Transition(consts.PaymentCommandStatusPending)
+		}
+		if transitionErr == nil {
+			transitionErr = cmds[i].Transition(to)
+		}
+		if transitionErr != nil {
+			locker.Lock()
+			errs = append(errs, transitionErr)
+			locker.Unlock()
 		}
 	}
-	for i := range cmds {
-		go func(i int) {
-			defer wg.Done()
-			key := cmds[i].ID.String()
-			cmds[i].Error = ""
-			var err error
-			switch cmds[i].Action {
-			case consts.PaymentCommandActionAuthorize:
-				err = h.user.Authorize(key, cmds[i].Amount)
-				if err == nil {
-					h.Lock()
-					h.currentState.AuthorizedAmount += cmds[i].Amount
-					h.Unlock()
+	for _, phase := range [][]int{authorizations, others} {
+		for _, i := range phase {
+			i := i
+			wg.Add(1)
+			h.execute(func() {
+				defer wg.Done()
+				if cmds[i].Action == consts.PaymentCommandActionRelease && paired {
+					// The release is run along with the capture
+					return
 				}
-			case consts.PaymentCommandActionCapture:
-				// Some handlers do not support incremental capturing - when you capture, the remainder is released.  For
-				// these, they will need to know how much to capture and release at the same time.
-				if captureRelease.release == nil {
-					var captured uint
-					captured, err = h.user.Capture(key, cmds[i].Amount)
+				defer annotate(cmds[i])()
+				key := cmds[i].ID.String()
+				cmds[i].Error = ""
+				var err error
+				switch cmds[i].Action {
+				case consts.PaymentCommandActionAuthorize:
+					if caps[consts.CapabilityIncrementalAuthorization] && h.CurrentState().AuthorizedAmount > 0 {
+						err = incremental.IncrementAuthorization(key, cmds[i].Amount)
+					} else {
+						err = h.user.Authorize(key, cmds[i].Amount)
+					}
 					if err == nil {
 						h.Lock()
-						h.currentState.AuthorizedAmount -= captured
-						h.currentState.Amount += int(captured)
+						h.currentState.AuthorizedAmount += cmds[i].Amount
 						h.Unlock()
+						cmds[i].Settled = cmds[i].Amount
+					}
+				case consts.PaymentCommandActionCapture:
+					if !paired {
+						var captured uint
+						if caps[consts.CapabilityMultiCapture] {
+							captured, err = multi.MultiCapture(key, cmds[i].Amount)
+						} else {
+							captured, err = h.user.Capture(key, cmds[i].Amount)
+						}
+						if err == nil {
+							h.Lock()
+							h.currentState.AuthorizedAmount -= captured
+							h.currentState.Amount += int(captured)
+							cmds[i].Settled, cmds[i].ProviderFee = captured, providerFee.Of(captured)
+							h.currentState.ProviderFees += cmds[i].ProviderFee
+							h.Unlock()
+						}
+					} else {
+						var captured, released uint
+						var releaseErr error
+						captureKey, releaseKey := captureRelease.capture.ID.String(), captureRelease.release.ID.String()
+						defer annotate(*captureRelease.release)()
+						if caps[consts.CapabilityMultiCapture] {
+							// Capturing leaves the remainder authorized, so release it separately.  This is done in
+							// sequence rather than concurrently, since both act on the same authorizations.  Releasing
+							// by refund must happen first, as it would otherwise refund what was just captured.
+							if caps[consts.CapabilityRefundUncaptured] {
+								released, releaseErr = h.user.Release(releaseKey, captureRelease.release.Amount)
+								captured, err = multi.MultiCapture(captureKey, captureRelease.capture.Amount)
+							} else {
+								captured, err = multi.MultiCapture(captureKey, captureRelease.capture.Amount)
+								released, releaseErr = h.user.Release(releaseKey, captureRelease.release.Amount)
+							}
+						} else {
+							captured, err, released, releaseErr = h.user.CaptureRelease(captureKey, captureRelease.capture.Amount, releaseKey, captureRelease.release.Amount)
+						}
+						if err == nil {
+							h.Lock()
+							h.currentState.AuthorizedAmount -= captured
+							h.currentState.Amount += int(captured)
+							cmds[i].Settled, cmds[i].ProviderFee = captured, providerFee.Of(captured)
+							h.currentState.ProviderFees += cmds[i].ProviderFee
+							h.Unlock()
+						}
+						if releaseErr == nil {
+							h.Lock()
+							h.currentState.AuthorizedAmount -= released
+							h.Unlock()
+							cmds[captureRelease.releaseIndex].Settled = released
+						}
+						cmds[captureRelease.releaseIndex].Error = ""
+						cmds[captureRelease.releaseIndex].Attempts++
+						handleErr(releaseErr, captureRelease.releaseIndex)
 					}
-				} else {
-					var captured, released uint
-					captured, captureErr, released, releaseErr := h.user.CaptureRelease(captureRelease.capture.ID.String(), captureRelease.capture.Amount, captureRelease.release.ID.String(), captureRelease.release.Amount)
-					if captureErr == nil {
+				case consts.PaymentCommandActionRelease:
+					var released uint
+					released, err = h.user.Release(key, cmds[i].Amount)
+					if err == nil {
 						h.Lock()
-						h.currentState.AuthorizedAmount -= captured
-						h.currentState.Amount += int(captured)
+						h.currentState.AuthorizedAmount -= released
 						h.Unlock()
+						cmds[i].Settled = released
 					}
-					if releaseErr == nil {
+				case consts.PaymentCommandActionCharge:
+					err = h.user.Charge(key, cmds[i].Amount)
+					if err == nil {
 						h.Lock()
-						h.currentState.AuthorizedAmount -= released
+						h.currentState.Amount += int(cmds[i].Amount)
+						cmds[i].Settled, cmds[i].ProviderFee = cmds[i].Amount, providerFee.Of(cmds[i].Amount)
+						h.currentState.ProviderFees += cmds[i].ProviderFee
 						h.Unlock()
 					}
-					handleErr(captureErr, captureRelease.captureIndex)
-					handleErr(releaseErr, captureRelease.releaseIndex)
-				}
-			case consts.PaymentCommandActionRelease:
-				if captureRelease.capture == nil {
-					var released uint
-					released, err = h.user.Release(key, cmds[i].Amount)
+				case consts.PaymentCommandActionRefund:
+					var refunded uint
+					refunded, err = h.user.Refund(key, cmds[i].Amount)
 					if err == nil {
 						h.Lock()
-						h.currentState.AuthorizedAmount -= released
+						h.currentState.Amount -= int(refunded)
 						h.Unlock()
+						cmds[i].Settled = refunded
+					}
+				case consts.PaymentCommandActionDeposit:
+					err = h.partner.Deposit(key, cmds[i].Amount)
+					if err == nil {
+						h.Lock()
+						h.currentState.PartnerAmount += int(cmds[i].Amount)
+						h.Unlock()
+						cmds[i].Settled = cmds[i].Amount
+					}
+				case consts.PaymentCommandActionWithdraw:
+					err = h.partner.Withdraw(key, cmds[i].Amount)
+					if err == nil {
+						h.Lock()
+						h.currentState.PartnerAmount -= int(cmds[i].Amount)
+						h.Unlock()
+						cmds[i].Settled = cmds[i].Amount
 					}
 				}
-			case consts.PaymentCommandActionCharge:
-				err = h.user.Charge(key, cmds[i].Amount)
-				if err == nil {
-					h.Lock()
-					h.currentState.Amount += int(cmds[i].Amount)
-					h.Unlock()
-				}
-			case consts.PaymentCommandActionRefund:
-				var refunded uint
-				refunded, err = h.user.Refund(key, cmds[i].Amount)
-				if err == nil {
-					h.Lock()
-					h.currentState.Amount -= int(refunded)
-					h.Unlock()
-				}
-			case consts.PaymentCommandActionDeposit:
-				err = h.partner.Deposit(key, cmds[i].Amount)
-				if err == nil {
-					h.Lock()
-					h.currentState.PartnerAmount += int(cmds[i].Amount)
-					h.Unlock()
-				}
-			case consts.PaymentCommandActionWithdraw:
-				err = h.partner.Withdraw(key, cmds[i].Amount)
-				if err == nil {
-					h.Lock()
-					h.currentState.PartnerAmount -= int(cmds[i].Amount)
-					h.Unlock()
-				}
-			}
-			cmds[i].Attempts++
-			handleErr(err, i)
-		}(i)
+				cmds[i].Attempts++
+				handleErr(err, i)
+			})
+		}
+		wg.Wait()
 	}
-
-	wg.Wait()
 	return cmds, errs
 }
 
-func (h handler) GenerateResolution(d resolver.DesiredState) ([]resolver.PaymentCommand, error) {
-	if d.Bucket != h.currentState.Bucket {
+// net sets the partner amount of d to what is left once fees are taken, if it asks for that.  The provider fees already
+// taken by the current state are used, so only what is still to be collected is estimated.
+func (h *handler) net(d resolver.DesiredState) resolver.DesiredState {
+	if d.PartnerAmountNetOfFees {
+		state := h.CurrentState()
+		d.PartnerAmount = h.fees[d.Bucket].Net(d.Amount, state.Amount, state.ProviderFees)
+	}
+	return d
+}
+
+// GenerateResolution returns the commands which will move the current state to d, stamped with the state version they
+// were generated from.
+func (h *handler) GenerateResolution(d resolver.DesiredState) ([]resolver.PaymentCommand, error) {
+	return h.resolution(h.net(d))
+}
+
+// resolution is GenerateResolution for a desired state whose fees have already been taken
+func (h *handler) resolution(d resolver.DesiredState) ([]resolver.PaymentCommand, error) {
+	if h.validator != nil {
+		if err := h.validator.Validate(d); err != nil {
+			return nil, err
+		}
+	}
+	state := h.CurrentState()
+	cmds, err := generateResolution(state, d, h.clock.Now(), h.capabilities)
+	if err != nil {
+		return nil, err
+	}
+	for i := range cmds {
+		cmds[i].StateVersion = state.Version
+	}
+	h.Lock()
+	h.planned = &d
+	h.Unlock()
+	return cmds, nil
+}
+
+func generateResolution(currentState ActualState, d resolver.DesiredState, now time.Time, caps capabilities) ([]resolver.PaymentCommand, error) {
+	if d.Bucket != currentState.Bucket {
 		return nil, errors.ErrDifferentBucket
 	}
-	if d.UserID != h.currentState.UserID {
+	if d.UserID != currentState.UserID {
 		return nil, errors.ErrDifferentUser
 	}
-	if d.PartnerID != h.currentState.PartnerID {
+	if d.PartnerID != currentState.PartnerID {
 		return nil, errors.ErrDifferentPartner
 	}
-	if d.Date.After(time.Now()) {
+	if d.Date.After(now) {
 		return nil, errors.ErrDateInFuture
 	}
-	if d.Date.Before(h.currentState.Date) {
+	if d.Date.Before(currentState.Date) {
 		return nil, errors.ErrLaterStateApplied
 	}
-	currentUserBalance := h.currentState.Amount
+	currentUserBalance := currentState.Amount
 	desiredUserBalance := d.Amount
 	chargeAmount := desiredUserBalance - currentUserBalance
 
-	currentAuthorizedBalance := h.currentState.AuthorizedAmount
+	currentAuthorizedBalance := currentState.AuthorizedAmount
 	desiredAuthorizedBalance := d.AuthorizedAmount
 	if currentAuthorizedBalance > math.MaxInt || desiredAuthorizedBalance > math.MaxInt {
 		return nil, errors.ErrUnderflow
@@ -245,6 +808,13 @@ func (h handler) GenerateResolution(d resolver.DesiredState) ([]resolver.Payment
 			}
 		}
 	}
+	if chargeAmount > 0 && authorizeAmount >= 0 && currentAuthorizedBalance > 0 && caps.canCaptureIncrements() {
+		// Rather than charging again, increase the existing authorization and capture from it, so the payment stays on
+		// one authorization.  This is on top of anything already being captured from the existing authorization.
+		authorizeAmount += chargeAmount
+		captureAmount += chargeAmount
+		chargeAmount = 0
+	}
 
 	cmds := []resolver.PaymentCommand{}
 
@@ -263,7 +833,7 @@ func (h handler) GenerateResolution(d resolver.DesiredState) ([]resolver.Payment
 		cmds = append(cmds, d.Refund(uint(-chargeAmount)))
 	}
 
-	partnerAmount := h.currentState.PartnerAmount
+	partnerAmount := currentState.PartnerAmount
 	desiredPartnerAmount := d.PartnerAmount
 	depositAmount := desiredPartnerAmount - partnerAmount
 	if depositAmount > 0 {
@@ -273,3 +843,56 @@ func (h handler) GenerateResolution(d resolver.DesiredState) ([]resolver.Payment
 	}
 	return cmds, nil
 }
+
+// Resolve generates the resolution for d and runs it.  If the handler has a Locker, the lock for this payment is held
+// for the duration, so that no other process can resolve it concurrently.
+func (h *handler) Resolve(ctx context.Context, d resolver.DesiredState) ([]resolver.PaymentCommand, []error) {
+	h.resolving.Lock()
+	defer h.resolving.Unlock()
+	if h.locker != nil {
+		lease, err := h.locker.Acquire(ctx, locks.Key(h.Bucket(), h.UserID(), h.PartnerID(), h.ExternalID()), h.lockTTL)
+		if err != nil {
+			return nil, []error{err}
+		}
+		stop := locks.KeepAlive(lease, h.lockTTL, h.clock)
+		cmds, errs := h.resolve(d)
+		renewErr := stop()
+		releaseErr := lease.Release(ctx)
+		if renewErr != nil {
+			errs = append(errs, renewErr)
+		} else if releaseErr != nil {
+			errs = append(errs, releaseErr)
+		}
+		return cmds, errs
+	}
+	return h.resolve(d)
+}
+
+func (h *handler) resolve(d resolver.DesiredState) ([]resolver.PaymentCommand, []error) {
+	if err := h.refresh(); err != nil {
+		return nil, []error{err}
+	}
+	var observers []ResolutionObserver
+	for _, observer := range h.observers {
+		if o, ok := observer.(ResolutionObserver); ok {
+			observers = append(observers, o)
+		}
+	}
+	for _, o := range observers {
+		o.Received(h.CurrentState(), d)
+	}
+	d = h.net(d)
+	cmds, err := h.resolution(d)
+	if err == nil {
+		for _, policy := range h.policies {
+			cmds = policy.Evaluate(h.CurrentState(), cmds)
+		}
+	}
+	for _, o := range observers {
+		o.Planned(h.CurrentState(), d, cmds, err)
+	}
+	if err != nil {
+		return nil, []error{err}
+	}
+	return h.Run(cmds)
+}
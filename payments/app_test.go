@@ -1,15 +1,24 @@
 package payments_test
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"github.com/davidjwilkins/declarative-payments/clock"
 	"github.com/davidjwilkins/declarative-payments/consts"
 	"github.com/davidjwilkins/declarative-payments/errors"
 	"github.com/davidjwilkins/declarative-payments/payments"
 	"github.com/davidjwilkins/declarative-payments/payments/handlers"
+	"github.com/davidjwilkins/declarative-payments/payments/locks"
 	"github.com/davidjwilkins/declarative-payments/payments/resolver"
+	"github.com/davidjwilkins/declarative-payments/payments/validation"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/client"
+	"github.com/stripe/stripe-go/v72/form"
 	"math"
+	"sync"
 	"testing"
 	"time"
 )
@@ -17,6 +26,7 @@ import (
 type Handler interface {
 	Run(cmds []resolver.PaymentCommand) ([]resolver.PaymentCommand, []error)
 	GenerateResolution(d resolver.DesiredState) ([]resolver.PaymentCommand, error)
+	Resolve(ctx context.Context, d resolver.DesiredState) ([]resolver.PaymentCommand, []error)
 	UserID() uuid.UUID
 	PartnerID() uuid.UUID
 	ExternalID() uuid.UUID
@@ -25,6 +35,10 @@ type Handler interface {
 }
 
 func withErrorsMockHandler(fns ...func(as *payments.ActualState)) (Handler, *payments.ActualState, resolver.DesiredState, func(string, error), func(string, error)) {
+	return withOptionsMockHandler(nil, fns...)
+}
+
+func withOptionsMockHandler(opts []payments.Option, fns ...func(as *payments.ActualState)) (Handler, *payments.ActualState, resolver.DesiredState, func(string, error), func(string, error)) {
 	userHandler := handlers.NewUserMock()
 	partnerHandler := handlers.NewPartnerMock()
 	as := payments.ActualState{
@@ -48,6 +62,7 @@ func withErrorsMockHandler(fns ...func(as *payments.ActualState)) (Handler, *pay
 		&as,
 		partnerHandler,
 		userHandler,
+		opts...,
 	)
 	state := resolver.DesiredState{
 		ID:         uuid.New(),
@@ -106,22 +121,22 @@ func TestHandler_Run(t *testing.T) {
 	t.Run("Capture", func(t *testing.T) {
 		handler, state, ds := mockHandler()
 		cmd := ds.Capture(1000)
-		cmds, errs := handler.Run([]resolver.PaymentCommand{
+		cmds, errs := handler.Run(stamp(handler, []resolver.PaymentCommand{
 			cmd,
-		})
+		}))
 		assert.Equal(t, 1, len(errs))
 		assert.Equal(t, errs[0].Error(), "cannot capture more than authorized")
 		assert.Equal(t, consts.PaymentCommandStatusFailed, cmds[0].Status, "cannot capture more than authorized")
 		assert.Equal(t, ds.ID, cmds[0].DesiredStateID)
 		assert.Equal(t, cmd.ID, cmds[0].ID)
 		assert.Equal(t, 0, state.Amount)
-		handler.Run([]resolver.PaymentCommand{
+		handler.Run(stamp(handler, []resolver.PaymentCommand{
 			ds.Authorize(1000),
-		})
+		}))
 		assert.Equal(t, uint(1000), state.AuthorizedAmount)
-		cmds, errs = handler.Run([]resolver.PaymentCommand{
+		cmds, errs = handler.Run(stamp(handler, []resolver.PaymentCommand{
 			cmd,
-		})
+		}))
 		assert.Equal(t, 0, len(errs))
 		assert.Equal(t, ds.ID, cmds[0].DesiredStateID)
 		assert.Equal(t, cmd.ID, cmds[0].ID)
@@ -132,22 +147,22 @@ func TestHandler_Run(t *testing.T) {
 	t.Run("Release", func(t *testing.T) {
 		handler, state, ds := mockHandler()
 		cmd := ds.Release(1000)
-		cmds, errs := handler.Run([]resolver.PaymentCommand{
+		cmds, errs := handler.Run(stamp(handler, []resolver.PaymentCommand{
 			cmd,
-		})
+		}))
 		assert.Equal(t, 1, len(errs))
 		assert.Equal(t, errs[0].Error(), "cannot release more than authorized")
 		assert.Equal(t, consts.PaymentCommandStatusFailed, cmds[0].Status, "cannot release more than authorized")
 		assert.Equal(t, ds.ID, cmds[0].DesiredStateID)
 		assert.Equal(t, cmd.ID, cmds[0].ID)
 		assert.Equal(t, 0, state.Amount)
-		handler.Run([]resolver.PaymentCommand{
+		handler.Run(stamp(handler, []resolver.PaymentCommand{
 			ds.Authorize(1000),
-		})
+		}))
 		assert.Equal(t, uint(1000), state.AuthorizedAmount)
-		cmds, errs = handler.Run([]resolver.PaymentCommand{
+		cmds, errs = handler.Run(stamp(handler, []resolver.PaymentCommand{
 			cmd,
-		})
+		}))
 		assert.Equal(t, 0, len(errs))
 		assert.Equal(t, ds.ID, cmds[0].DesiredStateID)
 		assert.Equal(t, cmd.ID, cmds[0].ID)
@@ -197,14 +212,14 @@ func TestHandler_Run(t *testing.T) {
 	})
 	t.Run("Capture + Release", func(t *testing.T) {
 		handler, state, ds := mockHandler()
-		handler.Run([]resolver.PaymentCommand{
+		handler.Run(stamp(handler, []resolver.PaymentCommand{
 			ds.Authorize(2400),
-		})
+		}))
 		originalCmds := []resolver.PaymentCommand{
 			ds.Capture(1000),
 			ds.Release(1000),
 		}
-		cmds, errs := handler.Run(originalCmds)
+		cmds, errs := handler.Run(stamp(handler, originalCmds))
 		assert.Equal(t, 0, len(errs))
 		assert.Equal(t, ds.ID, cmds[0].DesiredStateID)
 		assert.Equal(t, ds.ID, cmds[1].DesiredStateID)
@@ -215,7 +230,41 @@ func TestHandler_Run(t *testing.T) {
 		assert.Equal(t, uint(400), state.AuthorizedAmount)
 		assert.Equal(t, 1000, state.Amount)
 	})
+	t.Run("Capture + Release reports each outcome", func(t *testing.T) {
+		handler, state, ds, userErr, _ := withErrorsMockHandler()
+		handler.Run(stamp(handler, []resolver.PaymentCommand{
+			ds.Authorize(2400),
+		}))
+		originalCmds := []resolver.PaymentCommand{
+			ds.Capture(1000),
+			ds.Release(1000),
+		}
+		userErr(originalCmds[1].ID.String(), fmt.Errorf("Internal Server Error - %w", errors.ErrRetryable))
+		cmds, errs := handler.Run(stamp(handler, originalCmds))
+		assert.Equal(t, 1, len(errs))
+		wasSuccessful(consts.PaymentCommandActionCapture, cmds[:1])
+		assert.Equal(t, consts.PaymentCommandStatusError, cmds[1].Status)
+		assert.Equal(t, uint(1), cmds[1].Attempts)
+		assert.Equal(t, 1000, state.Amount)
+		assert.Equal(t, uint(1400), state.AuthorizedAmount)
+	})
 
+	t.Run("Terminal commands are not run again", func(t *testing.T) {
+		handler, state, ds, userErr, _ := withErrorsMockHandler()
+		charge := ds.Charge(1000)
+		refund := ds.Refund(1000)
+		userErr(refund.ID.String(), fmt.Errorf("card closed"))
+		cmds, _ := handler.Run([]resolver.PaymentCommand{charge, refund})
+		assert.Equal(t, consts.PaymentCommandStatusComplete, cmds[0].Status)
+		assert.Equal(t, consts.PaymentCommandStatusFailed, cmds[1].Status)
+		version := state.Version
+		cmds, errs := handler.Run(cmds)
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, uint(1), cmds[0].Attempts, "Complete commands are skipped")
+		assert.Equal(t, uint(1), cmds[1].Attempts, "Failed commands are skipped")
+		assert.Equal(t, 1000, state.Amount)
+		assert.Equal(t, version, state.Version)
+	})
 	t.Run("Retryable error is not failure", func(t *testing.T) {
 		handler, state, ds, userErr, _ := withErrorsMockHandler()
 		cmd := ds.Charge(1000)
@@ -513,6 +562,20 @@ func TestHandler_GenerateResolution(t *testing.T) {
 		})
 	})
 
+	t.Run("Desired state must be valid", func(t *testing.T) {
+		handler, _, ds, _, _ := withOptionsMockHandler([]payments.Option{
+			payments.WithValidator(validation.New(validation.NonNegative(), validation.PartnerWithinUser())),
+		})
+		ds.Amount = -100
+		cmds, err := handler.GenerateResolution(ds)
+		assert.True(t, errors.Is(err, errors.ErrInvalidDesiredState))
+		assert.Equal(t, 0, len(cmds))
+		ds.Amount = 100
+		ds.PartnerAmount = 100
+		_, err = handler.GenerateResolution(ds)
+		assert.NoError(t, err)
+	})
+
 	t.Run("Desired state must not be in future", func(t *testing.T) {
 		handler, _, ds := mockHandler()
 		ds.Date = time.Now().Add(time.Minute)
@@ -520,6 +583,17 @@ func TestHandler_GenerateResolution(t *testing.T) {
 		assert.Error(t, err)
 	})
 
+	t.Run("Future is decided by the handler's clock", func(t *testing.T) {
+		c := clock.NewMock(time.Now().Add(time.Hour))
+		handler, _, ds, _, _ := withOptionsMockHandler([]payments.Option{payments.WithClock(c)})
+		ds.Date = time.Now().Add(time.Minute)
+		_, err := handler.GenerateResolution(ds)
+		assert.NoError(t, err)
+		c.Set(time.Now())
+		_, err = handler.GenerateResolution(ds)
+		assert.True(t, errors.Is(err, errors.ErrDateInFuture))
+	})
+
 	t.Run("Desired state must be more recent than current state", func(t *testing.T) {
 		handler, as, ds := mockHandler()
 		ds.Date = as.Date.Add(-time.Minute)
@@ -537,3 +611,672 @@ func TestHandler_GenerateResolution(t *testing.T) {
 		assert.Equal(t, as.Amount, currentState.Amount)
 	})
 }
+
+func TestHandler_Resolve(t *testing.T) {
+	ctx := context.Background()
+	t.Run("Generates and runs resolution", func(t *testing.T) {
+		handler, state, ds := mockHandler()
+		ds.Amount = 1000
+		ds.PartnerAmount = 800
+		cmds, errs := handler.Resolve(ctx, ds)
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, 2, len(cmds))
+		for _, cmd := range cmds {
+			assert.Equal(t, consts.PaymentCommandStatusComplete, cmd.Status)
+		}
+		assert.Equal(t, 1000, state.Amount)
+		assert.Equal(t, 800, state.PartnerAmount)
+	})
+	t.Run("Returns resolution errors", func(t *testing.T) {
+		handler, _, ds := mockHandler()
+		ds.Bucket = "fail"
+		cmds, errs := handler.Resolve(ctx, ds)
+		assert.Equal(t, 0, len(cmds))
+		assert.Equal(t, []error{errors.ErrDifferentBucket}, errs)
+	})
+	t.Run("Holds the lock while resolving", func(t *testing.T) {
+		locker := locks.NewMemory(clock.System)
+		handler, state, ds, _, _ := withOptionsMockHandler([]payments.Option{payments.WithLocker(locker, time.Minute)})
+		key := locks.Key(handler.Bucket(), handler.UserID(), handler.PartnerID(), handler.ExternalID())
+		lease, err := locker.Acquire(ctx, key, time.Minute)
+		assert.NoError(t, err)
+		ds.Amount = 1000
+		cmds, errs := handler.Resolve(ctx, ds)
+		assert.Equal(t, 0, len(cmds))
+		assert.Equal(t, 1, len(errs))
+		assert.True(t, errors.Is(errs[0], errors.ErrLockHeld), "Cannot resolve while the lock is held elsewhere")
+		assert.Equal(t, 0, state.Amount)
+		assert.NoError(t, lease.Release(ctx))
+		cmds, errs = handler.Resolve(ctx, ds)
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, 1, len(cmds))
+		assert.Equal(t, 1000, state.Amount)
+		lease, err = locker.Acquire(ctx, key, time.Minute)
+		assert.NoError(t, err, "Lock is released after resolving")
+		assert.NoError(t, lease.Release(ctx))
+	})
+}
+
+func TestHandler_Versioning(t *testing.T) {
+	t.Run("Resolution is stamped with the state version", func(t *testing.T) {
+		handler, _, ds := mockHandler(func(as *payments.ActualState) {
+			as.Version = 5
+		})
+		ds.Amount = 1000
+		ds.PartnerAmount = 1000
+		cmds, err := handler.GenerateResolution(ds)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(cmds))
+		for _, cmd := range cmds {
+			assert.Equal(t, uint64(5), cmd.StateVersion)
+		}
+	})
+	t.Run("Run increments the version", func(t *testing.T) {
+		handler, state, ds, userErr, _ := withErrorsMockHandler()
+		cmd := ds.Charge(1000)
+		userErr(cmd.ID.String(), fmt.Errorf("Internal Server Error - %w", errors.ErrRetryable))
+		cmds, errs := handler.Run([]resolver.PaymentCommand{cmd})
+		assert.Equal(t, 1, len(errs))
+		assert.Equal(t, uint64(1), state.Version)
+		assert.Equal(t, uint64(1), cmds[0].StateVersion, "Commands are stamped so they can be retried")
+		cmds, errs = handler.Run(cmds)
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, uint64(2), state.Version)
+		assert.Equal(t, uint64(2), cmds[0].StateVersion)
+	})
+	t.Run("Plans generated from the same state cannot both run", func(t *testing.T) {
+		handler, state, ds := mockHandler()
+		ds.Amount = 100
+		first, err := handler.GenerateResolution(ds)
+		assert.NoError(t, err)
+		second, err := handler.GenerateResolution(ds)
+		assert.NoError(t, err)
+		_, errs := handler.Run(first)
+		assert.Equal(t, 0, len(errs))
+		cmds, errs := handler.Run(second)
+		assert.Equal(t, 1, len(errs))
+		assert.True(t, errors.Is(errs[0], errors.ErrStaleState), "Without a store, the version is still checked")
+		assert.Equal(t, consts.PaymentCommandStatusPending, cmds[0].Status)
+		assert.Equal(t, 100, state.Amount, "The user is only charged once")
+		assert.Equal(t, uint64(1), state.Version)
+	})
+	t.Run("Stored state is saved", func(t *testing.T) {
+		store := payments.NewMemoryStateStore()
+		handler, _, ds, _, _ := withOptionsMockHandler([]payments.Option{payments.WithStateStore(store)})
+		ds.Amount = 1000
+		cmds, err := handler.GenerateResolution(ds)
+		assert.NoError(t, err)
+		_, errs := handler.Run(cmds)
+		assert.Equal(t, 0, len(errs))
+		stored, err := store.Load(handler.ExternalID())
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(2), stored.Version, "The run claims one version, and saves its outcome as the next")
+		assert.Equal(t, 1000, stored.Amount)
+		assert.Equal(t, consts.PaymentStatusComplete, stored.Status)
+	})
+	t.Run("Plans which cannot run yet keep the version", func(t *testing.T) {
+		store := payments.NewMemoryStateStore()
+		handler, state, ds, _, _ := withOptionsMockHandler([]payments.Option{payments.WithStateStore(store),
+			payments.WithPolicy(awaitingPolicy{})})
+		ds.Amount = 1000
+		cmds, errs := handler.Resolve(context.Background(), ds)
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, consts.PaymentCommandStatusAwaitingApproval, cmds[0].Status)
+		assert.Equal(t, uint64(0), state.Version)
+		assert.Equal(t, consts.PaymentStatusPending, state.Status)
+		stored, err := store.Load(handler.ExternalID())
+		assert.NoError(t, err)
+		assert.Equal(t, ds.ID, stored.LastDesiredState.ID)
+		assert.NoError(t, cmds[0].Transition(consts.PaymentCommandStatusPending))
+		cmds, errs = handler.Run(cmds)
+		assert.Equal(t, 0, len(errs), "Released commands were generated from the stored version")
+		assert.Equal(t, consts.PaymentCommandStatusComplete, cmds[0].Status)
+		assert.Equal(t, 1000, state.Amount)
+	})
+	t.Run("Cannot plan from a state while it is being run", func(t *testing.T) {
+		store := payments.NewMemoryStateStore()
+		userHandler := handlers.NewUserMock()
+		as := payments.ActualState{
+			DesiredState: resolver.DesiredState{
+				ID:         uuid.New(),
+				ExternalID: uuid.New(),
+				UserID:     uuid.New(),
+				PartnerID:  uuid.New(),
+				Date:       time.Now().Add(-10 * time.Minute),
+				Bucket:     "test",
+			},
+		}
+		assert.NoError(t, store.Save(as, 0))
+		ds := as.DesiredState
+		ds.ID = uuid.New()
+		ds.Date = time.Now()
+		ds.Amount = 1000
+		var duringRun []error
+		user := &interleavingUser{UserHandler: userHandler, onCharge: func() {
+			// Another resolver loads the state between the claim and the saving of the outcome
+			stored, err := store.Load(as.ExternalID)
+			assert.NoError(t, err)
+			assert.Equal(t, consts.PaymentStatusRunning, stored.Status)
+			second := payments.NewHandler(&stored, handlers.NewPartnerMock(), userHandler, payments.WithStateStore(store))
+			cmds, err := second.GenerateResolution(ds)
+			assert.NoError(t, err)
+			_, duringRun = second.Run(cmds)
+			_, errs := second.Resolve(context.Background(), ds)
+			duringRun = append(duringRun, errs...)
+		}}
+		first := as
+		firstHandler := payments.NewHandler(&first, handlers.NewPartnerMock(), user, payments.WithStateStore(store))
+		_, errs := firstHandler.Resolve(context.Background(), ds)
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, 2, len(duringRun))
+		for _, err := range duringRun {
+			assert.True(t, errors.Is(err, errors.ErrStateRunning))
+			assert.True(t, errors.Is(err, errors.ErrStaleState))
+		}
+		assert.Equal(t, 1000, userHandler.Balance(), "User is only charged once")
+		stored, err := store.Load(as.ExternalID)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(2), stored.Version)
+		assert.Equal(t, 1000, stored.Amount)
+		assert.Equal(t, consts.PaymentStatusComplete, stored.Status)
+	})
+	t.Run("Cannot run a plan generated from a stale state", func(t *testing.T) {
+		store := payments.NewMemoryStateStore()
+		userHandler := handlers.NewUserMock()
+		as := payments.ActualState{
+			DesiredState: resolver.DesiredState{
+				ID:         uuid.New(),
+				ExternalID: uuid.New(),
+				UserID:     uuid.New(),
+				PartnerID:  uuid.New(),
+				Date:       time.Now().Add(-10 * time.Minute),
+				Bucket:     "test",
+			},
+		}
+		assert.NoError(t, store.Save(as, 0))
+		first, second := as, as
+		firstHandler := payments.NewHandler(&first, handlers.NewPartnerMock(), userHandler, payments.WithStateStore(store))
+		secondHandler := payments.NewHandler(&second, handlers.NewPartnerMock(), userHandler, payments.WithStateStore(store))
+		ds := resolver.DesiredState{
+			ID:         uuid.New(),
+			ExternalID: as.ExternalID,
+			UserID:     as.UserID,
+			PartnerID:  as.PartnerID,
+			Date:       time.Now(),
+			Bucket:     as.Bucket,
+			Amount:     1000,
+		}
+		firstCmds, err := firstHandler.GenerateResolution(ds)
+		assert.NoError(t, err)
+		secondCmds, err := secondHandler.GenerateResolution(ds)
+		assert.NoError(t, err)
+		_, errs := firstHandler.Run(firstCmds)
+		assert.Equal(t, 0, len(errs))
+		cmds, errs := secondHandler.Run(secondCmds)
+		assert.Equal(t, []error{errors.ErrStaleState}, errs)
+		assert.Equal(t, consts.PaymentCommandStatusPending, cmds[0].Status, "Stale commands are not run")
+		assert.Equal(t, 1000, userHandler.Balance(), "User is only charged once")
+		assert.Equal(t, 0, second.Amount)
+
+		cmds, errs = secondHandler.Resolve(context.Background(), ds)
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, 0, len(cmds), "Resolve refreshes the stale state before generating")
+		assert.Equal(t, 1000, second.Amount)
+		assert.Equal(t, 1000, userHandler.Balance())
+	})
+}
+
+func TestHandler_Status(t *testing.T) {
+	ctx := context.Background()
+	t.Run("Complete once the desired state is reached", func(t *testing.T) {
+		handler, state, ds := mockHandler()
+		ds.Amount = 1000
+		_, errs := handler.Resolve(ctx, ds)
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, consts.PaymentStatusComplete, state.Status)
+		assert.Equal(t, ds, state.LastDesiredState)
+		assert.Equal(t, ds.Date, state.Date)
+	})
+	t.Run("Error while retryable commands remain", func(t *testing.T) {
+		handler, state, ds, userErr, _ := withErrorsMockHandler()
+		ds.Amount = 1000
+		cmds, err := handler.GenerateResolution(ds)
+		assert.NoError(t, err)
+		userErr(cmds[0].ID.String(), fmt.Errorf("Internal Server Error - %w", errors.ErrRetryable))
+		cmds, _ = handler.Run(cmds)
+		assert.Equal(t, consts.PaymentStatusError, state.Status)
+		assert.Equal(t, ds.ID, state.LastDesiredState.ID)
+		handler.Run(cmds)
+		assert.Equal(t, consts.PaymentStatusComplete, state.Status)
+	})
+	t.Run("Failed when a command fails", func(t *testing.T) {
+		handler, state, ds, _, partnerErr := withErrorsMockHandler()
+		ds.Amount = 1000
+		ds.PartnerAmount = 800
+		cmds, err := handler.GenerateResolution(ds)
+		assert.NoError(t, err)
+		partnerErr(cmds[1].ID.String(), fmt.Errorf("account closed"))
+		handler.Run(cmds)
+		assert.Equal(t, consts.PaymentStatusFailed, state.Status)
+		assert.Equal(t, 1000, state.Amount)
+	})
+	t.Run("Pending while commands are outstanding", func(t *testing.T) {
+		handler, state, ds := mockHandler()
+		ds.Amount = 1000
+		cmds, err := handler.GenerateResolution(ds)
+		assert.NoError(t, err)
+		cmds[0].Status = consts.PaymentCommandStatusHeld
+		_, errs := handler.Run(cmds)
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, consts.PaymentStatusPending, state.Status, "Held commands are outstanding")
+		assert.Equal(t, ds.ID, state.LastDesiredState.ID)
+		assert.Equal(t, 0, state.Amount)
+
+		cmds[0].Status = consts.PaymentCommandStatusPending
+		cmds[0].Amount = 400
+		handler.Run(cmds)
+		assert.Equal(t, consts.PaymentStatusPending, state.Status, "Trimmed commands do not reach the desired state")
+	})
+	t.Run("Complete when there is nothing to do", func(t *testing.T) {
+		handler, state, ds := mockHandler(func(as *payments.ActualState) {
+			as.Status = consts.PaymentStatusError
+		})
+		cmds, errs := handler.Resolve(ctx, ds)
+		assert.Equal(t, 0, len(cmds))
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, consts.PaymentStatusComplete, state.Status)
+		assert.Equal(t, ds, state.LastDesiredState)
+	})
+	t.Run("Later states cannot be overwritten by earlier ones", func(t *testing.T) {
+		handler, _, ds := mockHandler()
+		ds.Amount = 1000
+		_, errs := handler.Resolve(ctx, ds)
+		assert.Equal(t, 0, len(errs))
+		earlier := ds
+		earlier.ID = uuid.New()
+		earlier.Date = ds.Date.Add(-time.Second)
+		_, errs = handler.Resolve(ctx, earlier)
+		assert.Equal(t, []error{errors.ErrLaterStateApplied}, errs)
+	})
+	t.Run("Status is stored", func(t *testing.T) {
+		store := payments.NewMemoryStateStore()
+		handler, _, ds, userErr, _ := withOptionsMockHandler([]payments.Option{payments.WithStateStore(store)})
+		ds.Amount = 1000
+		cmds, err := handler.GenerateResolution(ds)
+		assert.NoError(t, err)
+		userErr(cmds[0].ID.String(), fmt.Errorf("card declined"))
+		handler.Run(cmds)
+		found, err := payments.NeedsAttention(store)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(found))
+		assert.Equal(t, ds.ID, found[0].LastDesiredState.ID)
+	})
+}
+
+func TestHandler_IncrementalProviders(t *testing.T) {
+	handler := func() (Handler, *payments.ActualState, resolver.DesiredState, interface{ Calls() (int, int, int) }) {
+		user := handlers.NewIncrementalUserMock()
+		as := payments.ActualState{DesiredState: resolver.DesiredState{
+			ExternalID: uuid.New(),
+			UserID:     uuid.New(),
+			PartnerID:  uuid.New(),
+			Bucket:     "test",
+		}}
+		h := payments.NewHandler(&as, handlers.NewPartnerMock(), user)
+		ds := resolver.DesiredState{
+			ID:         uuid.New(),
+			ExternalID: as.ExternalID,
+			UserID:     as.UserID,
+			PartnerID:  as.PartnerID,
+			Date:       time.Now(),
+			Bucket:     as.Bucket,
+		}
+		return h, &as, ds, user
+	}
+	t.Run("Authorizations are incremented", func(t *testing.T) {
+		h, state, ds, user := handler()
+		_, errs := h.Run(stamp(h, []resolver.PaymentCommand{ds.Authorize(1000)}))
+		assert.Equal(t, 0, len(errs))
+		increments, _, _ := user.Calls()
+		assert.Equal(t, 0, increments, "Nothing to increment yet")
+		_, errs = h.Run(stamp(h, []resolver.PaymentCommand{ds.Authorize(500)}))
+		assert.Equal(t, 0, len(errs))
+		increments, _, _ = user.Calls()
+		assert.Equal(t, 1, increments)
+		assert.Equal(t, uint(1500), state.AuthorizedAmount)
+	})
+	t.Run("Captures leave the remainder authorized", func(t *testing.T) {
+		h, state, ds, user := handler()
+		h.Run(stamp(h, []resolver.PaymentCommand{ds.Authorize(2400)}))
+		cmds, errs := h.Run(stamp(h, []resolver.PaymentCommand{ds.Capture(1000)}))
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, consts.PaymentCommandStatusComplete, cmds[0].Status)
+		assert.Equal(t, 1000, state.Amount)
+		assert.Equal(t, uint(1400), state.AuthorizedAmount)
+		_, multiCaptures, _ := user.Calls()
+		assert.Equal(t, 1, multiCaptures)
+	})
+	t.Run("Capture + Release does not need CaptureRelease", func(t *testing.T) {
+		h, state, ds, user := handler()
+		h.Run(stamp(h, []resolver.PaymentCommand{ds.Authorize(2400)}))
+		cmds, errs := h.Run(stamp(h, []resolver.PaymentCommand{ds.Capture(1000), ds.Release(1000)}))
+		assert.Equal(t, 0, len(errs))
+		for _, cmd := range cmds {
+			assert.Equal(t, consts.PaymentCommandStatusComplete, cmd.Status)
+			assert.Equal(t, uint(1), cmd.Attempts)
+		}
+		assert.Equal(t, 1000, state.Amount)
+		assert.Equal(t, uint(400), state.AuthorizedAmount)
+		_, multiCaptures, captureReleases := user.Calls()
+		assert.Equal(t, 1, multiCaptures)
+		assert.Equal(t, 0, captureReleases)
+	})
+}
+
+func TestHandler_Capabilities(t *testing.T) {
+	handler := func(capabilities ...consts.Capability) (Handler, *payments.ActualState, resolver.DesiredState, interface{ Calls() (int, int, int) }) {
+		user := handlers.NewIncrementalUserMock()
+		if capabilities != nil {
+			user.SetCapabilities(capabilities...)
+		}
+		as := payments.ActualState{DesiredState: resolver.DesiredState{
+			ExternalID: uuid.New(),
+			UserID:     uuid.New(),
+			PartnerID:  uuid.New(),
+			Bucket:     "test",
+		}}
+		h := payments.NewHandler(&as, handlers.NewPartnerMock(), user)
+		ds := resolver.DesiredState{
+			ID:         uuid.New(),
+			ExternalID: as.ExternalID,
+			UserID:     as.UserID,
+			PartnerID:  as.PartnerID,
+			Date:       time.Now(),
+			Bucket:     as.Bucket,
+		}
+		return h, &as, ds, user
+	}
+	t.Run("Captures and releases are made together without partial capture", func(t *testing.T) {
+		h, state, ds, user := handler(consts.CapabilityPartialRelease)
+		h.Run(stamp(h, []resolver.PaymentCommand{ds.Authorize(2400)}))
+		_, errs := h.Run(stamp(h, []resolver.PaymentCommand{ds.Capture(1000), ds.Release(1000)}))
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, uint(400), state.AuthorizedAmount)
+		increments, multiCaptures, captureReleases := user.Calls()
+		assert.Equal(t, 0, increments)
+		assert.Equal(t, 0, multiCaptures)
+		assert.Equal(t, 1, captureReleases)
+	})
+	t.Run("Captures and releases are made together without partial release", func(t *testing.T) {
+		h, _, ds, user := handler(consts.CapabilityPartialCapture)
+		h.Run(stamp(h, []resolver.PaymentCommand{ds.Authorize(2400)}))
+		_, errs := h.Run(stamp(h, []resolver.PaymentCommand{ds.Capture(1000), ds.Release(1000)}))
+		assert.Equal(t, 0, len(errs))
+		_, _, captureReleases := user.Calls()
+		assert.Equal(t, 1, captureReleases)
+	})
+	t.Run("Captures and releases are independent with partial capture and release", func(t *testing.T) {
+		h, state, ds, user := handler(consts.CapabilityPartialCapture, consts.CapabilityPartialRelease)
+		h.Run(stamp(h, []resolver.PaymentCommand{ds.Authorize(2400)}))
+		cmds, errs := h.Run(stamp(h, []resolver.PaymentCommand{ds.Capture(1000), ds.Release(1000)}))
+		assert.Equal(t, 0, len(errs))
+		for _, cmd := range cmds {
+			assert.Equal(t, consts.PaymentCommandStatusComplete, cmd.Status)
+		}
+		assert.Equal(t, 1000, state.Amount)
+		assert.Equal(t, uint(400), state.AuthorizedAmount)
+		_, _, captureReleases := user.Calls()
+		assert.Equal(t, 0, captureReleases)
+	})
+	t.Run("Releases by refund are made before multicaptures", func(t *testing.T) {
+		user := handlers.NewIncrementalUserMock()
+		as := payments.ActualState{DesiredState: resolver.DesiredState{ExternalID: uuid.New(), Bucket: "test"}}
+		ds := resolver.DesiredState{ID: uuid.New(), ExternalID: as.ExternalID, Bucket: as.Bucket}
+		for _, refundUncaptured := range []bool{false, true} {
+			capabilities := []consts.Capability{consts.CapabilityMultiCapture}
+			if refundUncaptured {
+				capabilities = append(capabilities, consts.CapabilityRefundUncaptured)
+			}
+			user.SetCapabilities(capabilities...)
+			h := payments.NewHandler(&as, handlers.NewPartnerMock(), user)
+			h.Run(stamp(h, []resolver.PaymentCommand{ds.Authorize(2400)}))
+			_, errs := h.Run(stamp(h, []resolver.PaymentCommand{ds.Capture(1000), ds.Release(1000)}))
+			assert.Equal(t, 0, len(errs))
+		}
+		assert.True(t, user.AssertSequence(t, "MultiCapture", "Release", "Release", "MultiCapture"))
+	})
+	t.Run("PaymentIntents are captured before the rest is released", func(t *testing.T) {
+		backend := &intentBackend{intents: map[string]*stripe.PaymentIntent{}}
+		storage := handlers.NewMockStripeStorage("test")
+		user := handlers.NewStripeIntentHandler(client.New("sk_test", &stripe.Backends{API: backend}), "pm_card_visa", "usd", "test", storage)
+		as := payments.ActualState{DesiredState: resolver.DesiredState{ExternalID: uuid.New(), Bucket: "test"}}
+		ds := resolver.DesiredState{ID: uuid.New(), ExternalID: as.ExternalID, Bucket: as.Bucket}
+		h := payments.NewHandler(&as, handlers.NewPartnerMock(), user)
+		h.Run(stamp(h, []resolver.PaymentCommand{ds.Authorize(2400)}))
+		cmds, errs := h.Run(stamp(h, []resolver.PaymentCommand{ds.Capture(1000), ds.Release(1000)}))
+		assert.Equal(t, 0, len(errs))
+		for _, cmd := range cmds {
+			assert.Equal(t, consts.PaymentCommandStatusComplete, cmd.Status)
+		}
+		assert.Equal(t, []string{
+			"/v1/payment_intents",
+			"/v1/payment_intents/pi_1/capture",
+			"/v1/payment_intents",
+			"/v1/payment_intents/pi_1/cancel",
+		}, backend.paths, "The remainder is kept on a new intent before the captured one is cancelled")
+		assert.Equal(t, 1000, as.Amount)
+		assert.Equal(t, uint(400), as.AuthorizedAmount)
+		assert.Equal(t, int64(1000), backend.intents["pi_1"].Charges.Data[0].AmountCaptured, "Nothing captured is given back")
+		assert.Equal(t, uint(400), storage.AuthorizedBalance())
+	})
+	t.Run("Unadvertised capabilities are not used", func(t *testing.T) {
+		h, state, ds, user := handler(consts.CapabilityPartialCapture, consts.CapabilityPartialRelease)
+		h.Run([]resolver.PaymentCommand{ds.Authorize(1000)})
+		h.Run([]resolver.PaymentCommand{ds.Authorize(500)})
+		h.Run([]resolver.PaymentCommand{ds.Capture(500)})
+		assert.Equal(t, uint(1000), state.AuthorizedAmount)
+		increments, multiCaptures, _ := user.Calls()
+		assert.Equal(t, 0, increments)
+		assert.Equal(t, 0, multiCaptures)
+	})
+	t.Run("Charges are captured from an incremented authorization", func(t *testing.T) {
+		h, state, ds, user := handler()
+		h.Run([]resolver.PaymentCommand{ds.Authorize(1000)})
+		ds.Amount = 500
+		ds.AuthorizedAmount = 1000
+		cmds, err := h.GenerateResolution(ds)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(cmds))
+		assert.Equal(t, consts.PaymentCommandActionCapture, cmds[0].Action)
+		assert.Equal(t, uint(500), cmds[0].Amount)
+		assert.Equal(t, consts.PaymentCommandActionAuthorize, cmds[1].Action)
+		assert.Equal(t, uint(500), cmds[1].Amount)
+		cmds, errs := h.Run(cmds)
+		assert.Equal(t, 0, len(errs))
+		for _, cmd := range cmds {
+			assert.Equal(t, consts.PaymentCommandStatusComplete, cmd.Status)
+		}
+		assert.Equal(t, 500, state.Amount)
+		assert.Equal(t, uint(1000), state.AuthorizedAmount)
+		assert.Equal(t, consts.PaymentStatusComplete, state.Status)
+		increments, multiCaptures, _ := user.Calls()
+		assert.Equal(t, 1, increments)
+		assert.Equal(t, 1, multiCaptures)
+	})
+	t.Run("Charges beyond the authorization capture all of it as well as the increment", func(t *testing.T) {
+		h, state, ds, _ := handler()
+		h.Run([]resolver.PaymentCommand{ds.Authorize(200)})
+		ds.Amount = 500
+		cmds, err := h.GenerateResolution(ds)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(cmds))
+		assert.Equal(t, consts.PaymentCommandActionCapture, cmds[0].Action)
+		assert.Equal(t, uint(500), cmds[0].Amount)
+		assert.Equal(t, consts.PaymentCommandActionAuthorize, cmds[1].Action)
+		assert.Equal(t, uint(300), cmds[1].Amount)
+		_, errs := h.Run(cmds)
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, 500, state.Amount)
+		assert.Equal(t, uint(0), state.AuthorizedAmount)
+	})
+	t.Run("Charges are charged with nothing to increment", func(t *testing.T) {
+		h, _, ds, _ := handler()
+		ds.Amount = 500
+		cmds, err := h.GenerateResolution(ds)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(cmds))
+		assert.Equal(t, consts.PaymentCommandActionCharge, cmds[0].Action)
+	})
+}
+
+// annotatingUser records the metadata each command is annotated with while it runs
+type annotatingUser struct {
+	payments.UserHandler
+	lock     sync.Mutex
+	metadata map[string]map[string]string
+	running  map[string]map[string]string
+}
+
+func (a *annotatingUser) Annotate(key string, metadata map[string]string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if metadata != nil {
+		a.metadata[key] = metadata
+	}
+	a.running[key] = metadata
+}
+
+func TestHandler_Metadata(t *testing.T) {
+	user := &annotatingUser{
+		UserHandler: handlers.NewUserMock(),
+		metadata:    make(map[string]map[string]string),
+		running:     make(map[string]map[string]string),
+	}
+	as := payments.ActualState{DesiredState: resolver.DesiredState{
+		ExternalID: uuid.New(),
+		UserID:     uuid.New(),
+		PartnerID:  uuid.New(),
+		Bucket:     "test",
+	}}
+	h := payments.NewHandler(&as, handlers.NewPartnerMock(), user)
+	ds := resolver.DesiredState{
+		ID:         uuid.New(),
+		ExternalID: as.ExternalID,
+		UserID:     as.UserID,
+		PartnerID:  as.PartnerID,
+		Date:       time.Now(),
+		Bucket:     as.Bucket,
+		Amount:     1000,
+		Metadata:   map[string]string{"order": "A-100", "line": "1", "external_id": "forged"},
+	}
+	t.Run("Commands are annotated while they run", func(t *testing.T) {
+		cmds, err := h.GenerateResolution(ds)
+		assert.NoError(t, err)
+		cmds[0].Metadata = map[string]string{"line": "2"}
+		cmds, errs := h.Run(cmds)
+		assert.Equal(t, 0, len(errs))
+		key := cmds[0].ID.String()
+		assert.Equal(t, map[string]string{
+			"order":            "A-100",
+			"line":             "2",
+			"bucket":           "test",
+			"external_id":      as.ExternalID.String(),
+			"user_id":          as.UserID.String(),
+			"partner_id":       as.PartnerID.String(),
+			"desired_state_id": ds.ID.String(),
+		}, user.metadata[key], "Command metadata takes precedence, and identifiers cannot be overridden")
+		assert.Nil(t, user.running[key], "Annotations are cleared once run")
+	})
+	t.Run("Retried commands are annotated from the last desired state", func(t *testing.T) {
+		next := ds
+		next.ID = uuid.New()
+		next.Metadata = nil
+		_, err := h.GenerateResolution(next)
+		assert.NoError(t, err)
+		cmd := ds.Charge(100)
+		_, errs := h.Run(stamp(h, []resolver.PaymentCommand{cmd}))
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, "A-100", user.metadata[cmd.ID.String()]["order"])
+	})
+}
+
+// interleavingUser calls onCharge before charging, to interleave other work with a run
+type interleavingUser struct {
+	payments.UserHandler
+	onCharge func()
+}
+
+func (u *interleavingUser) Charge(idempotencyKey string, amount uint) error {
+	u.onCharge()
+	return u.UserHandler.Charge(idempotencyKey, amount)
+}
+
+// awaitingPolicy holds every command for approval
+type awaitingPolicy struct{}
+
+func (awaitingPolicy) Evaluate(_ payments.ActualState, cmds []resolver.PaymentCommand) []resolver.PaymentCommand {
+	for i := range cmds {
+		cmds[i].Transition(consts.PaymentCommandStatusAwaitingApproval)
+	}
+	return cmds
+}
+
+// intentBackend answers PaymentIntent requests the way Stripe would, without calling it
+type intentBackend struct {
+	paths   []string
+	intents map[string]*stripe.PaymentIntent
+}
+
+func (b *intentBackend) Call(method, path, key string, params stripe.ParamsContainer, v stripe.LastResponseSetter) error {
+	b.paths = append(b.paths, path)
+	var pi *stripe.PaymentIntent
+	switch p := params.(type) {
+	case *stripe.PaymentIntentParams:
+		id := fmt.Sprintf("pi_%d", len(b.intents)+1)
+		charge := &stripe.Charge{ID: "ch_" + id[3:], Amount: *p.Amount, Paid: true, Created: int64(len(b.intents) + 1)}
+		pi = &stripe.PaymentIntent{ID: id, Status: stripe.PaymentIntentStatusRequiresCapture, Charges: &stripe.ChargeList{Data: []*stripe.Charge{charge}}}
+		b.intents[id] = pi
+	case *stripe.PaymentIntentCaptureParams:
+		pi = b.intents[path[len("/v1/payment_intents/"):len(path)-len("/capture")]]
+		charge := pi.Charges.Data[0]
+		charge.AmountCaptured += *p.AmountToCapture
+		charge.Captured = true
+		if p.Extra == nil || p.Extra.Get("final_capture") != "false" {
+			pi.Status = stripe.PaymentIntentStatusSucceeded
+			charge.AmountRefunded = charge.Amount - charge.AmountCaptured
+		}
+	case *stripe.PaymentIntentCancelParams:
+		pi = b.intents[path[len("/v1/payment_intents/"):len(path)-len("/cancel")]]
+		charge := pi.Charges.Data[0]
+		pi.Status = stripe.PaymentIntentStatusCanceled
+		charge.AmountRefunded = charge.Amount - charge.AmountCaptured
+		charge.Refunded = !charge.Captured
+	default:
+		return fmt.Errorf("unexpected request to %s", path)
+	}
+	copied := *pi
+	*v.(*stripe.PaymentIntent) = copied
+	return nil
+}
+
+func (b *intentBackend) CallStreaming(method, path, key string, params stripe.ParamsContainer, v stripe.StreamingLastResponseSetter) error {
+	panic("not implemented")
+}
+
+func (b *intentBackend) CallRaw(method, path, key string, body *form.Values, params *stripe.Params, v stripe.LastResponseSetter) error {
+	panic("not implemented")
+}
+
+func (b *intentBackend) CallMultipart(method, path, key, boundary string, body *bytes.Buffer, params *stripe.Params, v stripe.LastResponseSetter) error {
+	panic("not implemented")
+}
+
+func (b *intentBackend) SetMaxNetworkRetries(maxNetworkRetries int64) {}
+
+// stamp marks cmds as generated from the current state of h, as GenerateResolution would
+func stamp(h Handler, cmds []resolver.PaymentCommand) []resolver.PaymentCommand {
+	for i := range cmds {
+		cmds[i].StateVersion = h.CurrentState().Version
+	}
+	return cmds
+}
@@ -0,0 +1,56 @@
+package approval
+
+import (
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/google/uuid"
+	"sort"
+	"sync"
+)
+
+type Store interface {
+	Save(r Request)
+	// Get returns the request for a command, or errors.ErrApprovalNotFound
+	Get(commandID uuid.UUID) (Request, error)
+	// List returns every request, oldest first
+	List() []Request
+}
+
+type memoryStore struct {
+	lock     sync.RWMutex
+	requests map[uuid.UUID]Request
+}
+
+func NewMemoryStore() *memoryStore {
+	return &memoryStore{
+		requests: make(map[uuid.UUID]Request),
+	}
+}
+
+func (m *memoryStore) Save(r Request) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.requests[r.Command.ID] = r
+}
+
+func (m *memoryStore) Get(commandID uuid.UUID) (Request, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	r, ok := m.requests[commandID]
+	if !ok {
+		return Request{}, errors.ErrApprovalNotFound
+	}
+	return r, nil
+}
+
+func (m *memoryStore) List() []Request {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	requests := make([]Request, 0, len(m.requests))
+	for _, r := range m.requests {
+		requests = append(requests, r)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].Requested.Before(requests[j].Requested)
+	})
+	return requests
+}
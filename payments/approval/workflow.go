@@ -0,0 +1,169 @@
+package approval
+
+import (
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments"
+	"github.com/davidjwilkins/declarative-payments/payments/resolver"
+	"github.com/google/uuid"
+	"time"
+)
+
+// Thresholds are the largest amounts per action which can run without approval
+type Thresholds map[consts.PaymentCommandAction]uint
+
+// Request is a command waiting for, or given, approval
+type Request struct {
+	Command    resolver.PaymentCommand
+	ExternalID uuid.UUID
+	UserID     uuid.UUID
+	PartnerID  uuid.UUID
+	Bucket     string
+	Requested  time.Time
+	// Executed is set once the approved command has completed
+	Executed bool
+}
+
+// Workflow holds commands above their threshold until they are approved.  It is both a payments.Policy and a
+// payments.CommandObserver.
+type Workflow struct {
+	store      Store
+	clock      clock.Clock
+	thresholds Thresholds
+}
+
+func New(store Store, c clock.Clock, thresholds Thresholds) *Workflow {
+	return &Workflow{
+		store:      store,
+		clock:      c,
+		thresholds: thresholds,
+	}
+}
+
+func (w *Workflow) needsApproval(cmd resolver.PaymentCommand) bool {
+	threshold, ok := w.thresholds[cmd.Action]
+	return ok && cmd.Amount > threshold
+}
+
+// find returns the request for the same change as cmd, if one has been made and not yet executed
+func (w *Workflow) find(state payments.ActualState, cmd resolver.PaymentCommand) (Request, bool) {
+	for _, r := range w.store.List() {
+		if !r.Executed && r.ExternalID == state.ExternalID && r.Command.DesiredStateID == cmd.DesiredStateID &&
+			r.Command.Action == cmd.Action && r.Command.Amount == cmd.Amount {
+			return r, true
+		}
+	}
+	return Request{}, false
+}
+
+// review moves a pending command to the status of its request.  It awaits approval first, since that is the only way
+// to be rejected, and if the request's status cannot be reached, it keeps awaiting approval so it never runs unreviewed.
+func review(cmd *resolver.PaymentCommand, to consts.PaymentCommandStatus) {
+	err := cmd.Transition(consts.PaymentCommandStatusAwaitingApproval)
+	if err == nil && to != consts.PaymentCommandStatusAwaitingApproval {
+		err = cmd.Transition(to)
+	}
+	if err != nil {
+		cmd.Error = err.Error()
+	}
+}
+
+// Evaluate holds commands above their threshold for approval.  If the same command was already requested, it takes
+// the original's ID, so that once approved, it runs with the same idempotency key however many times it was planned.
+func (w *Workflow) Evaluate(state payments.ActualState, cmds []resolver.PaymentCommand) []resolver.PaymentCommand {
+	for i := range cmds {
+		if cmds[i].Status != consts.PaymentCommandStatusPending || !w.needsApproval(cmds[i]) {
+			continue
+		}
+		if r, ok := w.find(state, cmds[i]); ok {
+			cmds[i].ID = r.Command.ID
+			cmds[i].Review = r.Command.Review
+			review(&cmds[i], r.Command.Status)
+			continue
+		}
+		if err := cmds[i].Transition(consts.PaymentCommandStatusAwaitingApproval); err != nil {
+			cmds[i].Error = err.Error()
+			continue
+		}
+		w.store.Save(Request{
+			Command:    cmds[i],
+			ExternalID: state.ExternalID,
+			UserID:     state.UserID,
+			PartnerID:  state.PartnerID,
+			Bucket:     state.Bucket,
+			Requested:  w.clock.Now(),
+		})
+	}
+	return cmds
+}
+
+// Observe marks approved commands which completed as executed.  Commands still awaiting approval are stamped with the
+// version the rest of their plan left the state at, so that once approved, they are not rejected as stale.
+func (w *Workflow) Observe(_ payments.ActualState, cmds []resolver.PaymentCommand) {
+	for _, cmd := range cmds {
+		r, err := w.store.Get(cmd.ID)
+		if err != nil {
+			continue
+		}
+		switch cmd.Status {
+		case consts.PaymentCommandStatusComplete:
+			r.Executed = true
+			r.Command = cmd
+		case consts.PaymentCommandStatusAwaitingApproval:
+			if r.Command.Status != consts.PaymentCommandStatusAwaitingApproval {
+				continue
+			}
+			r.Command.StateVersion = cmd.StateVersion
+		default:
+			continue
+		}
+		w.store.Save(r)
+	}
+}
+
+// Pending returns the requests awaiting approval, oldest first
+func (w *Workflow) Pending() []Request {
+	var pending []Request
+	for _, r := range w.store.List() {
+		if r.Command.Status == consts.PaymentCommandStatusAwaitingApproval {
+			pending = append(pending, r)
+		}
+	}
+	return pending
+}
+
+func (w *Workflow) review(commandID uuid.UUID, actor, reason string, approved bool) (resolver.PaymentCommand, error) {
+	r, err := w.store.Get(commandID)
+	if err != nil {
+		return resolver.PaymentCommand{}, err
+	}
+	if r.Command.Status != consts.PaymentCommandStatusAwaitingApproval {
+		return r.Command, errors.ErrAlreadyReviewed
+	}
+	r.Command.Review = resolver.Review{
+		Actor:    actor,
+		Reason:   reason,
+		Date:     w.clock.Now(),
+		Approved: approved,
+	}
+	to := consts.PaymentCommandStatusRejected
+	if approved {
+		to = consts.PaymentCommandStatusPending
+	}
+	if err := r.Command.Transition(to); err != nil {
+		return r.Command, err
+	}
+	w.store.Save(r)
+	return r.Command, nil
+}
+
+// Approve releases a command to be run.  The returned command keeps its original ID, and can be passed to Run.
+func (w *Workflow) Approve(commandID uuid.UUID, actor, reason string) (resolver.PaymentCommand, error) {
+	return w.review(commandID, actor, reason, true)
+}
+
+// Reject stops a command from ever being run
+func (w *Workflow) Reject(commandID uuid.UUID, actor, reason string) (resolver.PaymentCommand, error) {
+	return w.review(commandID, actor, reason, false)
+}
@@ -0,0 +1,211 @@
+package approval_test
+
+import (
+	"context"
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments"
+	"github.com/davidjwilkins/declarative-payments/payments/approval"
+	"github.com/davidjwilkins/declarative-payments/payments/handlers"
+	"github.com/davidjwilkins/declarative-payments/payments/resolver"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type Handler interface {
+	Run(cmds []resolver.PaymentCommand) ([]resolver.PaymentCommand, []error)
+	Resolve(ctx context.Context, d resolver.DesiredState) ([]resolver.PaymentCommand, []error)
+	CurrentState() payments.ActualState
+}
+
+func approvalHandler(w *approval.Workflow, opts ...payments.Option) (Handler, resolver.DesiredState) {
+	as := payments.ActualState{
+		DesiredState: resolver.DesiredState{
+			ID:         uuid.New(),
+			ExternalID: uuid.New(),
+			UserID:     uuid.New(),
+			PartnerID:  uuid.New(),
+			Date:       time.Now().Add(-time.Hour),
+			Bucket:     "test",
+			Amount:     5000,
+		},
+	}
+	opts = append([]payments.Option{payments.WithPolicy(w), payments.WithObserver(w)}, opts...)
+	h := payments.NewHandler(&as, handlers.NewPartnerMock(), handlers.NewUserMock(), opts...)
+	return h, resolver.DesiredState{
+		ID:         uuid.New(),
+		ExternalID: as.ExternalID,
+		UserID:     as.UserID,
+		PartnerID:  as.PartnerID,
+		Date:       time.Now(),
+		Bucket:     as.Bucket,
+		Amount:     as.Amount,
+	}
+}
+
+func TestWorkflow(t *testing.T) {
+	ctx := context.Background()
+	thresholds := approval.Thresholds{
+		consts.PaymentCommandActionRefund:   1000,
+		consts.PaymentCommandActionWithdraw: 1000,
+	}
+	t.Run("Commands within the threshold run", func(t *testing.T) {
+		w := approval.New(approval.NewMemoryStore(), clock.System, thresholds)
+		h, ds := approvalHandler(w)
+		ds.Amount = 4000
+		ds.PartnerAmount = 10000
+		cmds, errs := h.Resolve(ctx, ds)
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, consts.PaymentCommandStatusComplete, cmds[0].Status)
+		assert.Equal(t, consts.PaymentCommandStatusComplete, cmds[1].Status, "Actions without thresholds run")
+		assert.Equal(t, 0, len(w.Pending()))
+	})
+	t.Run("Commands above the threshold await approval", func(t *testing.T) {
+		w := approval.New(approval.NewMemoryStore(), clock.System, thresholds)
+		h, ds := approvalHandler(w)
+		ds.Amount = 3000
+		cmds, errs := h.Resolve(ctx, ds)
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, consts.PaymentCommandStatusAwaitingApproval, cmds[0].Status)
+		assert.Equal(t, uint(0), cmds[0].Attempts, "Commands awaiting approval are not run")
+		assert.Equal(t, 5000, h.CurrentState().Amount)
+		pending := w.Pending()
+		assert.Equal(t, 1, len(pending))
+		assert.Equal(t, cmds[0].ID, pending[0].Command.ID)
+		assert.Equal(t, ds.ExternalID, pending[0].ExternalID)
+	})
+	t.Run("Approved commands run with their original ID", func(t *testing.T) {
+		w := approval.New(approval.NewMemoryStore(), clock.System, thresholds)
+		h, ds := approvalHandler(w)
+		ds.Amount = 3000
+		cmds, _ := h.Resolve(ctx, ds)
+		approved, err := w.Approve(cmds[0].ID, "alice", "customer complaint")
+		assert.NoError(t, err)
+		assert.Equal(t, cmds[0].ID, approved.ID)
+		assert.Equal(t, consts.PaymentCommandStatusPending, approved.Status)
+		assert.Equal(t, "alice", approved.Review.Actor)
+		assert.Equal(t, "customer complaint", approved.Review.Reason)
+		assert.True(t, approved.Review.Approved)
+		ran, errs := h.Run([]resolver.PaymentCommand{approved})
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, consts.PaymentCommandStatusComplete, ran[0].Status)
+		assert.Equal(t, 3000, h.CurrentState().Amount)
+		assert.Equal(t, 0, len(w.Pending()))
+		_, err = w.Approve(cmds[0].ID, "alice", "again")
+		assert.True(t, errors.Is(err, errors.ErrAlreadyReviewed))
+	})
+	t.Run("Approved commands run against a stored state", func(t *testing.T) {
+		w := approval.New(approval.NewMemoryStore(), clock.System, thresholds)
+		store := payments.NewMemoryStateStore()
+		h, ds := approvalHandler(w, payments.WithStateStore(store))
+		ds.Amount = 3000
+		cmds, errs := h.Resolve(ctx, ds)
+		assert.Equal(t, 0, len(errs))
+		approved, err := w.Approve(cmds[0].ID, "alice", "customer complaint")
+		assert.NoError(t, err)
+		ran, errs := h.Run([]resolver.PaymentCommand{approved})
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, consts.PaymentCommandStatusComplete, ran[0].Status)
+		assert.Equal(t, 3000, h.CurrentState().Amount)
+		stored, err := store.Load(ds.ExternalID)
+		assert.NoError(t, err)
+		assert.Equal(t, 3000, stored.Amount)
+		assert.Equal(t, 0, len(w.Pending()))
+	})
+	t.Run("Approved commands run after the rest of their plan", func(t *testing.T) {
+		w := approval.New(approval.NewMemoryStore(), clock.System, thresholds)
+		store := payments.NewMemoryStateStore()
+		h, ds := approvalHandler(w, payments.WithStateStore(store))
+		ds.Amount = 3000
+		ds.PartnerAmount = 500
+		cmds, errs := h.Resolve(ctx, ds)
+		assert.Equal(t, 0, len(errs))
+		var held resolver.PaymentCommand
+		for _, cmd := range cmds {
+			if cmd.Action == consts.PaymentCommandActionRefund {
+				held = cmd
+				assert.Equal(t, consts.PaymentCommandStatusAwaitingApproval, cmd.Status)
+			} else {
+				assert.Equal(t, consts.PaymentCommandStatusComplete, cmd.Status)
+			}
+		}
+		assert.Equal(t, 500, h.CurrentState().PartnerAmount)
+		approved, err := w.Approve(held.ID, "alice", "customer complaint")
+		assert.NoError(t, err)
+		assert.Equal(t, h.CurrentState().Version, approved.StateVersion)
+		ran, errs := h.Run([]resolver.PaymentCommand{approved})
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, consts.PaymentCommandStatusComplete, ran[0].Status)
+		assert.Equal(t, 3000, h.CurrentState().Amount)
+		assert.Equal(t, 500, h.CurrentState().PartnerAmount)
+	})
+	t.Run("Approved commands are reused when the state is resolved again", func(t *testing.T) {
+		w := approval.New(approval.NewMemoryStore(), clock.System, thresholds)
+		h, ds := approvalHandler(w)
+		ds.Amount = 3000
+		cmds, _ := h.Resolve(ctx, ds)
+		again, _ := h.Resolve(ctx, ds)
+		assert.Equal(t, cmds[0].ID, again[0].ID, "Resolving again does not make a new request")
+		assert.Equal(t, 1, len(w.Pending()))
+		_, err := w.Approve(cmds[0].ID, "alice", "ok")
+		assert.NoError(t, err)
+		again, errs := h.Resolve(ctx, ds)
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, cmds[0].ID, again[0].ID)
+		assert.Equal(t, consts.PaymentCommandStatusComplete, again[0].Status)
+		assert.Equal(t, 3000, h.CurrentState().Amount)
+	})
+	t.Run("Rejected commands never run", func(t *testing.T) {
+		w := approval.New(approval.NewMemoryStore(), clock.System, thresholds)
+		h, ds := approvalHandler(w)
+		ds.Amount = 3000
+		cmds, _ := h.Resolve(ctx, ds)
+		rejected, err := w.Reject(cmds[0].ID, "bob", "fraud")
+		assert.NoError(t, err)
+		assert.Equal(t, consts.PaymentCommandStatusRejected, rejected.Status)
+		assert.False(t, rejected.Review.Approved)
+		ran, errs := h.Run([]resolver.PaymentCommand{rejected})
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, consts.PaymentCommandStatusRejected, ran[0].Status)
+		assert.Equal(t, 5000, h.CurrentState().Amount)
+		_, err = w.Approve(cmds[0].ID, "alice", "ok")
+		assert.True(t, errors.Is(err, errors.ErrAlreadyReviewed))
+	})
+	t.Run("Rejected commands stay rejected when the state is resolved again", func(t *testing.T) {
+		w := approval.New(approval.NewMemoryStore(), clock.System, thresholds)
+		h, ds := approvalHandler(w)
+		ds.Amount = 3000
+		cmds, _ := h.Resolve(ctx, ds)
+		_, err := w.Reject(cmds[0].ID, "bob", "fraud")
+		assert.NoError(t, err)
+		again, _ := h.Resolve(ctx, ds)
+		assert.Equal(t, 1, len(again))
+		assert.Equal(t, cmds[0].ID, again[0].ID)
+		assert.Equal(t, consts.PaymentCommandStatusRejected, again[0].Status)
+		assert.Equal(t, "", again[0].Error)
+		assert.Equal(t, 5000, h.CurrentState().Amount)
+	})
+	t.Run("Commands whose request cannot be reached keep awaiting approval", func(t *testing.T) {
+		store := approval.NewMemoryStore()
+		w := approval.New(store, clock.System, thresholds)
+		h, ds := approvalHandler(w)
+		ds.Amount = 3000
+		cmds, _ := h.Resolve(ctx, ds)
+		r, err := store.Get(cmds[0].ID)
+		assert.NoError(t, err)
+		r.Command.Status = consts.PaymentCommandStatusFailed
+		store.Save(r)
+		again, _ := h.Resolve(ctx, ds)
+		assert.Equal(t, consts.PaymentCommandStatusAwaitingApproval, again[0].Status)
+		assert.Contains(t, again[0].Error, "failed")
+		assert.Equal(t, 5000, h.CurrentState().Amount, "Nothing runs unreviewed")
+	})
+	t.Run("Unknown commands cannot be reviewed", func(t *testing.T) {
+		w := approval.New(approval.NewMemoryStore(), clock.System, thresholds)
+		_, err := w.Approve(uuid.New(), "alice", "ok")
+		assert.True(t, errors.Is(err, errors.ErrApprovalNotFound))
+	})
+}
@@ -0,0 +1,187 @@
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments"
+	"github.com/davidjwilkins/declarative-payments/payments/resolver"
+	"github.com/google/uuid"
+	"sync"
+	"time"
+)
+
+// Entry records a desired state being received, the plan generated for it, or the outcome of running the plan
+type Entry struct {
+	Sequence   uint64                `json:"sequence"`
+	Kind       consts.AuditEventKind `json:"kind"`
+	Date       time.Time             `json:"date"`
+	ExternalID uuid.UUID             `json:"external_id"`
+	UserID     uuid.UUID             `json:"user_id"`
+	// Actor, Source and Reason are those of the desired state the entry is about
+	Actor  string `json:"actor"`
+	Source string `json:"source"`
+	Reason string `json:"reason"`
+	// State is the actual state when the entry was recorded
+	State        payments.ActualState      `json:"state"`
+	DesiredState resolver.DesiredState     `json:"desired_state"`
+	Commands     []resolver.PaymentCommand `json:"commands"`
+	Error        string                    `json:"error"`
+	// PreviousHash is the Hash of the entry before this one, which makes the log tamper-evident
+	PreviousHash string `json:"previous_hash"`
+	Hash         string `json:"hash"`
+}
+
+// hash returns the hash of e, which covers every field except Hash
+func (e Entry) hash() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Verify checks that entries are a complete, unmodified chain, starting from the first entry of the log
+func Verify(entries []Entry) error {
+	previous := ""
+	for i, e := range entries {
+		hash, err := e.hash()
+		if err != nil {
+			return err
+		}
+		if e.Sequence != uint64(i)+1 || e.PreviousHash != previous || e.Hash != hash {
+			return fmt.Errorf("%w at entry %d", errors.ErrAuditChainBroken, e.Sequence)
+		}
+		previous = e.Hash
+	}
+	return nil
+}
+
+// Log is an append-only audit log.  It is a payments.CommandObserver and a payments.ResolutionObserver, so it records
+// every desired state a handler receives, the plan generated for it, and the commands run and their outcomes.
+type Log struct {
+	lock     sync.Mutex
+	store    Store
+	clock    clock.Clock
+	failures uint64
+	onError  func(e Entry, err error)
+}
+
+func New(store Store, c clock.Clock) *Log {
+	return &Log{
+		store: store,
+		clock: c,
+	}
+}
+
+// Append chains e onto the log
+func (l *Log) Append(e Entry) (Entry, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	last, ok, err := l.store.Last()
+	if err != nil {
+		return Entry{}, err
+	}
+	e.Sequence = 1
+	e.PreviousHash = ""
+	if ok {
+		e.Sequence = last.Sequence + 1
+		e.PreviousHash = last.Hash
+	}
+	if e.Hash, err = e.hash(); err != nil {
+		return Entry{}, err
+	}
+	return e, l.store.Append(e)
+}
+
+// OnError calls f with every entry the log fails to record as an observer, and the error it failed with
+func (l *Log) OnError(f func(e Entry, err error)) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.onError = f
+}
+
+// Failures returns how many entries the log has failed to record as an observer
+func (l *Log) Failures() uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.failures
+}
+
+// record appends e.  Observers cannot return errors, so failures are counted and passed to OnError instead.
+func (l *Log) record(e Entry) {
+	if _, err := l.Append(e); err != nil {
+		l.lock.Lock()
+		l.failures++
+		onError := l.onError
+		l.lock.Unlock()
+		if onError != nil {
+			onError(e, err)
+		}
+	}
+}
+
+// Query returns the entries matching q
+func (l *Log) Query(q Query) ([]Entry, error) {
+	return l.store.Query(q)
+}
+
+// Verify checks the whole log has not been tampered with
+func (l *Log) Verify() error {
+	entries, err := l.store.Query(Query{})
+	if err != nil {
+		return err
+	}
+	return Verify(entries)
+}
+
+func (l *Log) entry(kind consts.AuditEventKind, state payments.ActualState, d resolver.DesiredState) Entry {
+	return Entry{
+		Kind:         kind,
+		Date:         l.clock.Now(),
+		ExternalID:   state.ExternalID,
+		UserID:       state.UserID,
+		Actor:        d.Actor,
+		Source:       d.Source,
+		Reason:       d.Reason,
+		State:        state,
+		DesiredState: d,
+	}
+}
+
+// Received records a desired state being received.  Observers cannot return errors, so failing to record an entry does
+// not fail the resolution, but is counted by Failures and passed to OnError.
+func (l *Log) Received(state payments.ActualState, d resolver.DesiredState) {
+	l.record(l.entry(consts.AuditEventKindReceived, state, d))
+}
+
+// Planned records the plan generated for d, or why none was
+func (l *Log) Planned(state payments.ActualState, d resolver.DesiredState, cmds []resolver.PaymentCommand, err error) {
+	e := l.entry(consts.AuditEventKindPlanned, state, d)
+	// Run changes the commands after they are planned, so the entry needs its own copy
+	e.Commands = append([]resolver.PaymentCommand(nil), cmds...)
+	if err != nil {
+		e.Error = err.Error()
+	}
+	l.record(e)
+}
+
+// Observe records the commands run and their outcomes, attributed to the desired state they were generated for
+func (l *Log) Observe(state payments.ActualState, cmds []resolver.PaymentCommand) {
+	d := resolver.DesiredState{}
+	for _, cmd := range cmds {
+		if cmd.DesiredStateID == state.LastDesiredState.ID {
+			d = state.LastDesiredState
+			break
+		}
+	}
+	e := l.entry(consts.AuditEventKindRan, state, d)
+	e.Commands = append([]resolver.PaymentCommand(nil), cmds...)
+	l.record(e)
+}
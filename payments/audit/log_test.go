@@ -0,0 +1,157 @@
+package audit_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments"
+	"github.com/davidjwilkins/declarative-payments/payments/audit"
+	"github.com/davidjwilkins/declarative-payments/payments/handlers"
+	"github.com/davidjwilkins/declarative-payments/payments/resolver"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestLog(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	setup := func() (*audit.Log, *clock.Mock, func(userID uuid.UUID) (payments.ActualState, func(d resolver.DesiredState) []error)) {
+		c := clock.NewMock(now)
+		log := audit.New(audit.NewMemoryStore(), c)
+		handler := func(userID uuid.UUID) (payments.ActualState, func(d resolver.DesiredState) []error) {
+			state := payments.ActualState{DesiredState: resolver.DesiredState{
+				ExternalID: uuid.New(),
+				UserID:     userID,
+				PartnerID:  uuid.New(),
+				Bucket:     "test",
+			}}
+			h := payments.NewHandler(&state, handlers.NewPartnerMock(), handlers.NewUserMock(), payments.WithObserver(log), payments.WithClock(c))
+			return state, func(d resolver.DesiredState) []error {
+				_, errs := h.Resolve(ctx, d)
+				return errs
+			}
+		}
+		return log, c, handler
+	}
+	desired := func(state payments.ActualState, amount int) resolver.DesiredState {
+		return resolver.DesiredState{
+			ID:         uuid.New(),
+			ExternalID: state.ExternalID,
+			UserID:     state.UserID,
+			PartnerID:  state.PartnerID,
+			Date:       now,
+			Bucket:     state.Bucket,
+			Amount:     amount,
+			Actor:      "ops@example.com",
+			Source:     "bookings",
+			Reason:     "booking-created",
+		}
+	}
+	t.Run("Records every step of a resolution", func(t *testing.T) {
+		log, _, handler := setup()
+		state, resolve := handler(uuid.New())
+		d := desired(state, 1000)
+		assert.Equal(t, 0, len(resolve(d)))
+		entries, err := log.Query(audit.Query{})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, len(entries))
+		assert.Equal(t, []consts.AuditEventKind{consts.AuditEventKindReceived, consts.AuditEventKindPlanned, consts.AuditEventKindRan},
+			[]consts.AuditEventKind{entries[0].Kind, entries[1].Kind, entries[2].Kind})
+		for _, e := range entries {
+			assert.Equal(t, "ops@example.com", e.Actor)
+			assert.Equal(t, "bookings", e.Source)
+			assert.Equal(t, "booking-created", e.Reason)
+			assert.Equal(t, d.ID, e.DesiredState.ID)
+			assert.Equal(t, state.ExternalID, e.ExternalID)
+		}
+		assert.Equal(t, consts.PaymentCommandStatusPending, entries[1].Commands[0].Status, "The plan is recorded as generated")
+		assert.Equal(t, consts.PaymentCommandStatusComplete, entries[2].Commands[0].Status, "The outcome is recorded once run")
+		assert.Equal(t, 1000, entries[2].State.Amount)
+		assert.NoError(t, log.Verify())
+	})
+	t.Run("Records plans which could not be generated", func(t *testing.T) {
+		log, _, handler := setup()
+		state, resolve := handler(uuid.New())
+		d := desired(state, 1000)
+		d.Bucket = "other"
+		assert.Equal(t, []error{errors.ErrDifferentBucket}, resolve(d))
+		entries, err := log.Query(audit.Query{})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(entries))
+		assert.Equal(t, errors.ErrDifferentBucket.Error(), entries[1].Error)
+	})
+	t.Run("Can be queried", func(t *testing.T) {
+		log, c, handler := setup()
+		userID := uuid.New()
+		first, resolveFirst := handler(userID)
+		second, resolveSecond := handler(userID)
+		other, resolveOther := handler(uuid.New())
+		assert.Equal(t, 0, len(resolveFirst(desired(first, 100))))
+		c.Advance(time.Hour)
+		assert.Equal(t, 0, len(resolveSecond(desired(second, 100))))
+		assert.Equal(t, 0, len(resolveOther(desired(other, 100))))
+
+		entries, err := log.Query(audit.Query{ExternalID: first.ExternalID})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, len(entries))
+		entries, err = log.Query(audit.Query{UserID: userID})
+		assert.NoError(t, err)
+		assert.Equal(t, 6, len(entries))
+		entries, err = log.Query(audit.Query{UserID: userID, From: now.Add(time.Minute)})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, len(entries))
+		assert.Equal(t, second.ExternalID, entries[0].ExternalID)
+		entries, err = log.Query(audit.Query{To: now.Add(time.Hour)})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, len(entries), "To is exclusive")
+	})
+	t.Run("Tampering is evident", func(t *testing.T) {
+		log, _, handler := setup()
+		state, resolve := handler(uuid.New())
+		assert.Equal(t, 0, len(resolve(desired(state, 1000))))
+		assert.Equal(t, 0, len(resolve(desired(state, 2000))))
+		entries, err := log.Query(audit.Query{})
+		assert.NoError(t, err)
+		assert.NoError(t, audit.Verify(entries))
+
+		tampered := append([]audit.Entry(nil), entries...)
+		tampered[2].Commands = nil
+		assert.True(t, errors.Is(audit.Verify(tampered), errors.ErrAuditChainBroken), "Modified entries are detected")
+		assert.True(t, errors.Is(audit.Verify(append(entries[:1:1], entries[2:]...)), errors.ErrAuditChainBroken), "Removed entries are detected")
+
+		store := audit.NewMemoryStore()
+		assert.True(t, errors.Is(store.Append(entries[1]), errors.ErrAuditChainBroken), "Entries must follow the last one")
+		assert.NoError(t, store.Append(entries[0]))
+		assert.True(t, errors.Is(store.Append(entries[0]), errors.ErrAuditChainBroken))
+	})
+	t.Run("Failures to record are reported", func(t *testing.T) {
+		c := clock.NewMock(now)
+		failed := fmt.Errorf("store unavailable")
+		log := audit.New(failingStore{audit.NewMemoryStore(), failed}, c)
+		var kinds []consts.AuditEventKind
+		log.OnError(func(e audit.Entry, err error) {
+			assert.Equal(t, failed, err)
+			kinds = append(kinds, e.Kind)
+		})
+		state := payments.ActualState{DesiredState: resolver.DesiredState{ExternalID: uuid.New(), UserID: uuid.New(), Bucket: "test"}}
+		h := payments.NewHandler(&state, handlers.NewPartnerMock(), handlers.NewUserMock(), payments.WithObserver(log), payments.WithClock(c))
+		_, errs := h.Resolve(ctx, desired(state, 1000))
+		assert.Equal(t, 0, len(errs), "The resolution does not fail")
+		assert.Equal(t, uint64(3), log.Failures())
+		assert.Equal(t, []consts.AuditEventKind{consts.AuditEventKindReceived, consts.AuditEventKindPlanned, consts.AuditEventKindRan}, kinds)
+	})
+}
+
+// failingStore fails to append any entry
+type failingStore struct {
+	audit.Store
+	err error
+}
+
+func (s failingStore) Append(e audit.Entry) error {
+	return s.err
+}
@@ -0,0 +1,77 @@
+package audit
+
+import (
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/google/uuid"
+	"sync"
+	"time"
+)
+
+// Query selects entries.  Zero fields match everything; From is inclusive and To is exclusive.
+type Query struct {
+	ExternalID uuid.UUID
+	UserID     uuid.UUID
+	From       time.Time
+	To         time.Time
+}
+
+func (q Query) matches(e Entry) bool {
+	return (q.ExternalID == uuid.Nil || q.ExternalID == e.ExternalID) &&
+		(q.UserID == uuid.Nil || q.UserID == e.UserID) &&
+		(q.From.IsZero() || !e.Date.Before(q.From)) &&
+		(q.To.IsZero() || e.Date.Before(q.To))
+}
+
+// Store is an append-only store of entries
+type Store interface {
+	// Append stores e, provided it directly follows the last entry.  Otherwise, it returns errors.ErrAuditChainBroken.
+	Append(e Entry) error
+	// Last returns the most recent entry, or false if there are none
+	Last() (Entry, bool, error)
+	// Query returns the entries matching q, in the order they were appended
+	Query(q Query) ([]Entry, error)
+}
+
+type memoryStore struct {
+	lock    sync.RWMutex
+	entries []Entry
+}
+
+func NewMemoryStore() *memoryStore {
+	return &memoryStore{}
+}
+
+func (m *memoryStore) Append(e Entry) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	previous := ""
+	if len(m.entries) > 0 {
+		previous = m.entries[len(m.entries)-1].Hash
+	}
+	if e.Sequence != uint64(len(m.entries))+1 || e.PreviousHash != previous {
+		return errors.ErrAuditChainBroken
+	}
+	m.entries = append(m.entries, e)
+	return nil
+}
+
+func (m *memoryStore) Last() (Entry, bool, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if len(m.entries) == 0 {
+		return Entry{}, false, nil
+	}
+	return m.entries[len(m.entries)-1], true, nil
+}
+
+func (m *memoryStore) Query(q Query) ([]Entry, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var entries []Entry
+	for _, e := range m.entries {
+		if q.matches(e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
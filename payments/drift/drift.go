@@ -0,0 +1,163 @@
+// Package drift detects when an ActualState no longer matches what its providers hold.
+//
+// ActualState is only updated from what handlers return, so it misses anything done at the provider directly, such
+// as refunds from a dashboard, expired authorizations or disputes.  A Detector compares the state with the providers'
+// balances, and a Report of the difference can either be adopted as the truth, or corrected by resolving the provider
+// back to the state.
+package drift
+
+import (
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/payments"
+	"github.com/davidjwilkins/declarative-payments/payments/handlers"
+	"github.com/davidjwilkins/declarative-payments/payments/resolver"
+	"github.com/google/uuid"
+	"time"
+)
+
+// Balances are what is held for a payment
+type Balances struct {
+	Amount           int
+	AuthorizedAmount uint
+	PartnerAmount    int
+}
+
+// UserSource returns how much the user's provider has captured and authorized for the payment of state
+type UserSource func(state payments.ActualState) (amount int, authorized uint, err error)
+
+// PartnerSource returns how much the partner's provider has been paid for the payment of state
+type PartnerSource func(state payments.ActualState) (int, error)
+
+// Stripe is a UserSource which reads the balances from the StripeStorage of each payment.  The storage must be a
+// handlers.ChargeLister.
+func Stripe(storage func(state payments.ActualState) (handlers.StripeStorage, error)) UserSource {
+	return func(state payments.ActualState) (int, uint, error) {
+		s, err := storage(state)
+		if err != nil {
+			return 0, 0, err
+		}
+		return handlers.StripeBalances(s)
+	}
+}
+
+// Report compares the balances a state expects with those its providers hold
+type Report struct {
+	ExternalID uuid.UUID
+	// Version is the version of the state which was checked
+	Version  uint64
+	Expected Balances
+	Actual   Balances
+	Date     time.Time
+}
+
+// Drifted reports whether the providers hold something other than the state expects
+func (r Report) Drifted() bool {
+	return r.Expected != r.Actual
+}
+
+type Detector struct {
+	user    UserSource
+	partner PartnerSource
+	clock   clock.Clock
+}
+
+// NewDetector compares states with user and partner.  If partner is nil, partner balances are assumed to be as
+// expected.
+func NewDetector(user UserSource, partner PartnerSource, c clock.Clock) *Detector {
+	return &Detector{
+		user:    user,
+		partner: partner,
+		clock:   c,
+	}
+}
+
+// Check compares state with what its providers hold
+func (d *Detector) Check(state payments.ActualState) (Report, error) {
+	report := Report{
+		ExternalID: state.ExternalID,
+		Version:    state.Version,
+		Expected: Balances{
+			Amount:           state.Amount,
+			AuthorizedAmount: state.AuthorizedAmount,
+			PartnerAmount:    state.PartnerAmount,
+		},
+		Date: d.clock.Now(),
+	}
+	report.Actual = report.Expected
+	var err error
+	if report.Actual.Amount, report.Actual.AuthorizedAmount, err = d.user(state); err != nil {
+		return Report{}, err
+	}
+	if d.partner != nil {
+		if report.Actual.PartnerAmount, err = d.partner(state); err != nil {
+			return Report{}, err
+		}
+	}
+	return report, nil
+}
+
+// Scan checks every state in store, and returns the reports of those which have drifted
+func (d *Detector) Scan(store payments.StateStore) ([]Report, error) {
+	states, err := store.Find("", consts.PaymentStatusPending, consts.PaymentStatusComplete,
+		consts.PaymentStatusError, consts.PaymentStatusFailed)
+	if err != nil {
+		return nil, err
+	}
+	var drifted []Report
+	for _, state := range states {
+		report, err := d.Check(state)
+		if err != nil {
+			return drifted, err
+		}
+		if report.Drifted() {
+			drifted = append(drifted, report)
+		}
+	}
+	return drifted, nil
+}
+
+// Adopt returns state with the balances its providers hold, as the next version.  It is pending if they are not those
+// of its last desired state, so that it can be resolved again.
+func Adopt(state payments.ActualState, report Report) payments.ActualState {
+	state.Amount = report.Actual.Amount
+	state.AuthorizedAmount = report.Actual.AuthorizedAmount
+	state.PartnerAmount = report.Actual.PartnerAmount
+	state.UpdateRevenue()
+	state.Version++
+	last := state.LastDesiredState
+	if last.ID != uuid.Nil && (last.Amount != state.Amount || last.AuthorizedAmount != state.AuthorizedAmount ||
+		last.PartnerAmount != state.PartnerAmount) && state.Status == consts.PaymentStatusComplete {
+		state.Status = consts.PaymentStatusPending
+	}
+	return state
+}
+
+// AdoptStored adopts the providers' balances for the state in store which report was made from.  If the state has
+// changed since, errors.ErrStaleState is returned, and it should be checked again.
+func AdoptStored(store payments.StateStore, report Report) (payments.ActualState, error) {
+	state, err := store.Load(report.ExternalID)
+	if err != nil {
+		return payments.ActualState{}, err
+	}
+	adopted := Adopt(state, report)
+	if err := store.Save(adopted, report.Version); err != nil {
+		return payments.ActualState{}, err
+	}
+	return adopted, nil
+}
+
+// Correction returns the desired state which moves the providers back to the balances state expected.  Resolve it on a
+// handler for the adopted state, so that the commands are generated from what the providers hold.
+func Correction(state payments.ActualState, report Report) resolver.DesiredState {
+	d := state.DesiredState
+	d.ID = uuid.New()
+	d.Date = report.Date
+	d.Amount = report.Expected.Amount
+	d.AuthorizedAmount = report.Expected.AuthorizedAmount
+	d.PartnerAmount = report.Expected.PartnerAmount
+	d.Actor = ""
+	d.Source = "drift"
+	d.Reason = "correction"
+	return d
+}
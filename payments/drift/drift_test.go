@@ -0,0 +1,138 @@
+package drift_test
+
+import (
+	"context"
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments"
+	"github.com/davidjwilkins/declarative-payments/payments/drift"
+	"github.com/davidjwilkins/declarative-payments/payments/handlers"
+	"github.com/davidjwilkins/declarative-payments/payments/resolver"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/stripe-go/v72"
+	"testing"
+	"time"
+)
+
+type userBalances interface {
+	payments.UserHandler
+	Balance() int
+	AuthorizedBalance() uint
+}
+
+type partnerBalances interface {
+	payments.PartnerHandler
+	Balance() int
+}
+
+func TestDetector(t *testing.T) {
+	setup := func() (*drift.Detector, payments.StateStore, *payments.ActualState, userBalances, partnerBalances) {
+		user, partner := handlers.NewUserMock(), handlers.NewPartnerMock()
+		store := payments.NewMemoryStateStore()
+		state := &payments.ActualState{DesiredState: resolver.DesiredState{ExternalID: uuid.New(), Bucket: "test"}}
+		h := payments.NewHandler(state, partner, user, payments.WithStateStore(store))
+		d := state.DesiredState
+		d.ID = uuid.New()
+		d.Date = time.Now()
+		d.Amount = 1000
+		d.AuthorizedAmount = 500
+		d.PartnerAmount = 900
+		_, errs := h.Resolve(context.Background(), d)
+		assert.Equal(t, 0, len(errs))
+		detector := drift.NewDetector(
+			func(payments.ActualState) (int, uint, error) {
+				return user.Balance(), user.AuthorizedBalance(), nil
+			},
+			func(payments.ActualState) (int, error) {
+				return partner.Balance(), nil
+			},
+			clock.System,
+		)
+		return detector, store, state, user, partner
+	}
+	t.Run("No drift when the providers match", func(t *testing.T) {
+		detector, store, state, _, _ := setup()
+		report, err := detector.Check(*state)
+		assert.NoError(t, err)
+		assert.False(t, report.Drifted())
+		drifted, err := detector.Scan(store)
+		assert.NoError(t, err)
+		assert.Empty(t, drifted)
+	})
+	t.Run("Changes made at the provider are reported", func(t *testing.T) {
+		detector, store, state, user, partner := setup()
+		user.Refund("dashboard", 200)
+		user.Release("expired", 500)
+		partner.Withdraw("chargeback", 100)
+		drifted, err := detector.Scan(store)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(drifted))
+		assert.Equal(t, state.ExternalID, drifted[0].ExternalID)
+		assert.Equal(t, state.Version, drifted[0].Version)
+		assert.Equal(t, drift.Balances{Amount: 1000, AuthorizedAmount: 500, PartnerAmount: 900}, drifted[0].Expected)
+		assert.Equal(t, drift.Balances{Amount: 800, AuthorizedAmount: 0, PartnerAmount: 800}, drifted[0].Actual)
+	})
+	t.Run("Provider balances can be adopted", func(t *testing.T) {
+		detector, store, state, user, _ := setup()
+		user.Refund("dashboard", 200)
+		report, err := detector.Check(*state)
+		assert.NoError(t, err)
+		adopted, err := drift.AdoptStored(store, report)
+		assert.NoError(t, err)
+		assert.Equal(t, 800, adopted.Amount)
+		assert.Equal(t, state.Version+1, adopted.Version)
+		assert.Equal(t, consts.PaymentStatusPending, adopted.Status, "The last desired state is no longer reached")
+		stored, err := store.Load(state.ExternalID)
+		assert.NoError(t, err)
+		assert.Equal(t, adopted, stored)
+		report, err = detector.Check(stored)
+		assert.NoError(t, err)
+		assert.False(t, report.Drifted())
+		_, err = drift.AdoptStored(store, report)
+		assert.NoError(t, err)
+		_, err = drift.AdoptStored(store, report)
+		assert.True(t, errors.Is(err, errors.ErrStaleState), "Reports of older versions cannot be adopted")
+	})
+	t.Run("Providers can be corrected", func(t *testing.T) {
+		detector, store, state, user, partner := setup()
+		user.Refund("dashboard", 200)
+		report, err := detector.Check(*state)
+		assert.NoError(t, err)
+		adopted, err := drift.AdoptStored(store, report)
+		assert.NoError(t, err)
+		h := payments.NewHandler(&adopted, partner, user, payments.WithStateStore(store))
+		correction := drift.Correction(adopted, report)
+		assert.Equal(t, "drift", correction.Source)
+		cmds, errs := h.Resolve(context.Background(), correction)
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, 1, len(cmds))
+		assert.Equal(t, consts.PaymentCommandActionCharge, cmds[0].Action)
+		report, err = detector.Check(h.CurrentState())
+		assert.NoError(t, err)
+		assert.False(t, report.Drifted())
+		assert.Equal(t, 1000, user.Balance())
+	})
+}
+
+func TestStripeSource(t *testing.T) {
+	storage := handlers.NewMockStripeStorage("test")
+	storage.UpsertCharge(stripe.Charge{ID: "charged", Amount: 1000, AmountRefunded: 300, Captured: true, Paid: true})
+	storage.UpsertCharge(stripe.Charge{ID: "authorized", Amount: 500, Paid: true})
+	storage.UpsertCharge(stripe.Charge{ID: "released", Amount: 400, AmountRefunded: 400, Refunded: true, Paid: true})
+	storage.UpsertCharge(stripe.Charge{ID: "partly-captured", Amount: 800, AmountCaptured: 200, Captured: true, Paid: true,
+		PaymentIntent: &stripe.PaymentIntent{ID: "pi", Status: stripe.PaymentIntentStatusRequiresCapture}})
+	source := drift.Stripe(func(payments.ActualState) (handlers.StripeStorage, error) {
+		return storage, nil
+	})
+	amount, authorized, err := source(payments.ActualState{})
+	assert.NoError(t, err)
+	assert.Equal(t, 900, amount)
+	assert.Equal(t, uint(1100), authorized)
+	unlisted := drift.Stripe(func(payments.ActualState) (handlers.StripeStorage, error) {
+		return struct{ handlers.StripeStorage }{storage}, nil
+	})
+	_, _, err = unlisted(payments.ActualState{})
+	assert.True(t, errors.Is(err, errors.ErrChargesNotListed), "Storage which cannot list its charges is an error")
+}
@@ -0,0 +1,87 @@
+// Package fees models what the platform and the provider take from a payment, so that partners can be paid what is
+// left, and the platform's revenue can be told apart from the provider's fees.
+package fees
+
+import (
+	"fmt"
+	"github.com/davidjwilkins/declarative-payments/errors"
+)
+
+// Fee is a percentage of an amount plus a fixed amount
+type Fee struct {
+	// BasisPoints is the percentage in hundredths of a percent, so 290 is 2.9%
+	BasisPoints uint `json:"basis_points"`
+	// Fixed is in the smallest unit of the currency
+	Fixed uint `json:"fixed"`
+}
+
+// Of returns the fee on amount, rounded to the nearest unit.  Nothing is taken from nothing, and never more than amount.
+func (f Fee) Of(amount uint) uint {
+	if amount == 0 {
+		return 0
+	}
+	fee := (uint64(amount)*uint64(f.BasisPoints)+5000)/10000 + uint64(f.Fixed)
+	if fee > uint64(amount) {
+		return amount
+	}
+	return uint(fee)
+}
+
+// Schedule is the Fee in each currency, keyed by its lowercase ISO code
+type Schedule map[string]Fee
+
+// Schedules are the fees of a bucket
+type Schedules struct {
+	// Platform is what the platform keeps of each payment
+	Platform Schedule `json:"platform"`
+	// Provider is what the provider is estimated to take of each capture and charge
+	Provider Schedule `json:"provider"`
+}
+
+// Fees are the fees in one currency
+type Fees struct {
+	Platform Fee
+	Provider Fee
+}
+
+// For returns the fees in currency.  An empty schedule takes nothing, but errors.ErrInvalidFeeSchedule is returned if a
+// schedule has no fee for currency, or a fee of more than 100%.
+func (s Schedules) For(currency string) (Fees, error) {
+	var f Fees
+	for _, schedule := range []struct {
+		name     string
+		schedule Schedule
+		fee      *Fee
+	}{{"platform", s.Platform, &f.Platform}, {"provider", s.Provider, &f.Provider}} {
+		if len(schedule.schedule) == 0 {
+			continue
+		}
+		fee, ok := schedule.schedule[currency]
+		if !ok {
+			return Fees{}, fmt.Errorf("%w: no %s fee in %q", errors.ErrInvalidFeeSchedule, schedule.name, currency)
+		}
+		if fee.BasisPoints > 10000 {
+			return Fees{}, fmt.Errorf("%w: %s fee in %q is over 100%%", errors.ErrInvalidFeeSchedule, schedule.name, currency)
+		}
+		*schedule.fee = fee
+	}
+	return f, nil
+}
+
+// Net returns what is left of a user amount once the platform and provider have taken their fees.  collected is how
+// much of the amount has already been captured or charged, and providerFees what the provider took of it, which it
+// keeps even if the amount is refunded.  The provider's fee is only estimated for what is still to be collected.
+func (f Fees) Net(amount, collected int, providerFees uint) int {
+	if amount <= 0 {
+		return amount
+	}
+	provider := int(providerFees)
+	if pending := amount - collected; pending > 0 {
+		provider += int(f.Provider.Of(uint(pending)))
+	}
+	net := amount - int(f.Platform.Of(uint(amount))) - provider
+	if net < 0 {
+		return 0
+	}
+	return net
+}
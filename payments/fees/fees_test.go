@@ -0,0 +1,43 @@
+package fees_test
+
+import (
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments/fees"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestFees(t *testing.T) {
+	t.Run("Fees are a percentage plus a fixed amount", func(t *testing.T) {
+		fee := fees.Fee{BasisPoints: 290, Fixed: 30}
+		assert.Equal(t, uint(59), fee.Of(1000))
+		assert.Equal(t, uint(33), fee.Of(100), "Percentages are rounded to the nearest unit")
+		assert.Equal(t, uint(0), fee.Of(0), "Nothing is taken from nothing")
+		assert.Equal(t, uint(20), fee.Of(20), "No more than the amount is taken")
+	})
+	t.Run("Schedules are chosen by currency", func(t *testing.T) {
+		schedules := fees.Schedules{
+			Platform: fees.Schedule{"usd": {BasisPoints: 1000}, "eur": {BasisPoints: 500}},
+			Provider: fees.Schedule{"usd": {BasisPoints: 290, Fixed: 30}},
+		}
+		usd, err := schedules.For("usd")
+		assert.NoError(t, err)
+		assert.Equal(t, fees.Fees{Platform: fees.Fee{BasisPoints: 1000}, Provider: fees.Fee{BasisPoints: 290, Fixed: 30}}, usd)
+		_, err = schedules.For("eur")
+		assert.True(t, errors.Is(err, errors.ErrInvalidFeeSchedule), "Every schedule must include the currency")
+		none, err := fees.Schedules{}.For("gbp")
+		assert.NoError(t, err)
+		assert.Equal(t, fees.Fees{}, none, "Empty schedules take nothing")
+		_, err = fees.Schedules{Platform: fees.Schedule{"usd": {BasisPoints: 10001}}}.For("usd")
+		assert.True(t, errors.Is(err, errors.ErrInvalidFeeSchedule))
+	})
+	t.Run("Net is what is left for the partner", func(t *testing.T) {
+		f := fees.Fees{Platform: fees.Fee{BasisPoints: 1000}, Provider: fees.Fee{BasisPoints: 290, Fixed: 30}}
+		assert.Equal(t, 841, f.Net(1000, 0, 0))
+		assert.Equal(t, 0, f.Net(30, 0, 0), "Partners are never owed less than nothing")
+		assert.Equal(t, 0, f.Net(0, 0, 0))
+		assert.Equal(t, 1000, fees.Fees{}.Net(1000, 0, 0))
+		assert.Equal(t, 1246, f.Net(1500, 1000, 59), "Fees taken are kept, and only the rest is estimated")
+		assert.Equal(t, 391, f.Net(500, 1000, 59), "Provider fees are not returned by refunds")
+	})
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// StatementDescriptorLength is the most characters a card statement will show
+const StatementDescriptorLength = 22
+
+// Descriptions are templates for the description and statement descriptor of the objects a handler makes at its
+// provider.  They are executed with the metadata of the command making the object, e.g. "Order {{.order}}".  Either
+// may be empty, in which case the provider's default is used.
+type Descriptions struct {
+	Description         string `json:"description"`
+	StatementDescriptor string `json:"statement_descriptor"`
+}
+
+// Parse checks that the templates of d are valid
+func (d Descriptions) Parse() error {
+	_, _, err := d.parse()
+	return err
+}
+
+func (d Descriptions) parse() (description, statementDescriptor *template.Template, err error) {
+	if d.Description != "" {
+		if description, err = template.New("description").Option("missingkey=zero").Parse(d.Description); err != nil {
+			return nil, nil, fmt.Errorf("description: %w", err)
+		}
+	}
+	if d.StatementDescriptor != "" {
+		statementDescriptor, err = template.New("statement_descriptor").Option("missingkey=zero").Parse(d.StatementDescriptor)
+		if err != nil {
+			return nil, nil, fmt.Errorf("statement descriptor: %w", err)
+		}
+	}
+	return description, statementDescriptor, nil
+}
+
+// annotations holds the metadata of the commands a handler is running, by idempotency key, and the templates which
+// describe them.  It is shared by copies of the handler.
+type annotations struct {
+	lock                sync.RWMutex
+	metadata            map[string]map[string]string
+	description         *template.Template
+	statementDescriptor *template.Template
+}
+
+func newAnnotations() *annotations {
+	return &annotations{metadata: make(map[string]map[string]string)}
+}
+
+func (a *annotations) annotate(idempotencyKey string, metadata map[string]string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if metadata == nil {
+		delete(a.metadata, idempotencyKey)
+		return
+	}
+	a.metadata[idempotencyKey] = metadata
+}
+
+func (a *annotations) describe(d Descriptions) error {
+	description, statementDescriptor, err := d.parse()
+	if err != nil {
+		return err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.description, a.statementDescriptor = description, statementDescriptor
+	return nil
+}
+
+// lookup returns the metadata of the command an object is made for, along with extra.  Handlers derive the keys of
+// the objects they make from the command's key by adding a suffix after a colon, which is ignored.
+func (a *annotations) lookup(idempotencyKey string, extra map[string]string) map[string]string {
+	command := idempotencyKey
+	if i := strings.Index(command, ":"); i >= 0 {
+		command = command[:i]
+	}
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	metadata := make(map[string]string, len(a.metadata[command])+len(extra))
+	for k, v := range a.metadata[command] {
+		metadata[k] = v
+	}
+	for k, v := range extra {
+		metadata[k] = v
+	}
+	return metadata
+}
+
+// descriptions returns the description and statement descriptor for an object with metadata, or nil for those which
+// are not templated.  Statement descriptors are cut to StatementDescriptorLength.
+func (a *annotations) descriptions(metadata map[string]string) (description, statementDescriptor *string) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	execute := func(t *template.Template, max int) *string {
+		if t == nil {
+			return nil
+		}
+		var b strings.Builder
+		if err := t.Execute(&b, metadata); err != nil {
+			return nil
+		}
+		s := strings.TrimSpace(b.String())
+		if runes := []rune(s); max > 0 && len(runes) > max {
+			s = strings.TrimSpace(string(runes[:max]))
+		}
+		return &s
+	}
+	return execute(a.description, 0), execute(a.statementDescriptor, StatementDescriptorLength)
+}
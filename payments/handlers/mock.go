@@ -2,18 +2,151 @@ package handlers
 
 import (
 	"errors"
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/consts"
 	"sync"
+	"time"
 )
 
+// Call is a call made to a mock, in the order the calls returned
+type Call struct {
+	Method string
+	Key    string
+	Amount uint
+	// Result is the amount the call returned, for those which return one
+	Result uint
+	Err    error
+	Date   time.Time
+}
+
+// Response is what a scripted call returns instead of being made
+type Response struct {
+	Amount uint
+	Err    error
+}
+
+// TestingT is the part of *testing.T the assertions of a mock need
+type TestingT interface {
+	Errorf(format string, args ...interface{})
+}
+
+// recorder keeps the history of a mock's calls, and the responses scripted for them
+type recorder struct {
+	recording sync.Mutex
+	clock     clock.Clock
+	history   []Call
+	counts    map[string]int
+	scripts   map[string]map[int]Response
+}
+
+func newRecorder() recorder {
+	return recorder{
+		clock:   clock.System,
+		counts:  make(map[string]int),
+		scripts: make(map[string]map[int]Response),
+	}
+}
+
+// SetClock sets the clock calls are dated with
+func (r *recorder) SetClock(c clock.Clock) {
+	r.recording.Lock()
+	defer r.recording.Unlock()
+	r.clock = c
+}
+
+// Respond scripts the nth call to method, counting from 1, to return response instead of being made
+func (r *recorder) Respond(method string, n int, response Response) {
+	r.recording.Lock()
+	defer r.recording.Unlock()
+	if r.scripts[method] == nil {
+		r.scripts[method] = make(map[int]Response)
+	}
+	r.scripts[method][n] = response
+}
+
+// call makes fn, unless a response is scripted for it, and records the call
+func (r *recorder) call(method, key string, amount uint, fn func() (uint, error)) (uint, error) {
+	r.recording.Lock()
+	r.counts[method]++
+	response, scripted := r.scripts[method][r.counts[method]]
+	r.recording.Unlock()
+	result, err := response.Amount, response.Err
+	if !scripted {
+		result, err = fn()
+	}
+	r.record(Call{Method: method, Key: key, Amount: amount, Result: result, Err: err})
+	return result, err
+}
+
+// record adds c to the history, dated now
+func (r *recorder) record(c Call) {
+	r.recording.Lock()
+	defer r.recording.Unlock()
+	c.Date = r.clock.Now()
+	r.history = append(r.history, c)
+}
+
+// History returns every call made so far
+func (r *recorder) History() []Call {
+	r.recording.Lock()
+	defer r.recording.Unlock()
+	return append([]Call(nil), r.history...)
+}
+
+// CallsTo returns the calls made to method
+func (r *recorder) CallsTo(method string) []Call {
+	var calls []Call
+	for _, c := range r.History() {
+		if c.Method == method {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// AssertSequence asserts that methods were called in order, though other calls may have been made between them
+func (r *recorder) AssertSequence(t TestingT, methods ...string) bool {
+	history := r.History()
+	next := 0
+	for _, c := range history {
+		if next < len(methods) && c.Method == methods[next] {
+			next++
+		}
+	}
+	if next < len(methods) {
+		var called []string
+		for _, c := range history {
+			called = append(called, c.Method)
+		}
+		t.Errorf("expected calls %v in order, but %s was not called after them in %v", methods[:next], methods[next], called)
+		return false
+	}
+	return true
+}
+
+// AssertCalledWith asserts that method was called with key and amount
+func (r *recorder) AssertCalledWith(t TestingT, method, key string, amount uint) bool {
+	for _, c := range r.CallsTo(method) {
+		if c.Key == key && c.Amount == amount {
+			return true
+		}
+	}
+	t.Errorf("expected %s to be called with key %q and amount %d, but it was called with %v", method, key, amount, r.CallsTo(method))
+	return false
+}
+
 type userMock struct {
+	recorder
 	lock              sync.RWMutex
 	balance           int
 	authorizedBalance uint
 	handled           map[string]struct{}
 	errors            map[string]error
+	capabilities      []consts.Capability
 }
 
 type partnerMock struct {
+	recorder
 	lock    sync.RWMutex
 	balance int
 	handled map[string]struct{}
@@ -22,13 +155,30 @@ type partnerMock struct {
 
 func NewUserMock() *userMock {
 	return &userMock{
+		recorder:          newRecorder(),
 		balance:           0,
 		authorizedBalance: 0,
 		handled:           make(map[string]struct{}),
 		errors:            make(map[string]error),
+		capabilities:      []consts.Capability{consts.CapabilityPartialCapture, consts.CapabilityPartialRelease},
 	}
 }
 
+// Capabilities returns what the mock advertises.  By default, it captures and releases independently.
+func (m *userMock) Capabilities() []consts.Capability {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.capabilities
+}
+
+// SetCapabilities changes what the mock advertises, so it can stand in for other providers.  Handlers read the
+// capabilities when they are created, so this must be called before then.
+func (m *userMock) SetCapabilities(capabilities ...consts.Capability) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.capabilities = capabilities
+}
+
 func (m *userMock) ShouldErr(key string, err error) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
@@ -61,13 +211,13 @@ func (m *userMock) AuthorizedBalance() uint {
 	return m.authorizedBalance
 }
 
-func (m *userMock) Authorize(idempotencyKey string, amount uint) error {
-	return m.ifNotHandled(idempotencyKey, func() {
+func (m *userMock) authorize(idempotencyKey string, amount uint) (uint, error) {
+	return 0, m.ifNotHandled(idempotencyKey, func() {
 		m.authorizedBalance += amount
 	})
 }
 
-func (m *userMock) Capture(idempotencyKey string, amount uint) (uint, error) {
+func (m *userMock) capture(idempotencyKey string, amount uint) (uint, error) {
 	authorizedBalance := m.AuthorizedBalance()
 	if authorizedBalance < amount {
 		return 0, errors.New("cannot capture more than authorized")
@@ -83,7 +233,7 @@ func (m *userMock) Capture(idempotencyKey string, amount uint) (uint, error) {
 	return 0, err
 }
 
-func (m *userMock) Release(idempotencyKey string, amount uint) (uint, error) {
+func (m *userMock) release(idempotencyKey string, amount uint) (uint, error) {
 	authorizedBalance := m.AuthorizedBalance()
 	if authorizedBalance < amount {
 		return 0, errors.New("cannot release more than authorized")
@@ -97,33 +247,104 @@ func (m *userMock) Release(idempotencyKey string, amount uint) (uint, error) {
 	return amount, err
 }
 
+func (m *userMock) charge(idempotencyKey string, amount uint) (uint, error) {
+	return 0, m.ifNotHandled(idempotencyKey, func() {
+		m.balance += int(amount)
+	})
+}
+
+func (m *userMock) refund(idempotencyKey string, amount uint) (uint, error) {
+	err := m.ifNotHandled(idempotencyKey, func() {
+		m.balance -= int(amount)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return amount, nil
+}
+
+func (m *userMock) Authorize(idempotencyKey string, amount uint) error {
+	_, err := m.call("Authorize", idempotencyKey, amount, func() (uint, error) {
+		return m.authorize(idempotencyKey, amount)
+	})
+	return err
+}
+
+func (m *userMock) Capture(idempotencyKey string, amount uint) (uint, error) {
+	return m.call("Capture", idempotencyKey, amount, func() (uint, error) {
+		return m.capture(idempotencyKey, amount)
+	})
+}
+
+func (m *userMock) Release(idempotencyKey string, amount uint) (uint, error) {
+	return m.call("Release", idempotencyKey, amount, func() (uint, error) {
+		return m.release(idempotencyKey, amount)
+	})
+}
+
+// CaptureRelease is recorded with the capture key and amount, after the Capture and Release it makes.  To script its
+// response, script those instead.
 func (m *userMock) CaptureRelease(captureKey string, capture uint, releaseKey string, release uint) (uint, error, uint, error) {
 	captured, captureErr := m.Capture(captureKey, capture)
 	released, releaseErr := m.Release(releaseKey, release)
+	m.record(Call{Method: "CaptureRelease", Key: captureKey, Amount: capture, Result: captured, Err: captureErr})
 	return captured, captureErr, released, releaseErr
 }
 
 func (m *userMock) Charge(idempotencyKey string, amount uint) error {
-	return m.ifNotHandled(idempotencyKey, func() {
-		m.balance += int(amount)
+	_, err := m.call("Charge", idempotencyKey, amount, func() (uint, error) {
+		return m.charge(idempotencyKey, amount)
 	})
+	return err
 }
 
 func (m *userMock) Refund(idempotencyKey string, amount uint) (uint, error) {
-	err := m.ifNotHandled(idempotencyKey, func() {
-		m.balance -= int(amount)
+	return m.call("Refund", idempotencyKey, amount, func() (uint, error) {
+		return m.refund(idempotencyKey, amount)
 	})
-	if err != nil {
-		return 0, err
-	}
-	return amount, nil
+}
+
+// incrementalUserMock is a userMock which supports incremental authorization and multicapture
+type incrementalUserMock struct {
+	*userMock
+}
+
+// NewIncrementalUserMock returns a mock which advertises incremental authorization and multicapture, but not partial
+// capture, so captures and releases are run together
+func NewIncrementalUserMock() *incrementalUserMock {
+	m := &incrementalUserMock{userMock: NewUserMock()}
+	m.SetCapabilities(
+		consts.CapabilityIncrementalAuthorization,
+		consts.CapabilityMultiCapture,
+		consts.CapabilityPartialRelease,
+	)
+	return m
+}
+
+func (m *incrementalUserMock) IncrementAuthorization(idempotencyKey string, amount uint) error {
+	_, err := m.call("IncrementAuthorization", idempotencyKey, amount, func() (uint, error) {
+		return m.authorize(idempotencyKey, amount)
+	})
+	return err
+}
+
+func (m *incrementalUserMock) MultiCapture(idempotencyKey string, amount uint) (uint, error) {
+	return m.call("MultiCapture", idempotencyKey, amount, func() (uint, error) {
+		return m.capture(idempotencyKey, amount)
+	})
+}
+
+// Calls returns how many increments, multicaptures and capture-releases have been made
+func (m *incrementalUserMock) Calls() (increments, multiCaptures, captureReleases int) {
+	return len(m.CallsTo("IncrementAuthorization")), len(m.CallsTo("MultiCapture")), len(m.CallsTo("CaptureRelease"))
 }
 
 func NewPartnerMock() *partnerMock {
 	return &partnerMock{
-		balance: 0,
-		handled: make(map[string]struct{}),
-		errors:  make(map[string]error),
+		recorder: newRecorder(),
+		balance:  0,
+		handled:  make(map[string]struct{}),
+		errors:   make(map[string]error),
 	}
 }
 
@@ -154,13 +375,19 @@ func (m *partnerMock) Balance() int {
 }
 
 func (m *partnerMock) Deposit(idempotencyKey string, amount uint) error {
-	return m.ifNotHandled(idempotencyKey, func() {
-		m.balance += int(amount)
+	_, err := m.call("Deposit", idempotencyKey, amount, func() (uint, error) {
+		return 0, m.ifNotHandled(idempotencyKey, func() {
+			m.balance += int(amount)
+		})
 	})
+	return err
 }
 
 func (m *partnerMock) Withdraw(idempotencyKey string, amount uint) error {
-	return m.ifNotHandled(idempotencyKey, func() {
-		m.balance -= int(amount)
+	_, err := m.call("Withdraw", idempotencyKey, amount, func() (uint, error) {
+		return 0, m.ifNotHandled(idempotencyKey, func() {
+			m.balance -= int(amount)
+		})
 	})
+	return err
 }
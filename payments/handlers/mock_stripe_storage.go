@@ -8,18 +8,24 @@ import (
 type mockStripeStorage struct {
 	bucket     string
 	Charges    map[string]stripe.Charge
+	// Selector chooses the authorizations for GetAuthorizationsFor.  Defaults to OldestFirst.
+	Selector AuthorizationSelector
 }
 
 func NewMockStripeStorage(bucket string) *mockStripeStorage {
 	return &mockStripeStorage{
 		bucket,
 		make(map[string]stripe.Charge),
+		OldestFirst,
 	}
 }
 func (m *mockStripeStorage) ListAuthorizations() []stripe.Charge {
 	authorizations := []stripe.Charge{}
 	for _, charge := range m.Charges {
-		if !charge.Captured && !charge.Disputed && !charge.Refunded && charge.Status != "failed" {
+		// A PaymentIntent which has been partly captured can still be captured again
+		capturable := !charge.Captured ||
+			(charge.PaymentIntent != nil && charge.PaymentIntent.Status == stripe.PaymentIntentStatusRequiresCapture)
+		if capturable && !charge.Disputed && !charge.Refunded && charge.Status != "failed" {
 			authorizations = append(authorizations, charge)
 		}
 	}
@@ -37,18 +43,7 @@ func (m *mockStripeStorage) ListCharges() []stripe.Charge {
 }
 
 func (m *mockStripeStorage) GetAuthorizationsFor(amount uint) []stripe.Charge {
-	auths := m.ListAuthorizations()
-	sort.Slice(auths, func(i, j int) bool {
-		return auths[i].Created < auths[j].Created
-	})
-	var i int
-	intAmount := int(amount)
-	for i = 0; i < len(auths) && intAmount > 0; i++ {
-		if auths[i].Amount > auths[i].AmountRefunded && auths[i].Paid {
-			intAmount -= int(auths[i].Amount - auths[i].AmountRefunded)
-		}
-	}
-	return auths[:i]
+	return m.Selector.Select(m.ListAuthorizations(), amount)
 }
 
 func (m *mockStripeStorage) GetChargesFor(amount uint) []stripe.Charge {
@@ -2,11 +2,14 @@ package handlers_test
 
 import (
 	"errors"
+	"fmt"
+	"github.com/davidjwilkins/declarative-payments/clock"
 	"github.com/davidjwilkins/declarative-payments/payments/handlers"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestPartnerMock(t *testing.T) {
@@ -172,3 +175,63 @@ func TestUserMock(t *testing.T) {
 		assert.Equal(t, 0, m.Balance(), "Balance is correct after concurrent operations")
 	})
 }
+
+// failures records what a mock's assertions report
+type failures struct {
+	messages []string
+}
+
+func (f *failures) Errorf(format string, args ...interface{}) {
+	f.messages = append(f.messages, fmt.Sprintf(format, args...))
+}
+
+func TestMockRecording(t *testing.T) {
+	t.Run("Calls are recorded", func(t *testing.T) {
+		c := clock.NewMock(time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC))
+		m := handlers.NewUserMock()
+		m.SetClock(c)
+		assert.NoError(t, m.Authorize("a", 1000))
+		c.Advance(time.Minute)
+		m.Capture("b", 2000)
+		history := m.History()
+		assert.Equal(t, 2, len(history))
+		assert.Equal(t, handlers.Call{Method: "Authorize", Key: "a", Amount: 1000, Date: c.Now().Add(-time.Minute)}, history[0])
+		assert.Equal(t, "Capture", history[1].Method)
+		assert.Equal(t, uint(0), history[1].Result)
+		assert.Error(t, history[1].Err, "Failed calls are recorded")
+		assert.Equal(t, c.Now(), history[1].Date)
+	})
+	t.Run("Capture-releases are recorded with what they make", func(t *testing.T) {
+		m := handlers.NewUserMock()
+		m.Authorize("a", 1000)
+		m.CaptureRelease("b", 400, "c", 100)
+		assert.True(t, m.AssertSequence(t, "Authorize", "Capture", "Release", "CaptureRelease"))
+		assert.True(t, m.AssertCalledWith(t, "Release", "c", 100))
+		assert.Equal(t, uint(400), m.CallsTo("CaptureRelease")[0].Result)
+	})
+	t.Run("Assertions report failures", func(t *testing.T) {
+		m := handlers.NewPartnerMock()
+		m.Deposit("a", 100)
+		m.Withdraw("b", 100)
+		f := &failures{}
+		assert.True(t, m.AssertSequence(f, "Deposit", "Withdraw"))
+		assert.False(t, m.AssertSequence(f, "Withdraw", "Deposit"))
+		assert.False(t, m.AssertCalledWith(f, "Deposit", "a", 200))
+		assert.Equal(t, 2, len(f.messages))
+		assert.Contains(t, f.messages[0], "Deposit was not called")
+	})
+	t.Run("Responses can be scripted", func(t *testing.T) {
+		m := handlers.NewUserMock()
+		declined := errors.New("declined")
+		m.Respond("Charge", 2, handlers.Response{Err: declined})
+		m.Respond("Refund", 1, handlers.Response{Amount: 40})
+		assert.NoError(t, m.Charge("a", 100))
+		assert.Equal(t, declined, m.Charge("b", 100), "The second charge is scripted")
+		assert.NoError(t, m.Charge("b", 100), "Only the second")
+		refunded, err := m.Refund("c", 100)
+		assert.NoError(t, err)
+		assert.Equal(t, uint(40), refunded)
+		assert.Equal(t, 200, m.Balance(), "Scripted calls are not made")
+		assert.Equal(t, 4, len(m.History()))
+	})
+}
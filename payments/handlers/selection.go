@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"github.com/stripe/stripe-go/v72"
+	"sort"
+)
+
+// AuthorizationSelector chooses which authorizations to capture or release an amount from.  Every authorization it
+// selects is used in full except the last, which may be used in part, leaving a remainder which has to be
+// re-authorized.  If the authorizations cannot cover the amount, all of them are selected.
+type AuthorizationSelector interface {
+	Select(auths []stripe.Charge, amount uint) []stripe.Charge
+}
+
+// available returns how much of auth is left to capture or release, or 0 if it cannot be used.  Authorizations made
+// with PaymentIntents may already be partly captured, and while they can still be captured, anything refunded was
+// refunded from what they captured rather than released.
+func available(auth stripe.Charge) int64 {
+	left := auth.Amount - auth.AmountRefunded - auth.AmountCaptured
+	if auth.PaymentIntent != nil && auth.PaymentIntent.Status == stripe.PaymentIntentStatusRequiresCapture {
+		left = auth.Amount - auth.AmountCaptured
+	}
+	if !auth.Paid || left <= 0 {
+		return 0
+	}
+	return left
+}
+
+func oldest(auths []stripe.Charge) []stripe.Charge {
+	sorted := append([]stripe.Charge(nil), auths...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Created < sorted[j].Created
+	})
+	return sorted
+}
+
+type oldestFirst struct{}
+
+// OldestFirst takes the oldest authorizations until the amount is covered
+var OldestFirst AuthorizationSelector = oldestFirst{}
+
+func (oldestFirst) Select(auths []stripe.Charge, amount uint) []stripe.Charge {
+	auths = oldest(auths)
+	var i int
+	left := int64(amount)
+	for i = 0; i < len(auths) && left > 0; i++ {
+		left -= available(auths[i])
+	}
+	return auths[:i]
+}
+
+type bestFit struct {
+	maxCandidates int
+}
+
+// DefaultMaxCandidates bounds the search of BestFit, which is exponential in the number of authorizations
+const DefaultMaxCandidates = 20
+
+// BestFit selects the authorizations which cover the amount with the smallest remainder, preferring exact coverage so
+// that nothing has to be re-authorized.  Of equally good selections, it prefers the oldest authorizations, since they
+// expire first.  With more than maxCandidates usable authorizations, it falls back to OldestFirst.
+func BestFit(maxCandidates int) AuthorizationSelector {
+	if maxCandidates <= 0 {
+		maxCandidates = DefaultMaxCandidates
+	}
+	return bestFit{maxCandidates: maxCandidates}
+}
+
+func (b bestFit) Select(auths []stripe.Charge, amount uint) []stripe.Charge {
+	var candidates []stripe.Charge
+	var total int64
+	for _, auth := range oldest(auths) {
+		if a := available(auth); a > 0 {
+			candidates = append(candidates, auth)
+			total += a
+		}
+	}
+	target := int64(amount)
+	if target == 0 {
+		return nil
+	}
+	if total <= target {
+		return candidates
+	}
+	if len(candidates) > b.maxCandidates {
+		return OldestFirst.Select(auths, amount)
+	}
+	// remaining[i] is how much is available from candidates[i:], for pruning selections which cannot cover the amount
+	remaining := make([]int64, len(candidates)+1)
+	for i := len(candidates) - 1; i >= 0; i-- {
+		remaining[i] = remaining[i+1] + available(candidates[i])
+	}
+	var best []int
+	bestOver := total - target + 1
+	var selected []int
+	// search tries including each candidate before excluding it, so the first of equally good selections found is the
+	// one with the oldest authorizations
+	var search func(i int, sum int64) bool
+	search = func(i int, sum int64) bool {
+		if sum >= target {
+			if over := sum - target; over < bestOver {
+				bestOver = over
+				best = append(best[:0], selected...)
+			}
+			// Adding more can only increase the remainder
+			return bestOver == 0
+		}
+		if i == len(candidates) || sum+remaining[i] < target {
+			return false
+		}
+		selected = append(selected, i)
+		if search(i+1, sum+available(candidates[i])) {
+			return true
+		}
+		selected = selected[:len(selected)-1]
+		return search(i+1, sum)
+	}
+	search(0, 0)
+	chosen := make([]stripe.Charge, len(best))
+	for i, index := range best {
+		chosen[i] = candidates[index]
+	}
+	return chosen
+}
@@ -0,0 +1,132 @@
+package handlers_test
+
+import (
+	"fmt"
+	"github.com/davidjwilkins/declarative-payments/payments/handlers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/stripe-go/v72"
+	"math/rand"
+	"testing"
+)
+
+func authorizations(amounts ...int64) []stripe.Charge {
+	auths := make([]stripe.Charge, len(amounts))
+	for i, amount := range amounts {
+		auths[i] = stripe.Charge{ID: fmt.Sprintf("ch_%d", i), Amount: amount, Paid: true, Created: int64(i)}
+	}
+	return auths
+}
+
+func ids(auths []stripe.Charge) []string {
+	ids := []string{}
+	for _, auth := range auths {
+		ids = append(ids, auth.ID)
+	}
+	return ids
+}
+
+// remainder is how much of the selected authorizations is left over after using amount, and has to be re-authorized
+func remainder(auths []stripe.Charge, amount uint) int64 {
+	var total int64
+	for _, auth := range auths {
+		total += auth.Amount - auth.AmountRefunded
+	}
+	if total < int64(amount) {
+		return 0
+	}
+	return total - int64(amount)
+}
+
+func TestAuthorizationSelector(t *testing.T) {
+	t.Run("Oldest first", func(t *testing.T) {
+		auths := authorizations(1000, 500, 300)
+		assert.Equal(t, []string{"ch_0", "ch_1"}, ids(handlers.OldestFirst.Select(auths, 1200)))
+		assert.Equal(t, []string{"ch_0", "ch_1", "ch_2"}, ids(handlers.OldestFirst.Select(auths, 5000)), "Everything is selected if it cannot cover the amount")
+	})
+	t.Run("Best fit prefers exact coverage", func(t *testing.T) {
+		auths := authorizations(1000, 500, 300, 200)
+		selector := handlers.BestFit(0)
+		assert.Equal(t, []string{"ch_1", "ch_2"}, ids(selector.Select(auths, 800)))
+		assert.Equal(t, []string{"ch_0", "ch_3"}, ids(selector.Select(auths, 1200)))
+		assert.Equal(t, []string{"ch_0"}, ids(selector.Select(auths, 1000)))
+	})
+	t.Run("Best fit minimizes the remainder", func(t *testing.T) {
+		auths := authorizations(1000, 700, 450)
+		selected := handlers.BestFit(0).Select(auths, 1100)
+		assert.Equal(t, []string{"ch_1", "ch_2"}, ids(selected))
+		assert.Equal(t, int64(50), remainder(selected, 1100))
+	})
+	t.Run("Best fit prefers the oldest authorizations", func(t *testing.T) {
+		auths := authorizations(500, 300, 500, 300)
+		assert.Equal(t, []string{"ch_0"}, ids(handlers.BestFit(0).Select(auths, 500)))
+		assert.Equal(t, []string{"ch_0", "ch_1"}, ids(handlers.BestFit(0).Select(auths, 800)))
+	})
+	t.Run("Best fit skips unusable authorizations", func(t *testing.T) {
+		auths := authorizations(1000, 500, 300)
+		auths[1].Paid = false
+		auths[2].AmountRefunded = 100
+		assert.Equal(t, []string{"ch_2"}, ids(handlers.BestFit(0).Select(auths, 200)))
+		assert.Equal(t, []string{"ch_0", "ch_2"}, ids(handlers.BestFit(0).Select(auths, 5000)))
+		assert.Empty(t, handlers.BestFit(0).Select(auths, 0))
+	})
+	t.Run("Best fit falls back to oldest first", func(t *testing.T) {
+		auths := authorizations(1000, 500, 300, 200)
+		assert.Equal(t, []string{"ch_0"}, ids(handlers.BestFit(3).Select(auths, 800)))
+	})
+	t.Run("Storage uses its selector", func(t *testing.T) {
+		storage := handlers.NewMockStripeStorage("test")
+		for _, auth := range authorizations(1000, 500, 300) {
+			storage.UpsertCharge(auth)
+		}
+		assert.Equal(t, []string{"ch_0"}, ids(storage.GetAuthorizationsFor(800)))
+		storage.Selector = handlers.BestFit(0)
+		assert.Equal(t, []string{"ch_1", "ch_2"}, ids(storage.GetAuthorizationsFor(800)))
+	})
+}
+
+// chargeSets are realistic sets of authorizations: a few holds of round amounts, and an amount to capture which is
+// often, but not always, the sum of some of them.
+func chargeSets(n int) ([][]stripe.Charge, []uint) {
+	r := rand.New(rand.NewSource(1))
+	sets := make([][]stripe.Charge, n)
+	amounts := make([]uint, n)
+	for i := range sets {
+		held := make([]int64, 2+r.Intn(7))
+		for j := range held {
+			held[j] = int64(500 * (1 + r.Intn(20)))
+		}
+		sets[i] = authorizations(held...)
+		var amount int64
+		for _, h := range held {
+			if r.Intn(2) == 0 {
+				amount += h
+			}
+		}
+		if amount == 0 || r.Intn(4) == 0 {
+			amount = int64(100 * (1 + r.Intn(100)))
+		}
+		amounts[i] = uint(amount)
+	}
+	return sets, amounts
+}
+
+func benchmarkSelector(b *testing.B, selector handlers.AuthorizationSelector) {
+	sets, amounts := chargeSets(1000)
+	reauthorizations := 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		j := i % len(sets)
+		if remainder(selector.Select(sets[j], amounts[j]), amounts[j]) > 0 {
+			reauthorizations++
+		}
+	}
+	b.ReportMetric(float64(reauthorizations)/float64(b.N), "reauths/op")
+}
+
+func BenchmarkOldestFirst(b *testing.B) {
+	benchmarkSelector(b, handlers.OldestFirst)
+}
+
+func BenchmarkBestFit(b *testing.B) {
+	benchmarkSelector(b, handlers.BestFit(0))
+}
@@ -1,8 +1,12 @@
 package handlers
 
 import (
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/errors"
 	"github.com/stripe/stripe-go/v72"
 	"github.com/stripe/stripe-go/v72/client"
+	"net"
+	"net/http"
 )
 
 type StripeStorage interface {
@@ -17,27 +21,86 @@ type stripeHandler struct {
 	bucket string
 	currency stripe.Currency
 	storage StripeStorage
+	annotations *annotations
+}
+
+// Annotate attaches metadata to the charges and refunds made for the command with idempotencyKey
+func (s stripeHandler) Annotate(idempotencyKey string, metadata map[string]string) {
+	s.annotations.annotate(idempotencyKey, metadata)
+}
+
+// Describe sets the templates for the description and statement descriptor of new charges
+func (s stripeHandler) Describe(descriptions Descriptions) error {
+	return s.annotations.describe(descriptions)
+}
+
+// params returns the params of an object made with idempotencyKey, with the metadata of the command it is made for
+func (s stripeHandler) params(idempotencyKey string) stripe.Params {
+	return stripe.Params{
+		IdempotencyKey: stripe.String(idempotencyKey),
+		Metadata: s.annotations.lookup(idempotencyKey, map[string]string{
+			"bucket": s.bucket,
+			"idempotencyKey": idempotencyKey,
+		}),
+	}
+}
+
+// retryableError is a Stripe error which may succeed if the call is made again.  It is errors.ErrRetryable, so that it
+// is retried and counts towards circuit breakers, and still unwraps to the Stripe error.
+type retryableError struct {
+	err error
+}
+
+func (e retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e retryableError) Unwrap() error {
+	return e.err
+}
+
+func (e retryableError) Is(target error) bool {
+	return target == errors.ErrRetryable
+}
+
+// retryable marks server errors, rate limits and failed connections as retryable, and returns any other error as it is
+func retryable(err error) error {
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) {
+		if stripeErr.HTTPStatusCode >= http.StatusInternalServerError ||
+			stripeErr.HTTPStatusCode == http.StatusTooManyRequests ||
+			stripeErr.Type == stripe.ErrorTypeAPI ||
+			stripeErr.Type == stripe.ErrorTypeAPIConnection ||
+			stripeErr.Type == stripe.ErrorTypeRateLimit ||
+			stripeErr.Code == stripe.ErrorCodeRateLimit {
+			return retryableError{err}
+		}
+		return err
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return retryableError{err}
+	}
+	return err
 }
 
 func (s stripeHandler) doCharge(authorization bool, idempotencyKey string, amount uint) error {
+	params := s.params(idempotencyKey)
+	description, statementDescriptor := s.annotations.descriptions(params.Metadata)
 	ch, err := s.Charges.New(&stripe.ChargeParams{
 		Amount: stripe.Int64(int64(amount)),
 		Capture: stripe.Bool(!authorization),
 		Source: &stripe.SourceParams{Token: stripe.String(s.cardID)},
 		Currency: stripe.String(string(s.currency)),
-		Params: stripe.Params{
-			IdempotencyKey: stripe.String(idempotencyKey),
-			Metadata: map[string]string{
-				"bucket": s.bucket,
-				"idempotencyKey": idempotencyKey,
-			},
-		},
+		Description: description,
+		StatementDescriptor: statementDescriptor,
+		Params: params,
 	})
 	if ch != nil && ch.ID != "" {
 		s.storage.UpsertCharge(*ch)
 	}
 	if err != nil {
-		return err
+		return retryable(err)
 	}
 	return nil
 }
@@ -61,9 +124,7 @@ func (s stripeHandler) doCapture(idempotencyKey string, amount uint) (uint, uint
 		amountLeft -= captureAmount
 		ch, err := s.Charges.Capture(auth.ID, &stripe.CaptureParams{
 			Amount: stripe.Int64(captureAmount),
-			Params: stripe.Params{
-				IdempotencyKey: stripe.String(idempotencyKey + ":" + auth.ID),
-			},
+			Params: s.params(idempotencyKey + ":" + auth.ID),
 		})
 		if ch != nil && ch.ID != "" {
 			s.storage.UpsertCharge(*ch)
@@ -75,7 +136,7 @@ func (s stripeHandler) doCapture(idempotencyKey string, amount uint) (uint, uint
 			}
 		}
 		if err != nil {
-			lastErr = err
+			lastErr = retryable(err)
 			// Refresh the charge, our data might be stale and this would be a good time to update
 			ch, err := s.Charges.Get(auth.ID, nil)
 			if err == nil && ch != nil && ch.ID == auth.ID {
@@ -129,17 +190,12 @@ func (s stripeHandler) doRelease(charges []stripe.Charge, idempotencyKey string,
 
 		}
 		amountLeft -= releaseAmount
+		params := s.params(idempotencyKey + ":" + auth.ID)
+		params.Expand = []*string{stripe.String("charge")}
 		refund, err := s.Refunds.New(&stripe.RefundParams{
 			Amount: stripe.Int64(releaseAmount),
 			Charge: stripe.String(auth.ID),
-			Params: stripe.Params{
-				Expand: []*string{stripe.String("charge")},
-				IdempotencyKey: stripe.String(idempotencyKey + ":" + auth.ID),
-				Metadata: map[string]string{
-					"bucket": s.bucket,
-					"idempotencyKey": idempotencyKey + ":" + auth.ID,
-				},
-			},
+			Params: params,
 		})
 		if refund != nil && refund.ID != "" {
 			s.storage.UpsertCharge(*refund.Charge)
@@ -148,7 +204,7 @@ func (s stripeHandler) doRelease(charges []stripe.Charge, idempotencyKey string,
 			totalReleased += uint(releaseAmount)
 		}
 		if err != nil {
-			lastErr = err
+			lastErr = retryable(err)
 		}
 	}
 	return totalReleased, lastErr
@@ -190,6 +246,12 @@ func (s stripeHandler) Refund(idempotencyKey string, amount uint) (uint, error)
 	return s.doRelease(charges, idempotencyKey, amount)
 }
 
+// Capabilities of the Charges API: capturing a charge releases the rest of it, and uncaptured charges are released by
+// refunding them in full, so anything left has to be authorized again.
+func (s stripeHandler) Capabilities() []consts.Capability {
+	return []consts.Capability{consts.CapabilityRefundUncaptured}
+}
+
 func NewStripeHandler(api *client.API, cardID, currency, bucket string, storage StripeStorage) *stripeHandler {
 	h := &stripeHandler{
 		api,
@@ -197,6 +259,7 @@ func NewStripeHandler(api *client.API, cardID, currency, bucket string, storage
 		bucket,
 		stripe.Currency(currency),
 		storage,
+		newAnnotations(),
 	}
 	return h
 }
@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/stripe/stripe-go/v72"
+)
+
+// ChargeLister is a StripeStorage which can list its captured charges, so that what Stripe holds can be told
+type ChargeLister interface {
+	ListCharges() []stripe.Charge
+}
+
+// StripeBalances returns what Stripe holds according to storage: the amount captured less refunds, and the amount
+// authorized which has not been captured or released.  Storage must be kept up to date with changes made outside the
+// handler, such as refunds from the dashboard or disputes, for these to reflect them.  It returns
+// errors.ErrChargesNotListed if storage is not a ChargeLister.
+func StripeBalances(storage StripeStorage) (amount int, authorized uint, err error) {
+	lister, ok := storage.(ChargeLister)
+	if !ok {
+		return 0, 0, errors.ErrChargesNotListed
+	}
+	for _, ch := range lister.ListCharges() {
+		captured := ch.AmountCaptured
+		if captured == 0 {
+			captured = ch.Amount
+		}
+		amount += int(captured - ch.AmountRefunded)
+	}
+	for _, auth := range storage.ListAuthorizations() {
+		left := auth.Amount - auth.AmountRefunded
+		if auth.Captured {
+			// A PaymentIntent which can be captured again keeps what it has not captured authorized
+			left = auth.Amount - auth.AmountCaptured
+		}
+		if left > 0 {
+			authorized += uint(left)
+		}
+	}
+	return amount, authorized, nil
+}
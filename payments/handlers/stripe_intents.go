@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"errors"
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/client"
+	"net/http"
+)
+
+// stripeIntentHandler authorizes with PaymentIntents rather than Charges.  On eligible cards, these can be incremented
+// and captured more than once, so changing an authorization does not cost a new one.  On other cards, it falls back to
+// the same re-authorizing behaviour as stripeHandler.
+type stripeIntentHandler struct {
+	stripeHandler
+}
+
+// NewStripeIntentHandler returns a handler which charges paymentMethodID, using PaymentIntents for authorizations
+func NewStripeIntentHandler(api *client.API, paymentMethodID, currency, bucket string, storage StripeStorage) *stripeIntentHandler {
+	return &stripeIntentHandler{*NewStripeHandler(api, paymentMethodID, currency, bucket, storage)}
+}
+
+// Capabilities of PaymentIntents.  Cards which are not eligible for incremental authorization or multicapture fall back
+// to authorizing again, so these hold for every card, just not as cheaply.  Authorizations are released by cancelling
+// their intents rather than refunding them, so releases are made after captures.
+func (s stripeIntentHandler) Capabilities() []consts.Capability {
+	return []consts.Capability{
+		consts.CapabilityIncrementalAuthorization,
+		consts.CapabilityMultiCapture,
+	}
+}
+
+// unsupported reports whether Stripe rejected a request, such as when the card is not eligible for it
+func unsupported(err error) bool {
+	var stripeErr *stripe.Error
+	return errors.As(err, &stripeErr) && stripeErr.Type == stripe.ErrorTypeInvalidRequest
+}
+
+// upsertIntent stores the charges of pi, recording its status so storage can tell which still have an authorization
+// to capture
+func (s stripeIntentHandler) upsertIntent(pi *stripe.PaymentIntent) {
+	if pi == nil || pi.Charges == nil {
+		return
+	}
+	for _, ch := range pi.Charges.Data {
+		charge := *ch
+		charge.PaymentIntent = &stripe.PaymentIntent{ID: pi.ID, Status: pi.Status}
+		s.storage.UpsertCharge(charge)
+	}
+}
+
+func (s stripeIntentHandler) Authorize(idempotencyKey string, amount uint) error {
+	params := &stripe.PaymentIntentParams{
+		Amount:        stripe.Int64(int64(amount)),
+		Currency:      stripe.String(string(s.currency)),
+		PaymentMethod: stripe.String(s.cardID),
+		CaptureMethod: stripe.String(string(stripe.PaymentIntentCaptureMethodManual)),
+		Confirm:       stripe.Bool(true),
+		Params:        s.params(idempotencyKey),
+	}
+	params.Description, params.StatementDescriptor = s.annotations.descriptions(params.Metadata)
+	params.AddExtra("payment_method_options[card][request_incremental_authorization_support]", "true")
+	params.AddExtra("payment_method_options[card][request_multicapture]", "if_available")
+	pi, err := s.PaymentIntents.New(params)
+	s.upsertIntent(pi)
+	return retryable(err)
+}
+
+// latestIntent returns the newest authorization made with a PaymentIntent which can still be captured
+func (s stripeIntentHandler) latestIntent() (stripe.Charge, bool) {
+	var latest stripe.Charge
+	found := false
+	for _, auth := range s.storage.ListAuthorizations() {
+		if auth.PaymentIntent != nil && auth.PaymentIntent.Status == stripe.PaymentIntentStatusRequiresCapture &&
+			(!found || auth.Created > latest.Created) {
+			latest = auth
+			found = true
+		}
+	}
+	return latest, found
+}
+
+// IncrementAuthorization increases the newest authorization by amount.  If there is none, or the card does not support
+// incremental authorization, it makes a new authorization instead.
+func (s stripeIntentHandler) IncrementAuthorization(idempotencyKey string, amount uint) error {
+	auth, ok := s.latestIntent()
+	if !ok {
+		return s.Authorize(idempotencyKey, amount)
+	}
+	params := &stripe.PaymentIntentParams{
+		Amount: stripe.Int64(auth.Amount + int64(amount)),
+		Params: s.params(idempotencyKey),
+	}
+	pi := &stripe.PaymentIntent{}
+	path := "/v1/payment_intents/" + auth.PaymentIntent.ID + "/increment_authorization"
+	err := s.PaymentIntents.B.Call(http.MethodPost, path, s.PaymentIntents.Key, params, pi)
+	if err == nil {
+		s.upsertIntent(pi)
+		return nil
+	}
+	if unsupported(err) {
+		return s.Authorize(idempotencyKey+":authorize", amount)
+	}
+	return retryable(err)
+}
+
+func (s stripeIntentHandler) capture(idempotencyKey string, auth stripe.Charge, amount int64, final bool) error {
+	params := &stripe.PaymentIntentCaptureParams{
+		AmountToCapture: stripe.Int64(amount),
+		Params:          s.params(idempotencyKey),
+	}
+	if !final {
+		params.AddExtra("final_capture", "false")
+	}
+	pi, err := s.PaymentIntents.Capture(auth.PaymentIntent.ID, params)
+	s.upsertIntent(pi)
+	return retryable(err)
+}
+
+// MultiCapture captures amount, leaving the remainder of the last authorization it captures from authorized.  If the
+// card does not support multicapture, the remainder is re-authorized as Capture does.
+func (s stripeIntentHandler) MultiCapture(idempotencyKey string, amount uint) (uint, error) {
+	auths := s.storage.GetAuthorizationsFor(amount)
+	left := int64(amount)
+	captured := uint(0)
+	for _, auth := range auths {
+		if left <= 0 {
+			break
+		}
+		key := idempotencyKey + ":" + auth.ID
+		if auth.PaymentIntent == nil {
+			// Authorized with the Charges API, so capturing releases the rest, which is authorized again as an intent
+			more, released, err := s.doCapture(key, uint(left))
+			if released > 0 {
+				if reauthErr := s.Authorize(key+":reauthorize", released); err == nil {
+					err = reauthErr
+				}
+			}
+			return captured + more, err
+		}
+		capture, remainder := available(auth), int64(0)
+		if capture > left {
+			capture, remainder = left, capture-left
+		}
+		err := s.capture(key, auth, capture, remainder == 0)
+		if err != nil && remainder > 0 && unsupported(err) {
+			// Capturing releases the remainder, so it has to be authorized again
+			if err = s.capture(key+":final", auth, capture, true); err == nil {
+				err = s.Authorize(key+":reauthorize", uint(remainder))
+				captured += uint(capture)
+				return captured, err
+			}
+		}
+		if err != nil {
+			return captured, err
+		}
+		captured += uint(capture)
+		left -= capture
+	}
+	return captured, nil
+}
+
+// Capture captures amount.  Whatever is left of the authorizations it captures from stays authorized, as it does for
+// MultiCapture.
+func (s stripeIntentHandler) Capture(idempotencyKey string, amount uint) (uint, error) {
+	return s.MultiCapture(idempotencyKey, amount)
+}
+
+// cancel releases everything left of auth.  An intent is cancelled, which releases what it has not captured, and a
+// charge made with the Charges API is refunded in full.
+func (s stripeIntentHandler) cancel(idempotencyKey string, auth stripe.Charge) error {
+	if auth.PaymentIntent == nil {
+		params := s.params(idempotencyKey)
+		params.Expand = []*string{stripe.String("charge")}
+		refund, err := s.Refunds.New(&stripe.RefundParams{
+			Charge: stripe.String(auth.ID),
+			Params: params,
+		})
+		if refund != nil && refund.Charge != nil && refund.Charge.ID != "" {
+			s.storage.UpsertCharge(*refund.Charge)
+		}
+		return retryable(err)
+	}
+	pi, err := s.PaymentIntents.Cancel(auth.PaymentIntent.ID, &stripe.PaymentIntentCancelParams{
+		Params: s.params(idempotencyKey),
+	})
+	s.upsertIntent(pi)
+	return retryable(err)
+}
+
+// Release releases amount of what is authorized.  Holds cannot be released in part, so when less than the rest of an
+// authorization is released, what is kept is authorized again as a new intent before the old one is cancelled.
+func (s stripeIntentHandler) Release(idempotencyKey string, amount uint) (uint, error) {
+	left := int64(amount)
+	released := uint(0)
+	for _, auth := range s.storage.GetAuthorizationsFor(amount) {
+		if left <= 0 {
+			break
+		}
+		key := idempotencyKey + ":" + auth.ID
+		release := available(auth)
+		if release > left {
+			// It's better to have too much authorized than too little, so bail if the rest cannot be kept
+			if err := s.Authorize(key+":reauthorize", uint(release-left)); err != nil {
+				return released, err
+			}
+			release = left
+		}
+		if err := s.cancel(key, auth); err != nil {
+			return released, err
+		}
+		released += uint(release)
+		left -= release
+	}
+	return released, nil
+}
+
+// CaptureRelease captures capture, leaving the rest authorized, and then releases release
+func (s stripeIntentHandler) CaptureRelease(captureKey string, capture uint, releaseKey string, release uint) (captured uint, captureErr error, released uint, releaseErr error) {
+	captured, captureErr = s.MultiCapture(captureKey, capture)
+	released, releaseErr = s.Release(releaseKey, release)
+	return captured, captureErr, released, releaseErr
+}
+
+// refundable returns how much of a captured charge can still be refunded.  While an intent can still be captured, the
+// rest of its authorization has not been released, so only what it captured can be refunded.
+func refundable(ch stripe.Charge) int64 {
+	left := ch.Amount - ch.AmountRefunded
+	if ch.PaymentIntent != nil && ch.PaymentIntent.Status == stripe.PaymentIntentStatusRequiresCapture {
+		left = ch.AmountCaptured - ch.AmountRefunded
+	}
+	if left < 0 {
+		return 0
+	}
+	return left
+}
+
+// Refund refunds amount of what has been captured.  It never releases authorizations, even of intents which have only
+// been captured in part.
+func (s stripeIntentHandler) Refund(idempotencyKey string, amount uint) (uint, error) {
+	left := int64(amount)
+	refunded := uint(0)
+	var lastErr error
+	for _, ch := range s.storage.GetChargesFor(amount) {
+		if left <= 0 {
+			break
+		}
+		refund := refundable(ch)
+		if refund > left {
+			refund = left
+		}
+		if refund == 0 {
+			continue
+		}
+		params := s.params(idempotencyKey + ":" + ch.ID)
+		params.Expand = []*string{stripe.String("charge")}
+		r, err := s.Refunds.New(&stripe.RefundParams{
+			Amount: stripe.Int64(refund),
+			Charge: stripe.String(ch.ID),
+			Params: params,
+		})
+		if r != nil && r.Charge != nil && r.Charge.ID != "" {
+			charge := *r.Charge
+			// Keep what is known of the intent, so storage can still tell whether it can be captured
+			charge.PaymentIntent = ch.PaymentIntent
+			s.storage.UpsertCharge(charge)
+		}
+		if err != nil {
+			lastErr = retryable(err)
+			continue
+		}
+		refunded += uint(refund)
+		left -= refund
+	}
+	return refunded, lastErr
+}
@@ -0,0 +1,326 @@
+package handlers_test
+
+import (
+	"bytes"
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments/handlers"
+	"github.com/davidjwilkins/declarative-payments/payments/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/client"
+	"github.com/stripe/stripe-go/v72/form"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type call struct {
+	path   string
+	params stripe.ParamsContainer
+}
+
+// fakeBackend answers PaymentIntent requests without calling Stripe
+type fakeBackend struct {
+	calls   []call
+	respond func(path string, params stripe.ParamsContainer) (*stripe.PaymentIntent, error)
+	refunds []*stripe.Refund
+}
+
+func (f *fakeBackend) Call(method, path, key string, params stripe.ParamsContainer, v stripe.LastResponseSetter) error {
+	f.calls = append(f.calls, call{path, params})
+	if charge, ok := v.(*stripe.Charge); ok {
+		// Charges captured with the Charges API are captured in full
+		*charge = stripe.Charge{ID: strings.Split(path, "/")[3], Captured: true, Paid: true, Status: "succeeded"}
+		return nil
+	}
+	if refund, ok := v.(*stripe.Refund); ok {
+		// Refunds succeed, taking the next prepared response
+		*refund = *f.refunds[0]
+		f.refunds = f.refunds[1:]
+		return nil
+	}
+	pi, err := f.respond(path, params)
+	if err != nil {
+		return err
+	}
+	*v.(*stripe.PaymentIntent) = *pi
+	return nil
+}
+
+func (f *fakeBackend) CallStreaming(method, path, key string, params stripe.ParamsContainer, v stripe.StreamingLastResponseSetter) error {
+	panic("not implemented")
+}
+
+func (f *fakeBackend) CallRaw(method, path, key string, body *form.Values, params *stripe.Params, v stripe.LastResponseSetter) error {
+	panic("not implemented")
+}
+
+func (f *fakeBackend) CallMultipart(method, path, key, boundary string, body *bytes.Buffer, params *stripe.Params, v stripe.LastResponseSetter) error {
+	panic("not implemented")
+}
+
+func (f *fakeBackend) SetMaxNetworkRetries(maxNetworkRetries int64) {}
+
+func intent(id string, status stripe.PaymentIntentStatus, charge stripe.Charge) *stripe.PaymentIntent {
+	return &stripe.PaymentIntent{ID: id, Status: status, Charges: &stripe.ChargeList{Data: []*stripe.Charge{&charge}}}
+}
+
+func extra(params stripe.ParamsContainer, key string) string {
+	p := params.GetParams()
+	if p.Extra == nil {
+		return ""
+	}
+	return p.Extra.Get(key)
+}
+
+func TestStripeIntentHandler(t *testing.T) {
+	declined := &stripe.Error{Type: stripe.ErrorTypeInvalidRequest, Msg: "not supported"}
+	setup := func(respond func(path string, params stripe.ParamsContainer) (*stripe.PaymentIntent, error)) (*fakeBackend, handlers.StripeStorage) {
+		backend := &fakeBackend{respond: respond}
+		storage := handlers.NewMockStripeStorage("test")
+		storage.UpsertCharge(stripe.Charge{ID: "ch_1", Amount: 1000, Paid: true, Created: 1, PaymentIntent: &stripe.PaymentIntent{ID: "pi_1", Status: stripe.PaymentIntentStatusRequiresCapture}})
+		return backend, storage
+	}
+	handler := func(backend *fakeBackend, storage handlers.StripeStorage) interface {
+		Authorize(idempotencyKey string, amount uint) error
+		IncrementAuthorization(idempotencyKey string, amount uint) error
+		MultiCapture(idempotencyKey string, amount uint) (uint, error)
+		Release(idempotencyKey string, amount uint) (uint, error)
+		CaptureRelease(captureKey string, capture uint, releaseKey string, release uint) (uint, error, uint, error)
+		Refund(idempotencyKey string, amount uint) (uint, error)
+	} {
+		return handlers.NewStripeIntentHandler(client.New("sk_test", &stripe.Backends{API: backend}), "pm_card_visa", "usd", "test", storage)
+	}
+	t.Run("Authorizes with a PaymentIntent", func(t *testing.T) {
+		backend, storage := setup(func(path string, params stripe.ParamsContainer) (*stripe.PaymentIntent, error) {
+			return intent("pi_2", stripe.PaymentIntentStatusRequiresCapture, stripe.Charge{ID: "ch_2", Amount: 500, Paid: true, Created: 2}), nil
+		})
+		assert.NoError(t, handler(backend, storage).Authorize("key", 500))
+		assert.Equal(t, "/v1/payment_intents", backend.calls[0].path)
+		params := backend.calls[0].params.(*stripe.PaymentIntentParams)
+		assert.Equal(t, "manual", *params.CaptureMethod)
+		assert.Equal(t, "true", extra(params, "payment_method_options[card][request_incremental_authorization_support]"))
+		assert.Equal(t, "if_available", extra(params, "payment_method_options[card][request_multicapture]"))
+		assert.Equal(t, 2, len(storage.ListAuthorizations()))
+	})
+	t.Run("Increments the latest authorization", func(t *testing.T) {
+		backend, storage := setup(func(path string, params stripe.ParamsContainer) (*stripe.PaymentIntent, error) {
+			return intent("pi_1", stripe.PaymentIntentStatusRequiresCapture, stripe.Charge{ID: "ch_1", Amount: 1500, Paid: true, Created: 1}), nil
+		})
+		assert.NoError(t, handler(backend, storage).IncrementAuthorization("key", 500))
+		assert.Equal(t, 1, len(backend.calls))
+		assert.Equal(t, "/v1/payment_intents/pi_1/increment_authorization", backend.calls[0].path)
+		assert.Equal(t, int64(1500), *backend.calls[0].params.(*stripe.PaymentIntentParams).Amount, "Amount is the new total")
+		auths := storage.ListAuthorizations()
+		assert.Equal(t, 1, len(auths), "No new authorization is made")
+		assert.Equal(t, int64(1500), auths[0].Amount)
+	})
+	t.Run("Authorizes again when the card cannot be incremented", func(t *testing.T) {
+		backend, storage := setup(func(path string, params stripe.ParamsContainer) (*stripe.PaymentIntent, error) {
+			if path != "/v1/payment_intents" {
+				return nil, declined
+			}
+			return intent("pi_2", stripe.PaymentIntentStatusRequiresCapture, stripe.Charge{ID: "ch_2", Amount: 500, Paid: true, Created: 2}), nil
+		})
+		assert.NoError(t, handler(backend, storage).IncrementAuthorization("key", 500))
+		assert.Equal(t, 2, len(backend.calls))
+		assert.Equal(t, "key:authorize", *backend.calls[1].params.GetParams().IdempotencyKey)
+		assert.Equal(t, 2, len(storage.ListAuthorizations()))
+	})
+	t.Run("Captures part of an authorization", func(t *testing.T) {
+		backend, storage := setup(func(path string, params stripe.ParamsContainer) (*stripe.PaymentIntent, error) {
+			return intent("pi_1", stripe.PaymentIntentStatusRequiresCapture, stripe.Charge{ID: "ch_1", Amount: 1000, AmountCaptured: 600, Captured: true, Paid: true, Created: 1}), nil
+		})
+		captured, err := handler(backend, storage).MultiCapture("key", 600)
+		assert.NoError(t, err)
+		assert.Equal(t, uint(600), captured)
+		assert.Equal(t, 1, len(backend.calls))
+		assert.Equal(t, "/v1/payment_intents/pi_1/capture", backend.calls[0].path)
+		params := backend.calls[0].params.(*stripe.PaymentIntentCaptureParams)
+		assert.Equal(t, int64(600), *params.AmountToCapture)
+		assert.Equal(t, "false", extra(params, "final_capture"))
+		auths := storage.ListAuthorizations()
+		assert.Equal(t, 1, len(auths), "The remainder is still authorized")
+		assert.Equal(t, int64(400), auths[0].Amount-auths[0].AmountCaptured)
+	})
+	t.Run("Reauthorizes the remainder when the card cannot be captured more than once", func(t *testing.T) {
+		backend, storage := setup(func(path string, params stripe.ParamsContainer) (*stripe.PaymentIntent, error) {
+			switch {
+			case path == "/v1/payment_intents":
+				return intent("pi_2", stripe.PaymentIntentStatusRequiresCapture, stripe.Charge{ID: "ch_2", Amount: 400, Paid: true, Created: 2}), nil
+			case extra(params, "final_capture") == "false":
+				return nil, declined
+			}
+			return intent("pi_1", stripe.PaymentIntentStatusSucceeded, stripe.Charge{ID: "ch_1", Amount: 1000, AmountCaptured: 600, Captured: true, Paid: true, Created: 1}), nil
+		})
+		captured, err := handler(backend, storage).MultiCapture("key", 600)
+		assert.NoError(t, err)
+		assert.Equal(t, uint(600), captured)
+		assert.Equal(t, 3, len(backend.calls))
+		assert.Equal(t, "", extra(backend.calls[1].params, "final_capture"))
+		assert.Equal(t, int64(400), *backend.calls[2].params.(*stripe.PaymentIntentParams).Amount)
+		auths := storage.ListAuthorizations()
+		assert.Equal(t, 1, len(auths))
+		assert.Equal(t, "ch_2", auths[0].ID)
+	})
+	cancelled := stripe.Charge{ID: "ch_1", Amount: 1000, AmountRefunded: 1000, Refunded: true, Paid: true, Created: 1}
+	t.Run("Releases an authorization by cancelling its intent", func(t *testing.T) {
+		backend, storage := setup(func(path string, params stripe.ParamsContainer) (*stripe.PaymentIntent, error) {
+			return intent("pi_1", stripe.PaymentIntentStatusCanceled, cancelled), nil
+		})
+		released, err := handler(backend, storage).Release("key", 1000)
+		assert.NoError(t, err)
+		assert.Equal(t, uint(1000), released)
+		assert.Equal(t, 1, len(backend.calls))
+		assert.Equal(t, "/v1/payment_intents/pi_1/cancel", backend.calls[0].path)
+		assert.Equal(t, 0, len(storage.ListAuthorizations()))
+	})
+	t.Run("Releasing part of an authorization keeps the rest on a new intent", func(t *testing.T) {
+		backend, storage := setup(func(path string, params stripe.ParamsContainer) (*stripe.PaymentIntent, error) {
+			if path == "/v1/payment_intents" {
+				return intent("pi_2", stripe.PaymentIntentStatusRequiresCapture, stripe.Charge{ID: "ch_2", Amount: 600, Paid: true, Created: 2}), nil
+			}
+			return intent("pi_1", stripe.PaymentIntentStatusCanceled, cancelled), nil
+		})
+		released, err := handler(backend, storage).Release("key", 400)
+		assert.NoError(t, err)
+		assert.Equal(t, uint(400), released)
+		assert.Equal(t, 2, len(backend.calls))
+		assert.Equal(t, "/v1/payment_intents", backend.calls[0].path, "The rest is authorized before the hold is let go")
+		assert.Equal(t, int64(600), *backend.calls[0].params.(*stripe.PaymentIntentParams).Amount)
+		assert.Equal(t, "/v1/payment_intents/pi_1/cancel", backend.calls[1].path)
+		auths := storage.ListAuthorizations()
+		assert.Equal(t, 1, len(auths))
+		assert.Equal(t, "ch_2", auths[0].ID)
+	})
+	t.Run("Releasing what is left after a partial capture cancels the intent", func(t *testing.T) {
+		backend, storage := setup(func(path string, params stripe.ParamsContainer) (*stripe.PaymentIntent, error) {
+			return intent("pi_1", stripe.PaymentIntentStatusSucceeded, stripe.Charge{ID: "ch_1", Amount: 1000, AmountCaptured: 600, AmountRefunded: 400, Captured: true, Paid: true, Created: 1}), nil
+		})
+		storage.UpsertCharge(stripe.Charge{ID: "ch_1", Amount: 1000, AmountCaptured: 600, Captured: true, Paid: true, Created: 1, PaymentIntent: &stripe.PaymentIntent{ID: "pi_1", Status: stripe.PaymentIntentStatusRequiresCapture}})
+		released, err := handler(backend, storage).Release("key", 400)
+		assert.NoError(t, err)
+		assert.Equal(t, uint(400), released, "Only what was not captured is released")
+		assert.Equal(t, 1, len(backend.calls), "Nothing is authorized again")
+		assert.Equal(t, "/v1/payment_intents/pi_1/cancel", backend.calls[0].path)
+		assert.Equal(t, 0, len(storage.ListAuthorizations()))
+	})
+	t.Run("Captures and releases an authorization", func(t *testing.T) {
+		backend, storage := setup(func(path string, params stripe.ParamsContainer) (*stripe.PaymentIntent, error) {
+			if path == "/v1/payment_intents/pi_1/capture" {
+				return intent("pi_1", stripe.PaymentIntentStatusRequiresCapture, stripe.Charge{ID: "ch_1", Amount: 1000, AmountCaptured: 600, Captured: true, Paid: true, Created: 1}), nil
+			}
+			return intent("pi_1", stripe.PaymentIntentStatusSucceeded, stripe.Charge{ID: "ch_1", Amount: 1000, AmountCaptured: 600, AmountRefunded: 400, Captured: true, Paid: true, Created: 1}), nil
+		})
+		captured, captureErr, released, releaseErr := handler(backend, storage).CaptureRelease("capture", 600, "release", 400)
+		assert.NoError(t, captureErr)
+		assert.NoError(t, releaseErr)
+		assert.Equal(t, uint(600), captured)
+		assert.Equal(t, uint(400), released)
+		assert.Equal(t, 2, len(backend.calls), "Nothing is authorized again")
+		assert.Equal(t, "/v1/payment_intents/pi_1/capture", backend.calls[0].path)
+		assert.Equal(t, "/v1/payment_intents/pi_1/cancel", backend.calls[1].path)
+		assert.Equal(t, 0, len(storage.ListAuthorizations()))
+		assert.Equal(t, 1, len(storage.(handlers.ChargeLister).ListCharges()))
+	})
+	t.Run("Refunds only what has been captured", func(t *testing.T) {
+		backend, storage := setup(nil)
+		storage.UpsertCharge(stripe.Charge{ID: "ch_1", Amount: 1000, AmountCaptured: 600, Captured: true, Paid: true, Created: 1, PaymentIntent: &stripe.PaymentIntent{ID: "pi_1", Status: stripe.PaymentIntentStatusRequiresCapture}})
+		backend.refunds = []*stripe.Refund{{ID: "re_1", Status: "succeeded", Charge: &stripe.Charge{ID: "ch_1", Amount: 1000, AmountCaptured: 600, AmountRefunded: 600, Captured: true, Paid: true, Created: 1}}}
+		refunded, err := handler(backend, storage).Refund("key", 1000)
+		assert.NoError(t, err)
+		assert.Equal(t, uint(600), refunded)
+		assert.Equal(t, 1, len(backend.calls))
+		assert.Equal(t, "/v1/refunds", backend.calls[0].path)
+		params := backend.calls[0].params.(*stripe.RefundParams)
+		assert.Equal(t, int64(600), *params.Amount)
+		assert.Equal(t, "ch_1", *params.Charge)
+		assert.Equal(t, "key:ch_1", params.Metadata["idempotencyKey"])
+		auths := storage.ListAuthorizations()
+		assert.Equal(t, 1, len(auths), "The uncaptured rest is still authorized")
+		assert.Equal(t, int64(400), auths[0].Amount-auths[0].AmountCaptured)
+
+		backend.respond = func(path string, params stripe.ParamsContainer) (*stripe.PaymentIntent, error) {
+			return intent("pi_1", stripe.PaymentIntentStatusSucceeded, stripe.Charge{ID: "ch_1", Amount: 1000, AmountCaptured: 600, AmountRefunded: 1000, Captured: true, Paid: true, Created: 1}), nil
+		}
+		released, err := handler(backend, storage).Release("release", 400)
+		assert.NoError(t, err)
+		assert.Equal(t, uint(400), released, "Refunds do not count against what is left to release")
+	})
+	t.Run("Authorizations carry the command's metadata and descriptions", func(t *testing.T) {
+		backend, storage := setup(func(path string, params stripe.ParamsContainer) (*stripe.PaymentIntent, error) {
+			return intent("pi_2", stripe.PaymentIntentStatusRequiresCapture, stripe.Charge{ID: "ch_2", Amount: 500, Paid: true, Created: 2}), nil
+		})
+		h := handlers.NewStripeIntentHandler(client.New("sk_test", &stripe.Backends{API: backend}), "pm_card_visa", "usd", "test", storage)
+		assert.NoError(t, h.Describe(handlers.Descriptions{
+			Description:         "Order {{.order}} for {{.user_id}}",
+			StatementDescriptor: "EXAMPLE {{.order}} {{.missing}}",
+		}))
+		h.Annotate("key", map[string]string{"order": "A-100-LONG-REFERENCE", "user_id": "u1"})
+		assert.NoError(t, h.Authorize("key:reauthorize", 500), "Keys derived from the command's are annotated too")
+		params := backend.calls[0].params.(*stripe.PaymentIntentParams)
+		assert.Equal(t, "A-100-LONG-REFERENCE", params.Metadata["order"])
+		assert.Equal(t, "test", params.Metadata["bucket"])
+		assert.Equal(t, "key:reauthorize", params.Metadata["idempotencyKey"])
+		assert.Equal(t, "Order A-100-LONG-REFERENCE for u1", *params.Description)
+		assert.Equal(t, "EXAMPLE A-100-LONG-REF", *params.StatementDescriptor, "Statement descriptors are cut short")
+
+		assert.NoError(t, h.IncrementAuthorization("key", 100))
+		assert.Equal(t, "/v1/payment_intents/pi_2/increment_authorization", backend.calls[1].path)
+		assert.Equal(t, "A-100-LONG-REFERENCE", backend.calls[1].params.GetParams().Metadata["order"], "Increments carry it")
+		_, err := h.MultiCapture("key", 100)
+		assert.NoError(t, err)
+		assert.Equal(t, "/v1/payment_intents/pi_1/capture", backend.calls[2].path)
+		assert.Equal(t, "A-100-LONG-REFERENCE", backend.calls[2].params.GetParams().Metadata["order"], "Captures carry it")
+
+		storage.UpsertCharge(stripe.Charge{ID: "ch_3", Amount: 500, Paid: true, Created: 0})
+		_, err = h.MultiCapture("key", 500)
+		assert.NoError(t, err)
+		assert.Equal(t, "/v1/charges/ch_3/capture", backend.calls[3].path)
+		assert.Equal(t, "A-100-LONG-REFERENCE", backend.calls[3].params.GetParams().Metadata["order"], "Charges API captures carry it")
+		backend.calls = nil
+
+		h.Annotate("key", nil)
+		assert.NoError(t, h.Authorize("key", 500))
+		params = backend.calls[0].params.(*stripe.PaymentIntentParams)
+		assert.Equal(t, "", params.Metadata["order"], "Metadata is forgotten once the command has run")
+		assert.Equal(t, "Order  for", *params.Description)
+		assert.Error(t, h.Describe(handlers.Descriptions{Description: "{{"}))
+	})
+	t.Run("Server errors, rate limits and failed connections are retryable", func(t *testing.T) {
+		failures := []error{
+			&stripe.Error{Type: stripe.ErrorTypeAPI, HTTPStatusCode: 500, Msg: "Internal Server Error"},
+			&stripe.Error{Type: stripe.ErrorTypeRateLimit, Code: stripe.ErrorCodeRateLimit, HTTPStatusCode: 429},
+			&url.Error{Op: "Post", URL: "https://api.stripe.com/v1/payment_intents", Err: io.ErrUnexpectedEOF},
+		}
+		for _, failure := range failures {
+			backend, storage := setup(func(path string, params stripe.ParamsContainer) (*stripe.PaymentIntent, error) {
+				return nil, failure
+			})
+			err := handler(backend, storage).Authorize("key", 500)
+			assert.True(t, errors.Is(err, errors.ErrRetryable), failure.Error())
+			assert.True(t, errors.Is(err, failure), "The Stripe error is kept")
+		}
+		backend, storage := setup(func(path string, params stripe.ParamsContainer) (*stripe.PaymentIntent, error) {
+			return nil, declined
+		})
+		err := handler(backend, storage).Authorize("key", 500)
+		assert.False(t, errors.Is(err, errors.ErrRetryable), "Rejected requests are not retryable")
+	})
+	t.Run("Server errors open circuit breakers", func(t *testing.T) {
+		backend, storage := setup(func(path string, params stripe.ParamsContainer) (*stripe.PaymentIntent, error) {
+			return nil, &stripe.Error{Type: stripe.ErrorTypeAPI, HTTPStatusCode: 503, Msg: "Service Unavailable"}
+		})
+		breaker := middleware.NewCircuitBreaker(2, time.Minute, clock.System)
+		h := handlers.NewStripeIntentHandler(client.New("sk_test", &stripe.Backends{API: backend}), "pm_card_visa", "usd", "test", storage)
+		u := middleware.User(h, breaker.Middleware)
+		assert.Error(t, u.Authorize("a", 500))
+		assert.Error(t, u.Authorize("b", 500))
+		assert.True(t, breaker.Open())
+		assert.True(t, errors.Is(u.Authorize("c", 500), errors.ErrCircuitOpen))
+		assert.Equal(t, 2, len(backend.calls), "Calls are refused while open")
+	})
+}
@@ -0,0 +1,222 @@
+package installment
+
+import (
+	"fmt"
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments"
+	"github.com/davidjwilkins/declarative-payments/payments/resolver"
+	"github.com/davidjwilkins/declarative-payments/payments/scheduler"
+	"github.com/google/uuid"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Installment is a part of the total which is charged on a fixed date
+type Installment struct {
+	Date   time.Time
+	Amount uint
+	Status consts.InstallmentStatus
+	// State is the desired state which completed the installment
+	State resolver.DesiredState
+}
+
+// Plan authorizes a deposit, charges each installment on its date, and releases what is left of the deposit with the
+// last one.  It is a payments.CommandObserver, and tracks which installments succeeded from the commands it observes.
+type Plan struct {
+	ExternalID uuid.UUID
+	UserID     uuid.UUID
+	PartnerID  uuid.UUID
+	Bucket     string
+	// Start is when the deposit is authorized
+	Start   time.Time
+	Deposit uint
+	// PartnerShare is the partner's share of what the user pays, in basis points
+	PartnerShare uint
+	lock         sync.Mutex
+	installments []Installment
+}
+
+func New(externalID, userID, partnerID uuid.UUID, bucket string, start time.Time, deposit, partnerShare uint, installments ...Installment) (*Plan, error) {
+	if len(installments) == 0 || partnerShare > 10000 {
+		return nil, errors.ErrInvalidInstallmentPlan
+	}
+	p := &Plan{
+		ExternalID:   externalID,
+		UserID:       userID,
+		PartnerID:    partnerID,
+		Bucket:       bucket,
+		Start:        start,
+		Deposit:      deposit,
+		PartnerShare: partnerShare,
+	}
+	for _, i := range installments {
+		if i.Amount == 0 || i.Date.Before(start) {
+			return nil, errors.ErrInvalidInstallmentPlan
+		}
+		p.installments = append(p.installments, Installment{Date: i.Date, Amount: i.Amount, Status: consts.InstallmentStatusPending})
+	}
+	return p, nil
+}
+
+// Installments returns the installments in the order they were given
+func (p *Plan) Installments() []Installment {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]Installment(nil), p.installments...)
+}
+
+func (p *Plan) state(reason, key string, date time.Time, amount int, authorized uint) resolver.DesiredState {
+	partner := int(math.Round(float64(amount) * float64(p.PartnerShare) / 10000))
+	key = fmt.Sprintf("installment:%s:%d:%d:%d:%d", key, date.UnixNano(), amount, authorized, partner)
+	return resolver.DesiredState{
+		ID:               uuid.NewSHA1(p.ExternalID, []byte(key)),
+		ExternalID:       p.ExternalID,
+		UserID:           p.UserID,
+		PartnerID:        p.PartnerID,
+		Date:             date,
+		Bucket:           p.Bucket,
+		Amount:           amount,
+		AuthorizedAmount: authorized,
+		PartnerAmount:    partner,
+		Source:           "installment",
+		Reason:           reason,
+	}
+}
+
+// states returns the deposit's desired state, and the desired state of each installment which is not failed, keyed by
+// its index.  Completed installments keep the state they completed with, so they are never regenerated.
+func (p *Plan) states() (resolver.DesiredState, map[int]resolver.DesiredState) {
+	order := make([]int, len(p.installments))
+	failed := false
+	for i := range order {
+		order[i] = i
+		failed = failed || p.installments[i].Status == consts.InstallmentStatusFailed
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return p.installments[order[a]].Date.Before(p.installments[order[b]].Date)
+	})
+	states := make(map[int]resolver.DesiredState, len(order))
+	amount, released := 0, false
+	for n, i := range order {
+		installment := p.installments[i]
+		switch installment.Status {
+		case consts.InstallmentStatusComplete:
+			amount, released = installment.State.Amount, installment.State.AuthorizedAmount == 0
+			states[i] = installment.State
+		case consts.InstallmentStatusPending:
+			amount += int(installment.Amount)
+			authorized := p.Deposit
+			// The deposit is only released with the last installment, and not while a failed one is outstanding
+			if released || (n == len(order)-1 && !failed) {
+				authorized = 0
+			}
+			states[i] = p.state("installment", fmt.Sprint(i), installment.Date, amount, authorized)
+		}
+	}
+	return p.state("deposit", "deposit", p.Start, 0, p.Deposit), states
+}
+
+// States returns the desired states of the plan in date order, starting with the deposit.  Failed installments are left
+// out until they are rescheduled, so that later installments do not collect them.
+func (p *Plan) States() []resolver.DesiredState {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	deposit, byIndex := p.states()
+	states := []resolver.DesiredState{deposit}
+	for _, d := range byIndex {
+		states = append(states, d)
+	}
+	sort.SliceStable(states, func(a, b int) bool {
+		return states[a].Date.Before(states[b].Date)
+	})
+	return states
+}
+
+// Reschedule moves a failed installment to a new date, which cannot be before a completed installment.  Completed
+// installments are unaffected.
+func (p *Plan) Reschedule(index int, date time.Time) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if index < 0 || index >= len(p.installments) {
+		return errors.ErrInstallmentNotFound
+	}
+	if p.installments[index].Status != consts.InstallmentStatusFailed {
+		return errors.ErrInstallmentNotFailed
+	}
+	for _, i := range p.installments {
+		if i.Status == consts.InstallmentStatusComplete && date.Before(i.Date) {
+			return errors.ErrLaterStateApplied
+		}
+	}
+	p.installments[index].Date = date
+	p.installments[index].Status = consts.InstallmentStatusPending
+	return nil
+}
+
+// Observe marks an installment complete once every command for its desired state has completed, or failed if any
+// of them failed or was rejected.  Commands which errored are left pending, since they will be retried.
+func (p *Plan) Observe(state payments.ActualState, cmds []resolver.PaymentCommand) {
+	if state.ExternalID != p.ExternalID {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	_, states := p.states()
+	for i, d := range states {
+		if p.installments[i].Status != consts.InstallmentStatusPending {
+			continue
+		}
+		complete, failed, found := true, false, false
+		for _, cmd := range cmds {
+			if cmd.DesiredStateID != d.ID {
+				continue
+			}
+			found = true
+			complete = complete && cmd.Status == consts.PaymentCommandStatusComplete
+			failed = failed || cmd.Status == consts.PaymentCommandStatusFailed ||
+				cmd.Status == consts.PaymentCommandStatusRejected
+		}
+		switch {
+		case !found:
+		case failed:
+			p.installments[i].Status = consts.InstallmentStatusFailed
+		case complete:
+			p.installments[i].Status = consts.InstallmentStatusComplete
+			p.installments[i].State = d
+		}
+	}
+}
+
+// Sync schedules the plan's desired states which are not already scheduled, and cancels any pending ones which no
+// longer apply because an installment failed or was rescheduled.
+func (p *Plan) Sync(sch *scheduler.Scheduler) error {
+	states := p.States()
+	wanted := make(map[uuid.UUID]struct{}, len(states))
+	for _, d := range states {
+		wanted[d.ID] = struct{}{}
+	}
+	pending, err := sch.Pending(p.ExternalID)
+	if err != nil {
+		return err
+	}
+	for _, e := range pending {
+		if _, ok := wanted[e.State.ID]; !ok {
+			if err := sch.Cancel(e.State.ID); err != nil {
+				return err
+			}
+		}
+	}
+	for _, d := range states {
+		_, err := sch.Get(d.ID)
+		if errors.Is(err, errors.ErrScheduledStateNotFound) {
+			err = sch.Schedule(d)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package installment_test
+
+import (
+	"context"
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments"
+	"github.com/davidjwilkins/declarative-payments/payments/installment"
+	"github.com/davidjwilkins/declarative-payments/payments/resolver"
+	"github.com/davidjwilkins/declarative-payments/payments/scheduler"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type applierFunc func(ctx context.Context, d resolver.DesiredState) ([]resolver.PaymentCommand, []error)
+
+func (f applierFunc) Apply(ctx context.Context, d resolver.DesiredState) ([]resolver.PaymentCommand, []error) {
+	return f(ctx, d)
+}
+
+func TestPlan(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	month := func(n int) time.Time {
+		return start.AddDate(0, n, 0)
+	}
+	plan := func() *installment.Plan {
+		p, err := installment.New(uuid.New(), uuid.New(), uuid.New(), "test", start, 500, 1000,
+			installment.Installment{Date: month(1), Amount: 1000},
+			installment.Installment{Date: month(2), Amount: 1000},
+			installment.Installment{Date: month(3), Amount: 300},
+		)
+		assert.NoError(t, err)
+		return p
+	}
+	amounts := func(states []resolver.DesiredState) ([]int, []uint) {
+		var amounts []int
+		var authorized []uint
+		for _, d := range states {
+			amounts = append(amounts, d.Amount)
+			authorized = append(authorized, d.AuthorizedAmount)
+		}
+		return amounts, authorized
+	}
+	// observe reports a command for d with the given status
+	observe := func(p *installment.Plan, d resolver.DesiredState, status consts.PaymentCommandStatus) {
+		cmd := d.Charge(1)
+		cmd.Status = status
+		p.Observe(payments.ActualState{DesiredState: d}, []resolver.PaymentCommand{cmd})
+	}
+	t.Run("Expands into dated desired states", func(t *testing.T) {
+		p := plan()
+		states := p.States()
+		amount, authorized := amounts(states)
+		assert.Equal(t, []int{0, 1000, 2000, 2300}, amount, "Installments are cumulative")
+		assert.Equal(t, []uint{500, 500, 500, 0}, authorized, "The deposit is released with the last installment")
+		assert.Equal(t, []time.Time{start, month(1), month(2), month(3)}, []time.Time{states[0].Date, states[1].Date, states[2].Date, states[3].Date})
+		assert.Equal(t, 230, states[3].PartnerAmount)
+		assert.Equal(t, states, p.States(), "IDs are deterministic")
+	})
+	t.Run("Last installment captures the deposit and releases the remainder", func(t *testing.T) {
+		d := plan().States()[3]
+		cmds, err := payments.NewHandler(&payments.ActualState{DesiredState: resolver.DesiredState{
+			ExternalID:       d.ExternalID,
+			UserID:           d.UserID,
+			PartnerID:        d.PartnerID,
+			Bucket:           d.Bucket,
+			Amount:           2000,
+			AuthorizedAmount: 500,
+			PartnerAmount:    200,
+		}}, nil, nil).GenerateResolution(d)
+		assert.NoError(t, err)
+		assert.Equal(t, consts.PaymentCommandActionCapture, cmds[0].Action)
+		assert.Equal(t, uint(300), cmds[0].Amount)
+		assert.Equal(t, consts.PaymentCommandActionRelease, cmds[1].Action)
+		assert.Equal(t, uint(200), cmds[1].Amount)
+	})
+	t.Run("Tracks installments from command results", func(t *testing.T) {
+		p := plan()
+		states := p.States()
+		observe(p, states[1], consts.PaymentCommandStatusComplete)
+		observe(p, states[2], consts.PaymentCommandStatusError)
+		installments := p.Installments()
+		assert.Equal(t, consts.InstallmentStatusComplete, installments[0].Status)
+		assert.Equal(t, states[1], installments[0].State)
+		assert.Equal(t, consts.InstallmentStatusPending, installments[1].Status, "Errors are retried")
+		observe(p, states[2], consts.PaymentCommandStatusFailed)
+		assert.Equal(t, consts.InstallmentStatusFailed, p.Installments()[1].Status)
+
+		other := states[3]
+		other.ExternalID = uuid.New()
+		observe(p, other, consts.PaymentCommandStatusComplete)
+		assert.Equal(t, consts.InstallmentStatusPending, p.Installments()[2].Status, "Other payments are ignored")
+
+		amount, authorized := amounts(p.States())
+		assert.Equal(t, []int{0, 1000, 1300}, amount, "Failed installments are not collected by later ones")
+		assert.Equal(t, []uint{500, 500, 500}, authorized, "The deposit is held while an installment is outstanding")
+	})
+	t.Run("Rejected installments fail", func(t *testing.T) {
+		p := plan()
+		states := p.States()
+		observe(p, states[1], consts.PaymentCommandStatusComplete)
+		observe(p, states[2], consts.PaymentCommandStatusRejected)
+		assert.Equal(t, consts.InstallmentStatusFailed, p.Installments()[1].Status)
+		assert.NoError(t, p.Reschedule(1, month(4)), "Rejected installments can be rescheduled")
+	})
+	t.Run("Reschedules failed installments", func(t *testing.T) {
+		p := plan()
+		states := p.States()
+		assert.True(t, errors.Is(p.Reschedule(1, month(4)), errors.ErrInstallmentNotFailed))
+		assert.True(t, errors.Is(p.Reschedule(5, month(4)), errors.ErrInstallmentNotFound))
+		observe(p, states[1], consts.PaymentCommandStatusComplete)
+		observe(p, states[2], consts.PaymentCommandStatusFailed)
+		observe(p, p.States()[2], consts.PaymentCommandStatusComplete)
+		assert.True(t, errors.Is(p.Reschedule(1, month(2)), errors.ErrLaterStateApplied), "Cannot move before a completed installment")
+		assert.NoError(t, p.Reschedule(1, month(4)))
+		rescheduled := p.States()
+		assert.Equal(t, states[1], rescheduled[1], "Completed installments are not regenerated")
+		amount, authorized := amounts(rescheduled)
+		assert.Equal(t, []int{0, 1000, 1300, 2300}, amount)
+		assert.Equal(t, []uint{500, 500, 500, 0}, authorized)
+		assert.Equal(t, month(4), rescheduled[3].Date)
+	})
+	t.Run("Plans are validated", func(t *testing.T) {
+		_, err := installment.New(uuid.New(), uuid.New(), uuid.New(), "test", start, 500, 0)
+		assert.True(t, errors.Is(err, errors.ErrInvalidInstallmentPlan), "Installments are required")
+		_, err = installment.New(uuid.New(), uuid.New(), uuid.New(), "test", start, 500, 0, installment.Installment{Date: start.Add(-time.Hour), Amount: 100})
+		assert.True(t, errors.Is(err, errors.ErrInvalidInstallmentPlan), "Installments cannot be before the deposit")
+		_, err = installment.New(uuid.New(), uuid.New(), uuid.New(), "test", start, 500, 0, installment.Installment{Date: start, Amount: 0})
+		assert.True(t, errors.Is(err, errors.ErrInvalidInstallmentPlan))
+	})
+	t.Run("Sync feeds the scheduler", func(t *testing.T) {
+		p := plan()
+		c := clock.NewMock(start)
+		sch := scheduler.New(scheduler.NewMemoryStore(), applierFunc(func(ctx context.Context, d resolver.DesiredState) ([]resolver.PaymentCommand, []error) {
+			status := consts.PaymentCommandStatusComplete
+			if d.Date.Equal(month(2)) {
+				status = consts.PaymentCommandStatusFailed
+			}
+			observe(p, d, status)
+			return nil, nil
+		}), c)
+		assert.NoError(t, p.Sync(sch))
+		assert.NoError(t, p.Sync(sch), "Syncing again is idempotent")
+		pending, err := sch.Pending(p.ExternalID)
+		assert.NoError(t, err)
+		assert.Equal(t, 4, len(pending))
+
+		c.Set(month(2))
+		_, err = sch.Tick(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, consts.InstallmentStatusFailed, p.Installments()[1].Status)
+		assert.NoError(t, p.Sync(sch))
+		pending, err = sch.Pending(p.ExternalID)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(pending))
+		assert.Equal(t, 1300, pending[0].State.Amount, "The last installment no longer collects the failed one")
+		assert.Equal(t, uint(500), pending[0].State.AuthorizedAmount)
+
+		assert.NoError(t, p.Reschedule(1, month(4)))
+		assert.NoError(t, p.Sync(sch))
+		c.Set(month(4))
+		_, err = sch.Tick(context.Background())
+		assert.NoError(t, err)
+		for _, i := range p.Installments() {
+			assert.Equal(t, consts.InstallmentStatusComplete, i.Status)
+		}
+	})
+}
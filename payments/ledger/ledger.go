@@ -0,0 +1,234 @@
+// Package ledger keeps a double-entry record of every balance movement, so that it can be said where the money of a
+// payment went and when, which the running totals of an ActualState cannot.
+//
+// Each completed command posts a transaction moving its settled amount between accounts:
+//
+//	authorize: user-receivable      -> authorization-holds
+//	release:   authorization-holds  -> user-receivable
+//	capture:   authorization-holds  -> provider-clearing
+//	charge:    user-receivable      -> provider-clearing
+//	refund:    provider-clearing    -> user-receivable
+//	deposit:   provider-clearing    -> partner-payable
+//	withdraw:  partner-payable      -> provider-clearing
+//
+// Captures and charges also move their estimated provider fee from provider-clearing to provider-fees.  When a payment
+// completes, what is left in provider-clearing is recognized as platform-revenue.
+package ledger
+
+import (
+	"fmt"
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments"
+	"github.com/davidjwilkins/declarative-payments/payments/resolver"
+	"github.com/google/uuid"
+	"sync"
+	"time"
+)
+
+// Entry posts an amount to an account.  Amounts moved into an account are positive, and those moved out negative.
+type Entry struct {
+	Account consts.LedgerAccount `json:"account"`
+	Amount  int                  `json:"amount"`
+}
+
+// Transaction is a set of entries which balance, posted together
+type Transaction struct {
+	ID         uuid.UUID `json:"id"`
+	ExternalID uuid.UUID `json:"external_id"`
+	// CommandID is the command which moved the money, or uuid.Nil if the transaction recognizes revenue
+	CommandID   uuid.UUID `json:"command_id"`
+	Description string    `json:"description"`
+	Entries     []Entry   `json:"entries"`
+	Date        time.Time `json:"date"`
+}
+
+// move returns the entries moving amount from one account to another
+func move(from, to consts.LedgerAccount, amount int) []Entry {
+	return []Entry{{Account: from, Amount: -amount}, {Account: to, Amount: amount}}
+}
+
+// commandEntries returns the entries posted by cmd, or nil if it moves nothing
+func commandEntries(cmd resolver.PaymentCommand) []Entry {
+	amount := int(cmd.Settled)
+	var fee []Entry
+	if cmd.ProviderFee > 0 {
+		fee = move(consts.LedgerAccountProviderClearing, consts.LedgerAccountProviderFees, int(cmd.ProviderFee))
+	}
+	switch cmd.Action {
+	case consts.PaymentCommandActionAuthorize:
+		return move(consts.LedgerAccountUserReceivable, consts.LedgerAccountAuthorizationHolds, amount)
+	case consts.PaymentCommandActionRelease:
+		return move(consts.LedgerAccountAuthorizationHolds, consts.LedgerAccountUserReceivable, amount)
+	case consts.PaymentCommandActionCapture:
+		return append(move(consts.LedgerAccountAuthorizationHolds, consts.LedgerAccountProviderClearing, amount), fee...)
+	case consts.PaymentCommandActionCharge:
+		return append(move(consts.LedgerAccountUserReceivable, consts.LedgerAccountProviderClearing, amount), fee...)
+	case consts.PaymentCommandActionRefund:
+		return move(consts.LedgerAccountProviderClearing, consts.LedgerAccountUserReceivable, amount)
+	case consts.PaymentCommandActionDeposit:
+		return move(consts.LedgerAccountProviderClearing, consts.LedgerAccountPartnerPayable, amount)
+	case consts.PaymentCommandActionWithdraw:
+		return move(consts.LedgerAccountPartnerPayable, consts.LedgerAccountProviderClearing, amount)
+	}
+	return nil
+}
+
+// Ledger posts the movements of every command it observes.  It is a payments.CommandObserver, and commands are posted
+// once, when they complete, however many times they are observed.
+type Ledger struct {
+	lock  sync.Mutex
+	store Store
+	clock clock.Clock
+}
+
+func New(store Store, c clock.Clock) *Ledger {
+	return &Ledger{
+		store: store,
+		clock: c,
+	}
+}
+
+// Post appends tx to the ledger, provided its entries balance.  It is given an ID and date if it has none.
+func (l *Ledger) Post(tx Transaction) (Transaction, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.post(tx)
+}
+
+func (l *Ledger) post(tx Transaction) (Transaction, error) {
+	sum := 0
+	for _, e := range tx.Entries {
+		sum += e.Amount
+	}
+	if sum != 0 || len(tx.Entries) == 0 {
+		return Transaction{}, fmt.Errorf("%w: entries add up to %d", errors.ErrUnbalancedTransaction, sum)
+	}
+	if tx.ID == uuid.Nil {
+		tx.ID = uuid.New()
+	}
+	if tx.Date.IsZero() {
+		tx.Date = l.clock.Now()
+	}
+	return tx, l.store.Append(tx)
+}
+
+// Transactions returns the transactions matching q, in the order they were posted
+func (l *Ledger) Transactions(q Query) ([]Transaction, error) {
+	return l.store.Query(q)
+}
+
+// Balances returns the sum of the entries of the transactions matching q, by account.  If q has an Account, only its
+// balance is returned.
+func (l *Ledger) Balances(q Query) (map[consts.LedgerAccount]int, error) {
+	transactions, err := l.store.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	balances := make(map[consts.LedgerAccount]int)
+	for _, tx := range transactions {
+		for _, e := range tx.Entries {
+			if q.Account == "" || e.Account == q.Account {
+				balances[e.Account] += e.Amount
+			}
+		}
+	}
+	return balances, nil
+}
+
+// Observe posts the commands which completed and have not been posted yet.  If state is complete, what is left in
+// provider-clearing for it is then recognized as revenue.  Observers cannot return errors, so failing to post does not
+// fail the run; Check will report the difference.
+func (l *Ledger) Observe(state payments.ActualState, cmds []resolver.PaymentCommand) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	posted, err := l.store.Query(Query{ExternalID: state.ExternalID})
+	if err != nil {
+		return
+	}
+	seen := make(map[uuid.UUID]bool)
+	for _, tx := range posted {
+		seen[tx.CommandID] = true
+	}
+	for _, cmd := range cmds {
+		if cmd.Status != consts.PaymentCommandStatusComplete || cmd.Settled == 0 || seen[cmd.ID] {
+			continue
+		}
+		entries := commandEntries(cmd)
+		if entries == nil {
+			continue
+		}
+		if _, err := l.post(Transaction{
+			ExternalID:  state.ExternalID,
+			CommandID:   cmd.ID,
+			Description: string(cmd.Action),
+			Entries:     entries,
+		}); err != nil {
+			return
+		}
+		seen[cmd.ID] = true
+	}
+	if state.Status == consts.PaymentStatusComplete {
+		l.recognize(state)
+	}
+}
+
+// recognize moves what is left in provider-clearing for state to platform-revenue
+func (l *Ledger) recognize(state payments.ActualState) {
+	balances, err := l.Balances(Query{ExternalID: state.ExternalID})
+	if err != nil || balances[consts.LedgerAccountProviderClearing] == 0 {
+		return
+	}
+	l.post(Transaction{
+		ExternalID:  state.ExternalID,
+		Description: "revenue",
+		Entries: move(consts.LedgerAccountProviderClearing, consts.LedgerAccountPlatformRevenue,
+			balances[consts.LedgerAccountProviderClearing]),
+	})
+}
+
+// Check returns errors.ErrLedgerMismatch if the ledger's balances for the payment of state do not add up to it.  The
+// ledger only sees what handlers run, so states which adopt balances from elsewhere, as drift and recovery do, will no
+// longer match.
+func (l *Ledger) Check(state payments.ActualState) error {
+	balances, err := l.Balances(Query{ExternalID: state.ExternalID})
+	if err != nil {
+		return err
+	}
+	expected := map[consts.LedgerAccount]int{
+		consts.LedgerAccountUserReceivable:     -(state.Amount + int(state.AuthorizedAmount)),
+		consts.LedgerAccountAuthorizationHolds: int(state.AuthorizedAmount),
+		consts.LedgerAccountPartnerPayable:     state.PartnerAmount,
+		consts.LedgerAccountProviderFees:       int(state.ProviderFees),
+	}
+	if state.Status == consts.PaymentStatusComplete {
+		expected[consts.LedgerAccountProviderClearing] = 0
+		expected[consts.LedgerAccountPlatformRevenue] = state.PlatformRevenue
+	}
+	for _, account := range []consts.LedgerAccount{consts.LedgerAccountUserReceivable,
+		consts.LedgerAccountAuthorizationHolds, consts.LedgerAccountPartnerPayable, consts.LedgerAccountProviderFees,
+		consts.LedgerAccountProviderClearing, consts.LedgerAccountPlatformRevenue} {
+		want, ok := expected[account]
+		if ok && balances[account] != want {
+			return fmt.Errorf("%w: %s of %s is %d rather than %d", errors.ErrLedgerMismatch, account, state.ExternalID,
+				balances[account], want)
+		}
+	}
+	return nil
+}
+
+// Verify checks every state in store against the ledger
+func (l *Ledger) Verify(store payments.StateStore) error {
+	states, err := store.Find("", consts.PaymentStatusPending, consts.PaymentStatusComplete,
+		consts.PaymentStatusError, consts.PaymentStatusFailed)
+	if err != nil {
+		return err
+	}
+	for _, state := range states {
+		if err := l.Check(state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
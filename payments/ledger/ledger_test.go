@@ -0,0 +1,179 @@
+package ledger_test
+
+import (
+	"context"
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments"
+	"github.com/davidjwilkins/declarative-payments/payments/fees"
+	"github.com/davidjwilkins/declarative-payments/payments/handlers"
+	"github.com/davidjwilkins/declarative-payments/payments/ledger"
+	"github.com/davidjwilkins/declarative-payments/payments/resolver"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestLedger(t *testing.T) {
+	start := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	type responder interface {
+		payments.UserHandler
+		Respond(method string, n int, response handlers.Response)
+	}
+	type paymentHandler interface {
+		Resolve(ctx context.Context, d resolver.DesiredState) ([]resolver.PaymentCommand, []error)
+		Run(cmds []resolver.PaymentCommand) ([]resolver.PaymentCommand, []error)
+		CurrentState() payments.ActualState
+	}
+	setup := func() (*ledger.Ledger, paymentHandler, payments.StateStore, *clock.Mock, responder) {
+		c := clock.NewMock(start)
+		l := ledger.New(ledger.NewMemoryStore(), c)
+		user := handlers.NewUserMock()
+		store := payments.NewMemoryStateStore()
+		state := &payments.ActualState{DesiredState: resolver.DesiredState{ExternalID: uuid.New(), Bucket: "test"}}
+		h := payments.NewHandler(state, handlers.NewPartnerMock(), user, payments.WithStateStore(store),
+			payments.WithObserver(l), payments.WithClock(c))
+		return l, h, store, c, user
+	}
+	resolve := func(t *testing.T, h paymentHandler, amount int, authorized uint, partner int) []resolver.PaymentCommand {
+		d := h.CurrentState().DesiredState
+		d.ID = uuid.New()
+		d.Date = start
+		d.Amount = amount
+		d.AuthorizedAmount = authorized
+		d.PartnerAmount = partner
+		cmds, errs := h.Resolve(context.Background(), d)
+		assert.Equal(t, 0, len(errs), errs)
+		return cmds
+	}
+	t.Run("Completed commands post balanced transactions", func(t *testing.T) {
+		l, h, store, _, _ := setup()
+		cmds := resolve(t, h, 1000, 500, 900)
+		state := h.CurrentState()
+		transactions, err := l.Transactions(ledger.Query{ExternalID: state.ExternalID})
+		assert.NoError(t, err)
+		assert.Equal(t, len(cmds)+1, len(transactions), "One transaction per command, and one recognizing revenue")
+		for _, tx := range transactions {
+			sum := 0
+			for _, e := range tx.Entries {
+				sum += e.Amount
+			}
+			assert.Equal(t, 0, sum)
+		}
+		balances, err := l.Balances(ledger.Query{ExternalID: state.ExternalID})
+		assert.NoError(t, err)
+		assert.Equal(t, -1500, balances[consts.LedgerAccountUserReceivable])
+		assert.Equal(t, 500, balances[consts.LedgerAccountAuthorizationHolds])
+		assert.Equal(t, 0, balances[consts.LedgerAccountProviderClearing])
+		assert.Equal(t, 900, balances[consts.LedgerAccountPartnerPayable])
+		assert.Equal(t, 100, balances[consts.LedgerAccountPlatformRevenue])
+		assert.NoError(t, l.Check(state))
+		assert.NoError(t, l.Verify(store))
+		l.Observe(state, cmds)
+		again, err := l.Transactions(ledger.Query{ExternalID: state.ExternalID})
+		assert.NoError(t, err)
+		assert.Equal(t, len(transactions), len(again), "Commands are only posted once")
+	})
+	t.Run("Settled amounts are posted", func(t *testing.T) {
+		l, h, _, _, user := setup()
+		resolve(t, h, 1000, 0, 0)
+		user.Respond("Refund", 1, handlers.Response{Amount: 150})
+		cmds := resolve(t, h, 500, 0, 0)
+		assert.Equal(t, uint(150), cmds[0].Settled)
+		state := h.CurrentState()
+		assert.Equal(t, 850, state.Amount)
+		assert.NoError(t, l.Check(state))
+		transactions, err := l.Transactions(ledger.Query{CommandID: cmds[0].ID})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(transactions))
+		assert.Equal(t, []ledger.Entry{
+			{Account: consts.LedgerAccountProviderClearing, Amount: -150},
+			{Account: consts.LedgerAccountUserReceivable, Amount: 150},
+		}, transactions[0].Entries)
+	})
+	t.Run("Retried commands are posted when they complete", func(t *testing.T) {
+		l, h, _, _, user := setup()
+		user.Respond("Charge", 1, handlers.Response{Err: errors.ErrRetryable})
+		d := h.CurrentState().DesiredState
+		d.ID = uuid.New()
+		d.Date = start
+		d.Amount = 1000
+		cmds, errs := h.Resolve(context.Background(), d)
+		assert.Equal(t, 1, len(errs))
+		transactions, err := l.Transactions(ledger.Query{})
+		assert.NoError(t, err)
+		assert.Empty(t, transactions)
+		cmds, errs = h.Run(cmds)
+		assert.Equal(t, 0, len(errs))
+		assert.NoError(t, l.Check(h.CurrentState()))
+		transactions, err = l.Transactions(ledger.Query{CommandID: cmds[0].ID})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(transactions))
+	})
+	t.Run("Revenue follows refunds", func(t *testing.T) {
+		l, h, _, _, _ := setup()
+		resolve(t, h, 1000, 0, 900)
+		resolve(t, h, 0, 0, 0)
+		state := h.CurrentState()
+		balances, err := l.Balances(ledger.Query{ExternalID: state.ExternalID})
+		assert.NoError(t, err)
+		assert.Equal(t, 0, balances[consts.LedgerAccountPlatformRevenue])
+		assert.Equal(t, 0, balances[consts.LedgerAccountProviderClearing])
+		assert.NoError(t, l.Check(state))
+	})
+	t.Run("Provider fees are posted with what they were taken from", func(t *testing.T) {
+		l := ledger.New(ledger.NewMemoryStore(), clock.NewMock(start))
+		state := &payments.ActualState{DesiredState: resolver.DesiredState{ExternalID: uuid.New(), Bucket: "test"}}
+		h := payments.NewHandler(state, handlers.NewPartnerMock(), handlers.NewUserMock(), payments.WithObserver(l),
+			payments.WithClock(clock.NewMock(start)),
+			payments.WithFees(map[string]fees.Fees{"test": {Provider: fees.Fee{BasisPoints: 290, Fixed: 30}}}))
+		cmds := resolve(t, h, 1000, 0, 900)
+		for _, cmd := range cmds {
+			if cmd.Action == consts.PaymentCommandActionCharge {
+				assert.Equal(t, uint(59), cmd.ProviderFee)
+			}
+		}
+		assert.Equal(t, 41, h.CurrentState().PlatformRevenue)
+		balances, err := l.Balances(ledger.Query{ExternalID: state.ExternalID})
+		assert.NoError(t, err)
+		assert.Equal(t, 59, balances[consts.LedgerAccountProviderFees])
+		assert.Equal(t, 41, balances[consts.LedgerAccountPlatformRevenue])
+		assert.NoError(t, l.Check(h.CurrentState()))
+	})
+	t.Run("Movements can be queried by day", func(t *testing.T) {
+		l, h, _, c, _ := setup()
+		resolve(t, h, 1000, 0, 0)
+		c.Advance(24 * time.Hour)
+		resolve(t, h, 400, 0, 0)
+		day := start.Truncate(24 * time.Hour).Add(24 * time.Hour)
+		balances, err := l.Balances(ledger.Query{From: day, To: day.Add(24 * time.Hour),
+			Account: consts.LedgerAccountUserReceivable})
+		assert.NoError(t, err)
+		assert.Equal(t, map[consts.LedgerAccount]int{consts.LedgerAccountUserReceivable: 600}, balances)
+	})
+	t.Run("Unbalanced transactions are rejected", func(t *testing.T) {
+		l, _, _, _, _ := setup()
+		_, err := l.Post(ledger.Transaction{Entries: []ledger.Entry{{Account: consts.LedgerAccountPlatformRevenue, Amount: 100}}})
+		assert.True(t, errors.Is(err, errors.ErrUnbalancedTransaction))
+		tx, err := l.Post(ledger.Transaction{Description: "adjustment",
+			Entries: []ledger.Entry{
+				{Account: consts.LedgerAccountPlatformRevenue, Amount: -100},
+				{Account: consts.LedgerAccountPartnerPayable, Amount: 100},
+			}})
+		assert.NoError(t, err)
+		assert.NotEqual(t, uuid.Nil, tx.ID)
+		assert.Equal(t, start, tx.Date)
+	})
+	t.Run("States changed outside of the ledger do not match", func(t *testing.T) {
+		l, h, store, _, _ := setup()
+		resolve(t, h, 1000, 0, 0)
+		state := h.CurrentState()
+		state.Amount = 800
+		state.Version++
+		assert.NoError(t, store.Save(state, state.Version-1))
+		assert.True(t, errors.Is(l.Check(state), errors.ErrLedgerMismatch))
+		assert.True(t, errors.Is(l.Verify(store), errors.ErrLedgerMismatch))
+	})
+}
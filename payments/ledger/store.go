@@ -0,0 +1,69 @@
+package ledger
+
+import (
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/google/uuid"
+	"sync"
+	"time"
+)
+
+// Query selects transactions.  Zero fields match everything; From is inclusive and To is exclusive.
+type Query struct {
+	ExternalID uuid.UUID
+	CommandID  uuid.UUID
+	// Account matches the transactions which post to it
+	Account consts.LedgerAccount
+	From    time.Time
+	To      time.Time
+}
+
+func (q Query) matches(tx Transaction) bool {
+	if q.Account != "" {
+		posts := false
+		for _, e := range tx.Entries {
+			posts = posts || e.Account == q.Account
+		}
+		if !posts {
+			return false
+		}
+	}
+	return (q.ExternalID == uuid.Nil || q.ExternalID == tx.ExternalID) &&
+		(q.CommandID == uuid.Nil || q.CommandID == tx.CommandID) &&
+		(q.From.IsZero() || !tx.Date.Before(q.From)) &&
+		(q.To.IsZero() || tx.Date.Before(q.To))
+}
+
+// Store is an append-only store of transactions
+type Store interface {
+	Append(tx Transaction) error
+	// Query returns the transactions matching q, in the order they were appended
+	Query(q Query) ([]Transaction, error)
+}
+
+type memoryStore struct {
+	lock         sync.RWMutex
+	transactions []Transaction
+}
+
+func NewMemoryStore() *memoryStore {
+	return &memoryStore{}
+}
+
+func (m *memoryStore) Append(tx Transaction) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.transactions = append(m.transactions, tx)
+	return nil
+}
+
+func (m *memoryStore) Query(q Query) ([]Transaction, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var transactions []Transaction
+	for _, tx := range m.transactions {
+		if q.matches(tx) {
+			transactions = append(transactions, tx)
+		}
+	}
+	return transactions, nil
+}
@@ -0,0 +1,54 @@
+package locks
+
+import (
+	"context"
+	"fmt"
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/google/uuid"
+	"time"
+)
+
+// Locker provides mutual exclusion between processes resolving the same payment.
+type Locker interface {
+	// Acquire takes the lock for key for ttl, returning errors.ErrLockHeld if it is already held elsewhere.
+	Acquire(ctx context.Context, key string, ttl time.Duration) (Lease, error)
+}
+
+// Lease is a held lock.  It must be renewed before its ttl runs out, or it will be lost.
+type Lease interface {
+	Key() string
+	// Renew extends the lease by ttl, returning errors.ErrLockLost if the lease has already expired.
+	Renew(ctx context.Context, ttl time.Duration) error
+	Release(ctx context.Context) error
+}
+
+// Key returns the lock key for a payment
+func Key(bucket string, userID, partnerID, externalID uuid.UUID) string {
+	return fmt.Sprintf("%s/%s/%s/%s", bucket, userID, partnerID, externalID)
+}
+
+// KeepAlive renews lease every ttl/2 on c until stop is called.  stop returns the first renewal error, if any.
+func KeepAlive(lease Lease, ttl time.Duration, c clock.Clock) (stop func() error) {
+	done := make(chan struct{})
+	result := make(chan error, 1)
+	next := clock.After(c, ttl/2)
+	go func() {
+		for {
+			select {
+			case <-done:
+				result <- nil
+				return
+			case <-next:
+				if err := lease.Renew(context.Background(), ttl); err != nil {
+					result <- err
+					return
+				}
+				next = clock.After(c, ttl/2)
+			}
+		}
+	}()
+	return func() error {
+		close(done)
+		return <-result
+	}
+}
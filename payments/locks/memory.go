@@ -0,0 +1,90 @@
+package locks
+
+import (
+	"context"
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/google/uuid"
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	token   uuid.UUID
+	expires time.Time
+}
+
+type memoryLocker struct {
+	lock    sync.Mutex
+	clock   clock.Clock
+	entries map[string]memoryEntry
+}
+
+type memoryLease struct {
+	locker *memoryLocker
+	key    string
+	token  uuid.UUID
+}
+
+// NewMemory returns a Locker which only excludes holders within this process
+func NewMemory(c clock.Clock) *memoryLocker {
+	return &memoryLocker{
+		clock:   c,
+		entries: make(map[string]memoryEntry),
+	}
+}
+
+func (m *memoryLocker) Acquire(_ context.Context, key string, ttl time.Duration) (Lease, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := m.clock.Now()
+	if entry, ok := m.entries[key]; ok && entry.expires.After(now) {
+		return nil, errors.ErrLockHeld
+	}
+	entry := memoryEntry{
+		token:   uuid.New(),
+		expires: now.Add(ttl),
+	}
+	m.entries[key] = entry
+	return &memoryLease{
+		locker: m,
+		key:    key,
+		token:  entry.token,
+	}, nil
+}
+
+// held must be called with the lock held
+func (l *memoryLease) held() bool {
+	entry, ok := l.locker.entries[l.key]
+	return ok && entry.token == l.token && entry.expires.After(l.locker.clock.Now())
+}
+
+func (l *memoryLease) Key() string {
+	return l.key
+}
+
+func (l *memoryLease) Renew(_ context.Context, ttl time.Duration) error {
+	l.locker.lock.Lock()
+	defer l.locker.lock.Unlock()
+	if !l.held() {
+		return errors.ErrLockLost
+	}
+	l.locker.entries[l.key] = memoryEntry{
+		token:   l.token,
+		expires: l.locker.clock.Now().Add(ttl),
+	}
+	return nil
+}
+
+func (l *memoryLease) Release(_ context.Context) error {
+	l.locker.lock.Lock()
+	defer l.locker.lock.Unlock()
+	held := l.held()
+	if entry, ok := l.locker.entries[l.key]; ok && entry.token == l.token {
+		delete(l.locker.entries, l.key)
+	}
+	if !held {
+		return errors.ErrLockLost
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package locks_test
+
+import (
+	"context"
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments/locks"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestKey(t *testing.T) {
+	userID, partnerID, externalID := uuid.New(), uuid.New(), uuid.New()
+	assert.Equal(t, locks.Key("test", userID, partnerID, externalID), locks.Key("test", userID, partnerID, externalID))
+	assert.NotEqual(t, locks.Key("test", userID, partnerID, externalID), locks.Key("other", userID, partnerID, externalID))
+	assert.NotEqual(t, locks.Key("test", userID, partnerID, externalID), locks.Key("test", userID, partnerID, uuid.New()))
+}
+
+func TestMemory(t *testing.T) {
+	ctx := context.Background()
+	t.Run("Lock is exclusive", func(t *testing.T) {
+		l := locks.NewMemory(clock.System)
+		lease, err := l.Acquire(ctx, "abc", time.Minute)
+		assert.NoError(t, err)
+		assert.Equal(t, "abc", lease.Key())
+		_, err = l.Acquire(ctx, "abc", time.Minute)
+		assert.True(t, errors.Is(err, errors.ErrLockHeld), "Cannot acquire a held lock")
+		_, err = l.Acquire(ctx, "def", time.Minute)
+		assert.NoError(t, err, "Can acquire a different lock")
+		assert.NoError(t, lease.Release(ctx))
+		_, err = l.Acquire(ctx, "abc", time.Minute)
+		assert.NoError(t, err, "Can acquire a released lock")
+	})
+	t.Run("Lease expires", func(t *testing.T) {
+		c := clock.NewMock(time.Now())
+		l := locks.NewMemory(c)
+		lease, err := l.Acquire(ctx, "abc", time.Minute)
+		assert.NoError(t, err)
+		c.Advance(time.Minute)
+		other, err := l.Acquire(ctx, "abc", time.Minute)
+		assert.NoError(t, err, "Can acquire an expired lock")
+		assert.True(t, errors.Is(lease.Renew(ctx, time.Minute), errors.ErrLockLost), "Cannot renew a lost lease")
+		assert.True(t, errors.Is(lease.Release(ctx), errors.ErrLockLost), "Cannot release a lost lease")
+		_, err = l.Acquire(ctx, "abc", time.Minute)
+		assert.True(t, errors.Is(err, errors.ErrLockHeld), "Releasing a lost lease does not release the new holder")
+		assert.NoError(t, other.Release(ctx))
+	})
+	t.Run("Lease can be renewed", func(t *testing.T) {
+		c := clock.NewMock(time.Now())
+		l := locks.NewMemory(c)
+		lease, err := l.Acquire(ctx, "abc", time.Minute)
+		assert.NoError(t, err)
+		c.Advance(50 * time.Second)
+		assert.NoError(t, lease.Renew(ctx, time.Minute))
+		c.Advance(50 * time.Second)
+		_, err = l.Acquire(ctx, "abc", time.Minute)
+		assert.True(t, errors.Is(err, errors.ErrLockHeld), "Renewed lease is still held")
+		assert.NoError(t, lease.Release(ctx))
+	})
+}
+
+// renewals signals every renewal of the lease it wraps
+type renewals struct {
+	locks.Lease
+	renewed chan error
+}
+
+func (r renewals) Renew(ctx context.Context, ttl time.Duration) error {
+	err := r.Lease.Renew(ctx, ttl)
+	r.renewed <- err
+	return err
+}
+
+func TestKeepAlive(t *testing.T) {
+	ctx := context.Background()
+	t.Run("Renews the lease", func(t *testing.T) {
+		c := clock.NewMock(time.Now())
+		l := locks.NewMemory(c)
+		lease, err := l.Acquire(ctx, "abc", 20*time.Millisecond)
+		assert.NoError(t, err)
+		kept := renewals{Lease: lease, renewed: make(chan error, 10)}
+		stop := locks.KeepAlive(kept, 20*time.Millisecond, c)
+		c.Advance(10 * time.Millisecond)
+		assert.NoError(t, <-kept.renewed)
+		c.Advance(15 * time.Millisecond)
+		_, err = l.Acquire(ctx, "abc", time.Minute)
+		assert.True(t, errors.Is(err, errors.ErrLockHeld), "Lease is kept alive")
+		assert.NoError(t, stop())
+		assert.NoError(t, lease.Release(ctx))
+	})
+	t.Run("Reports a lost lease", func(t *testing.T) {
+		c := clock.NewMock(time.Now())
+		l := locks.NewMemory(c)
+		lease, err := l.Acquire(ctx, "abc", 20*time.Millisecond)
+		assert.NoError(t, err)
+		c.Advance(time.Minute)
+		kept := renewals{Lease: lease, renewed: make(chan error, 10)}
+		stop := locks.KeepAlive(kept, 20*time.Millisecond, c)
+		c.Advance(10 * time.Millisecond)
+		assert.True(t, errors.Is(<-kept.renewed, errors.ErrLockLost))
+		assert.True(t, errors.Is(stop(), errors.ErrLockLost))
+	})
+}
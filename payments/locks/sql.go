@@ -0,0 +1,148 @@
+package locks
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+type sqlLocker struct {
+	db    *sql.DB
+	clock clock.Clock
+}
+
+// sqlLease holds a Postgres session-level advisory lock on a dedicated connection.  Advisory locks never expire on
+// their own, so the lease releases the lock itself if it is not renewed within its ttl.
+type sqlLease struct {
+	lock    sync.Mutex
+	clock   clock.Clock
+	conn    *sql.Conn
+	key     string
+	id      int64
+	expires time.Time
+	expired bool
+}
+
+// NewSQL returns a Locker backed by Postgres advisory locks, whose leases expire on c
+func NewSQL(db *sql.DB, c clock.Clock) *sqlLocker {
+	return &sqlLocker{db: db, clock: c}
+}
+
+// advisoryID maps a lock key onto the 64 bit key space of pg_advisory_lock
+func advisoryID(key string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int64(h.Sum64())
+}
+
+func (s *sqlLocker) Acquire(ctx context.Context, key string, ttl time.Duration) (Lease, error) {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id := advisoryID(key)
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", id).Scan(&acquired); err != nil {
+		discard(conn)
+		return nil, err
+	}
+	if !acquired {
+		conn.Close()
+		return nil, errors.ErrLockHeld
+	}
+	l := &sqlLease{
+		clock: s.clock,
+		conn:  conn,
+		key:   key,
+		id:    id,
+	}
+	l.extend(ttl)
+	return l, nil
+}
+
+// extend moves the expiry of l to ttl from now, and releases the lock then unless it is extended again.  It must be
+// called with the lock held.
+func (l *sqlLease) extend(ttl time.Duration) {
+	l.expires = l.clock.Now().Add(ttl)
+	go func(expires time.Time, due <-chan time.Time) {
+		<-due
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		if l.expires.Equal(expires) {
+			l.expire()
+		}
+	}(l.expires, clock.After(l.clock, ttl))
+}
+
+// expire releases the lock once the lease has run out.  It must be called with the lock held.
+func (l *sqlLease) expire() {
+	if l.expired {
+		return
+	}
+	l.expired = true
+	l.unlock(context.Background())
+}
+
+// discard closes the session rather than returning it to the pool, which releases any advisory locks it still holds
+func discard(conn *sql.Conn) {
+	conn.Raw(func(interface{}) error {
+		return driver.ErrBadConn
+	})
+	conn.Close()
+}
+
+// unlock must be called with the lock held
+func (l *sqlLease) unlock(ctx context.Context) error {
+	var released bool
+	err := l.conn.QueryRowContext(ctx, "SELECT pg_advisory_unlock($1)", l.id).Scan(&released)
+	if err != nil {
+		discard(l.conn)
+		return err
+	}
+	l.conn.Close()
+	if !released {
+		return errors.ErrLockLost
+	}
+	return nil
+}
+
+func (l *sqlLease) Key() string {
+	return l.key
+}
+
+func (l *sqlLease) Renew(ctx context.Context, ttl time.Duration) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !l.clock.Now().Before(l.expires) {
+		l.expire()
+	}
+	if l.expired {
+		return errors.ErrLockLost
+	}
+	// Make sure the session holding the lock is still alive
+	if err := l.conn.PingContext(ctx); err != nil {
+		l.expired = true
+		discard(l.conn)
+		return errors.ErrLockLost
+	}
+	l.extend(ttl)
+	return nil
+}
+
+func (l *sqlLease) Release(ctx context.Context) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !l.clock.Now().Before(l.expires) {
+		l.expire()
+	}
+	if l.expired {
+		return errors.ErrLockLost
+	}
+	l.expired = true
+	return l.unlock(ctx)
+}
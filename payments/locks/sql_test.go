@@ -0,0 +1,161 @@
+package locks_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments/locks"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// advisoryServer fakes just enough of Postgres' advisory locks to exercise the SQL locker
+type advisoryServer struct {
+	lock sync.Mutex
+	held map[int64]*advisoryConn
+}
+
+type advisoryConn struct {
+	server *advisoryServer
+	dead   bool
+}
+
+type boolRows struct {
+	value bool
+	done  bool
+}
+
+func (s *advisoryServer) Open(string) (driver.Conn, error) {
+	return &advisoryConn{server: s}, nil
+}
+
+func (c *advisoryConn) Prepare(string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func (c *advisoryConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func (c *advisoryConn) Close() error {
+	c.server.lock.Lock()
+	defer c.server.lock.Unlock()
+	for id, holder := range c.server.held {
+		if holder == c {
+			delete(c.server.held, id)
+		}
+	}
+	return nil
+}
+
+func (c *advisoryConn) Ping(context.Context) error {
+	if c.dead {
+		return driver.ErrBadConn
+	}
+	return nil
+}
+
+func (c *advisoryConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if c.dead {
+		return nil, driver.ErrBadConn
+	}
+	c.server.lock.Lock()
+	defer c.server.lock.Unlock()
+	id := args[0].Value.(int64)
+	switch query {
+	case "SELECT pg_try_advisory_lock($1)":
+		if holder, ok := c.server.held[id]; ok && holder != c {
+			return &boolRows{value: false}, nil
+		}
+		c.server.held[id] = c
+		return &boolRows{value: true}, nil
+	case "SELECT pg_advisory_unlock($1)":
+		if holder, ok := c.server.held[id]; ok && holder == c {
+			delete(c.server.held, id)
+			return &boolRows{value: true}, nil
+		}
+		return &boolRows{value: false}, nil
+	}
+	return nil, fmt.Errorf("unexpected query %q", query)
+}
+
+func (r *boolRows) Columns() []string {
+	return []string{"result"}
+}
+
+func (r *boolRows) Close() error {
+	return nil
+}
+
+func (r *boolRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = r.value
+	return nil
+}
+
+var registerOnce sync.Once
+var server = &advisoryServer{held: make(map[int64]*advisoryConn)}
+
+func openAdvisoryDB() *sql.DB {
+	registerOnce.Do(func() {
+		sql.Register("advisory", server)
+	})
+	db, _ := sql.Open("advisory", "")
+	return db
+}
+
+func TestSQL(t *testing.T) {
+	ctx := context.Background()
+	db := openAdvisoryDB()
+	t.Run("Lock is exclusive", func(t *testing.T) {
+		l := locks.NewSQL(db, clock.System)
+		lease, err := l.Acquire(ctx, "abc", time.Minute)
+		assert.NoError(t, err)
+		assert.Equal(t, "abc", lease.Key())
+		_, err = l.Acquire(ctx, "abc", time.Minute)
+		assert.True(t, errors.Is(err, errors.ErrLockHeld), "Cannot acquire a held lock")
+		other, err := l.Acquire(ctx, "def", time.Minute)
+		assert.NoError(t, err, "Can acquire a different lock")
+		assert.NoError(t, lease.Renew(ctx, time.Minute))
+		assert.NoError(t, lease.Release(ctx))
+		assert.NoError(t, other.Release(ctx))
+		lease, err = l.Acquire(ctx, "abc", time.Minute)
+		assert.NoError(t, err, "Can acquire a released lock")
+		assert.NoError(t, lease.Release(ctx))
+		assert.True(t, errors.Is(lease.Release(ctx), errors.ErrLockLost), "Cannot release twice")
+	})
+	t.Run("Lease expires if not renewed", func(t *testing.T) {
+		c := clock.NewMock(time.Now())
+		l := locks.NewSQL(db, c)
+		lease, err := l.Acquire(ctx, "abc", 10*time.Millisecond)
+		assert.NoError(t, err)
+		c.Advance(30 * time.Millisecond)
+		assert.True(t, errors.Is(lease.Renew(ctx, time.Minute), errors.ErrLockLost), "Cannot renew an expired lease")
+		lease, err = l.Acquire(ctx, "abc", time.Minute)
+		assert.NoError(t, err, "Expired lease was released")
+		assert.NoError(t, lease.Release(ctx))
+	})
+	t.Run("Lease is lost with its session", func(t *testing.T) {
+		l := locks.NewSQL(db, clock.System)
+		lease, err := l.Acquire(ctx, "abc", time.Minute)
+		assert.NoError(t, err)
+		server.lock.Lock()
+		for _, conn := range server.held {
+			conn.dead = true
+		}
+		server.lock.Unlock()
+		assert.True(t, errors.Is(lease.Renew(ctx, time.Minute), errors.ErrLockLost), "Cannot renew on a dead session")
+		lease, err = l.Acquire(ctx, "abc", time.Minute)
+		assert.NoError(t, err, "Dead session's lock was released")
+		assert.NoError(t, lease.Release(ctx))
+	})
+}
@@ -0,0 +1,279 @@
+package payments
+
+import (
+	"context"
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments/resolver"
+	"github.com/google/uuid"
+	"sync"
+	"time"
+)
+
+// HandlerFactory builds the provider handlers for a payment
+type HandlerFactory func(state ActualState) (PartnerHandler, UserHandler, error)
+
+// Result is the outcome of resolving a desired state
+type Result struct {
+	Commands []resolver.PaymentCommand
+	Errors   []error
+}
+
+type job struct {
+	ctx    context.Context
+	state  resolver.DesiredState
+	result chan Result
+}
+
+// managedHandler is a handler along with the desired states waiting to be resolved by it
+type managedHandler struct {
+	handler *handler
+	queue   []job
+	// scheduled is true while the handler is waiting for, or being worked on by, a worker
+	scheduled bool
+	lastUsed  time.Time
+}
+
+// Manager routes desired states to the handler for their ExternalID, loading handlers from storage as needed.  Work
+// for a handler is serialized, and handlers are worked on in parallel by a fixed number of workers.
+type Manager struct {
+	store          StateStore
+	factory        HandlerFactory
+	handlerOptions []Option
+	clock          clock.Clock
+	workers        int
+	idleTimeout    time.Duration
+
+	lock     sync.Mutex
+	ready    *sync.Cond
+	handlers map[uuid.UUID]*managedHandler
+	// pending are the handlers which have work, in the order they should be worked on
+	pending []*managedHandler
+	closed  bool
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+type ManagerOption func(m *Manager)
+
+const DefaultWorkers = 16
+
+// WithWorkers sets how many handlers can be worked on at once
+func WithWorkers(n int) ManagerOption {
+	return func(m *Manager) {
+		m.workers = n
+	}
+}
+
+// WithIdleTimeout evicts handlers which have not been used for d.  By default, handlers are never evicted.
+func WithIdleTimeout(d time.Duration) ManagerOption {
+	return func(m *Manager) {
+		m.idleTimeout = d
+	}
+}
+
+func WithManagerClock(c clock.Clock) ManagerOption {
+	return func(m *Manager) {
+		m.clock = c
+	}
+}
+
+// WithHandlerOptions sets the options every handler is created with
+func WithHandlerOptions(opts ...Option) ManagerOption {
+	return func(m *Manager) {
+		m.handlerOptions = append(m.handlerOptions, opts...)
+	}
+}
+
+func NewManager(store StateStore, factory HandlerFactory, opts ...ManagerOption) *Manager {
+	m := &Manager{
+		store:    store,
+		factory:  factory,
+		clock:    clock.System,
+		workers:  DefaultWorkers,
+		handlers: make(map[uuid.UUID]*managedHandler),
+		done:     make(chan struct{}),
+	}
+	m.ready = sync.NewCond(&m.lock)
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.workers < 1 {
+		m.workers = 1
+	}
+	m.wg.Add(m.workers)
+	for i := 0; i < m.workers; i++ {
+		go m.work()
+	}
+	if m.idleTimeout > 0 {
+		m.wg.Add(1)
+		go m.evictIdle()
+	}
+	return m
+}
+
+// Submit queues d to be resolved by the handler for its ExternalID.  The result is sent on the returned channel.
+func (m *Manager) Submit(ctx context.Context, d resolver.DesiredState) <-chan Result {
+	result := make(chan Result, 1)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		result <- Result{Errors: []error{errors.ErrManagerClosed}}
+		return result
+	}
+	mh, ok := m.handlers[d.ExternalID]
+	if !ok {
+		mh = &managedHandler{}
+		m.handlers[d.ExternalID] = mh
+	}
+	mh.queue = append(mh.queue, job{
+		ctx:    ctx,
+		state:  d,
+		result: result,
+	})
+	if !mh.scheduled {
+		mh.scheduled = true
+		m.pending = append(m.pending, mh)
+		m.ready.Signal()
+	}
+	return result
+}
+
+// Apply resolves d with the handler for its ExternalID, and waits for the result
+func (m *Manager) Apply(ctx context.Context, d resolver.DesiredState) ([]resolver.PaymentCommand, []error) {
+	select {
+	case result := <-m.Submit(ctx, d):
+		return result.Commands, result.Errors
+	case <-ctx.Done():
+		return nil, []error{ctx.Err()}
+	}
+}
+
+// Len returns how many handlers are loaded
+func (m *Manager) Len() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.handlers)
+}
+
+// Evict unloads handlers which have no work and have been idle for the idle timeout, and returns how many it unloaded
+func (m *Manager) Evict() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := m.clock.Now()
+	evicted := 0
+	for id, mh := range m.handlers {
+		if !mh.scheduled && now.Sub(mh.lastUsed) >= m.idleTimeout {
+			delete(m.handlers, id)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// Close stops the workers once the work already submitted is done
+func (m *Manager) Close() {
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		return
+	}
+	m.closed = true
+	close(m.done)
+	m.ready.Broadcast()
+	m.lock.Unlock()
+	m.wg.Wait()
+}
+
+func (m *Manager) evictIdle() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(m.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			m.Evict()
+		}
+	}
+}
+
+func (m *Manager) work() {
+	defer m.wg.Done()
+	for {
+		m.lock.Lock()
+		for len(m.pending) == 0 && !m.closed {
+			m.ready.Wait()
+		}
+		if len(m.pending) == 0 {
+			m.lock.Unlock()
+			return
+		}
+		mh := m.pending[0]
+		m.pending = m.pending[1:]
+		next := mh.queue[0]
+		mh.queue = mh.queue[1:]
+		m.lock.Unlock()
+
+		next.result <- m.resolve(mh, next)
+
+		m.lock.Lock()
+		mh.lastUsed = m.clock.Now()
+		if len(mh.queue) > 0 {
+			// Go to the back of the line, so that a busy handler cannot starve the others
+			m.pending = append(m.pending, mh)
+			m.ready.Signal()
+		} else {
+			mh.scheduled = false
+		}
+		m.lock.Unlock()
+	}
+}
+
+func (m *Manager) resolve(mh *managedHandler, j job) Result {
+	if err := j.ctx.Err(); err != nil {
+		return Result{Errors: []error{err}}
+	}
+	if mh.handler == nil {
+		h, err := m.load(j.state)
+		if err != nil {
+			return Result{Errors: []error{err}}
+		}
+		mh.handler = h
+	}
+	cmds, errs := mh.handler.Resolve(j.ctx, j.state)
+	return Result{
+		Commands: cmds,
+		Errors:   errs,
+	}
+}
+
+// load builds the handler for d's ExternalID from its stored state, or from scratch if it has none
+func (m *Manager) load(d resolver.DesiredState) (*handler, error) {
+	state, err := m.store.Load(d.ExternalID)
+	if errors.Is(err, errors.ErrStateNotFound) {
+		state = ActualState{
+			DesiredState: resolver.DesiredState{
+				ID:         uuid.New(),
+				ExternalID: d.ExternalID,
+				UserID:     d.UserID,
+				PartnerID:  d.PartnerID,
+				Bucket:     d.Bucket,
+			},
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	partner, user, err := m.factory(state)
+	if err != nil {
+		return nil, err
+	}
+	opts := append([]Option{WithStateStore(m.store)}, m.handlerOptions...)
+	h := NewHandler(&state, partner, user, opts...)
+	// The workers already bound how many provider calls are made at once
+	h.execute = func(fn func()) {
+		fn()
+	}
+	return h, nil
+}
@@ -0,0 +1,187 @@
+package payments_test
+
+import (
+	"context"
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments"
+	"github.com/davidjwilkins/declarative-payments/payments/handlers"
+	"github.com/davidjwilkins/declarative-payments/payments/resolver"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingUser tracks how many calls are in flight at once
+type countingUser struct {
+	payments.UserHandler
+	lock     sync.Mutex
+	inFlight int
+	max      int
+}
+
+func (c *countingUser) Charge(idempotencyKey string, amount uint) error {
+	c.lock.Lock()
+	c.inFlight++
+	if c.inFlight > c.max {
+		c.max = c.inFlight
+	}
+	c.lock.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	c.lock.Lock()
+	c.inFlight--
+	c.lock.Unlock()
+	return c.UserHandler.Charge(idempotencyKey, amount)
+}
+
+func desiredState(externalID, userID, partnerID uuid.UUID, amount int) resolver.DesiredState {
+	return resolver.DesiredState{
+		ID:         uuid.New(),
+		ExternalID: externalID,
+		UserID:     userID,
+		PartnerID:  partnerID,
+		Date:       time.Now(),
+		Bucket:     "test",
+		Amount:     amount,
+	}
+}
+
+func TestManager(t *testing.T) {
+	ctx := context.Background()
+	type balancer interface {
+		Balance() int
+	}
+	mockFactory := func(users map[uuid.UUID]balancer) payments.HandlerFactory {
+		var lock sync.Mutex
+		return func(state payments.ActualState) (payments.PartnerHandler, payments.UserHandler, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			user := handlers.NewUserMock()
+			users[state.ExternalID] = user
+			return handlers.NewPartnerMock(), user, nil
+		}
+	}
+	t.Run("Creates handlers for new payments", func(t *testing.T) {
+		store := payments.NewMemoryStateStore()
+		users := make(map[uuid.UUID]balancer)
+		m := payments.NewManager(store, mockFactory(users))
+		defer m.Close()
+		d := desiredState(uuid.New(), uuid.New(), uuid.New(), 1000)
+		cmds, errs := m.Apply(ctx, d)
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, 1, len(cmds))
+		assert.Equal(t, 1, m.Len())
+		stored, err := store.Load(d.ExternalID)
+		assert.NoError(t, err)
+		assert.Equal(t, 1000, stored.Amount)
+		assert.Equal(t, d.UserID, stored.UserID)
+	})
+	t.Run("Loads handlers from storage", func(t *testing.T) {
+		store := payments.NewMemoryStateStore()
+		d := desiredState(uuid.New(), uuid.New(), uuid.New(), 1000)
+		assert.NoError(t, store.Save(payments.ActualState{
+			DesiredState: resolver.DesiredState{
+				ID:         uuid.New(),
+				ExternalID: d.ExternalID,
+				UserID:     d.UserID,
+				PartnerID:  d.PartnerID,
+				Date:       time.Now().Add(-time.Hour),
+				Bucket:     d.Bucket,
+				Amount:     400,
+			},
+			Version: 3,
+		}, 0))
+		users := make(map[uuid.UUID]balancer)
+		m := payments.NewManager(store, mockFactory(users))
+		defer m.Close()
+		cmds, errs := m.Apply(ctx, d)
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, 1, len(cmds))
+		assert.Equal(t, uint(600), cmds[0].Amount, "Only the difference from the stored state is charged")
+		stored, err := store.Load(d.ExternalID)
+		assert.NoError(t, err)
+		assert.Equal(t, 1000, stored.Amount)
+		assert.Equal(t, uint64(5), stored.Version, "The run claims one version, and saves its outcome as the next")
+	})
+	t.Run("Routes to the same handler by ExternalID", func(t *testing.T) {
+		store := payments.NewMemoryStateStore()
+		users := make(map[uuid.UUID]balancer)
+		m := payments.NewManager(store, mockFactory(users))
+		defer m.Close()
+		d := desiredState(uuid.New(), uuid.New(), uuid.New(), 1000)
+		other := desiredState(uuid.New(), uuid.New(), uuid.New(), 500)
+		var wg sync.WaitGroup
+		wg.Add(100)
+		for i := 0; i < 100; i++ {
+			go func(i int) {
+				defer wg.Done()
+				next := d
+				next.ID = uuid.New()
+				next.Amount = 10 * (i + 1)
+				if i%2 == 0 {
+					next = other
+				}
+				_, errs := m.Apply(ctx, next)
+				assert.Equal(t, 0, len(errs))
+			}(i)
+		}
+		wg.Wait()
+		assert.Equal(t, 2, m.Len())
+		assert.Equal(t, 2, len(users), "Handlers are only created once")
+		for _, id := range []uuid.UUID{d.ExternalID, other.ExternalID} {
+			stored, err := store.Load(id)
+			assert.NoError(t, err)
+			assert.Equal(t, stored.Amount, users[id].Balance(), "Work is serialized per handler")
+		}
+	})
+	t.Run("Bounds the number of workers", func(t *testing.T) {
+		store := payments.NewMemoryStateStore()
+		counter := &countingUser{UserHandler: handlers.NewUserMock()}
+		m := payments.NewManager(store, func(state payments.ActualState) (payments.PartnerHandler, payments.UserHandler, error) {
+			return handlers.NewPartnerMock(), counter, nil
+		}, payments.WithWorkers(2))
+		defer m.Close()
+		var results []<-chan payments.Result
+		for i := 0; i < 10; i++ {
+			results = append(results, m.Submit(ctx, desiredState(uuid.New(), uuid.New(), uuid.New(), 100)))
+		}
+		for _, result := range results {
+			assert.Equal(t, 0, len((<-result).Errors))
+		}
+		assert.Equal(t, 2, counter.max, "Handlers are worked on in parallel, up to the number of workers")
+	})
+	t.Run("Evicts idle handlers", func(t *testing.T) {
+		c := clock.NewMock(time.Now())
+		users := make(map[uuid.UUID]balancer)
+		m := payments.NewManager(payments.NewMemoryStateStore(), mockFactory(users), payments.WithManagerClock(c), payments.WithIdleTimeout(time.Hour))
+		defer m.Close()
+		d := desiredState(uuid.New(), uuid.New(), uuid.New(), 1000)
+		_, errs := m.Apply(ctx, d)
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, 0, m.Evict(), "Recently used handlers are not evicted")
+		c.Advance(time.Hour)
+		assert.Equal(t, 1, m.Evict())
+		assert.Equal(t, 0, m.Len())
+		d.ID = uuid.New()
+		d.Amount = 1500
+		cmds, errs := m.Apply(ctx, d)
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, uint(500), cmds[0].Amount, "Evicted handlers are reloaded from storage")
+	})
+	t.Run("Factory errors are returned", func(t *testing.T) {
+		m := payments.NewManager(payments.NewMemoryStateStore(), func(state payments.ActualState) (payments.PartnerHandler, payments.UserHandler, error) {
+			return nil, nil, errors.ErrDifferentBucket
+		})
+		defer m.Close()
+		_, errs := m.Apply(ctx, desiredState(uuid.New(), uuid.New(), uuid.New(), 1000))
+		assert.Equal(t, []error{errors.ErrDifferentBucket}, errs)
+	})
+	t.Run("Cannot submit once closed", func(t *testing.T) {
+		m := payments.NewManager(payments.NewMemoryStateStore(), mockFactory(make(map[uuid.UUID]balancer)))
+		m.Close()
+		_, errs := m.Apply(ctx, desiredState(uuid.New(), uuid.New(), uuid.New(), 1000))
+		assert.Equal(t, []error{errors.ErrManagerClosed}, errs)
+	})
+}
@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// CircuitBreaker stops calls to a provider account after consecutive retryable failures.  While it is open, calls fail
+// immediately with errors.ErrCircuitOpen.  Once the cooldown has passed, a single trial call is let through, which
+// closes the breaker if it succeeds.
+type CircuitBreaker struct {
+	lock      sync.Mutex
+	clock     clock.Clock
+	threshold int
+	cooldown  time.Duration
+	state     breakerState
+	failures  int
+	openedAt  time.Time
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration, c clock.Clock) *CircuitBreaker {
+	return &CircuitBreaker{
+		clock:     c,
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Open reports whether calls are currently being refused
+func (b *CircuitBreaker) Open() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state != breakerClosed
+}
+
+func (b *CircuitBreaker) allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.clock.Now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		// The trial call is still in flight
+		return false
+	}
+	return true
+}
+
+func (b *CircuitBreaker) record(err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err == nil || !errors.Is(err, errors.ErrRetryable) {
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = b.clock.Now()
+	}
+}
+
+// Middleware refuses calls while the breaker is open
+func (b *CircuitBreaker) Middleware(call func() error) error {
+	if !b.allow() {
+		return errors.ErrCircuitOpen
+	}
+	err := call()
+	b.record(err)
+	return err
+}
@@ -0,0 +1,90 @@
+package middleware_test
+
+import (
+	"fmt"
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments"
+	"github.com/davidjwilkins/declarative-payments/payments/handlers"
+	"github.com/davidjwilkins/declarative-payments/payments/middleware"
+	"github.com/davidjwilkins/declarative-payments/payments/resolver"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	retryable := fmt.Errorf("Internal Server Error - %w", errors.ErrRetryable)
+	t.Run("Opens after consecutive retryable failures", func(t *testing.T) {
+		c := clock.NewMock(time.Now())
+		breaker := middleware.NewCircuitBreaker(2, time.Minute, c)
+		m := handlers.NewUserMock()
+		u := middleware.User(m, breaker.Middleware)
+		m.ShouldErr("a", retryable)
+		assert.Error(t, u.Charge("a", 100))
+		assert.False(t, breaker.Open())
+		m.ShouldErr("b", retryable)
+		assert.Error(t, u.Charge("b", 100))
+		assert.True(t, breaker.Open())
+		err := u.Charge("c", 100)
+		assert.True(t, errors.Is(err, errors.ErrCircuitOpen), "Calls are refused while open")
+		assert.True(t, errors.Is(err, errors.ErrRetryable), "Refused calls can be retried")
+		assert.Equal(t, 0, m.Balance(), "Refused calls are not made")
+	})
+	t.Run("Non-retryable failures do not open it", func(t *testing.T) {
+		breaker := middleware.NewCircuitBreaker(1, time.Minute, clock.System)
+		m := handlers.NewUserMock()
+		u := middleware.User(m, breaker.Middleware)
+		m.ShouldErr("a", errors.ErrChargeFailed)
+		assert.Error(t, u.Charge("a", 100))
+		assert.False(t, breaker.Open())
+	})
+	t.Run("Success resets the count", func(t *testing.T) {
+		breaker := middleware.NewCircuitBreaker(2, time.Minute, clock.System)
+		m := handlers.NewUserMock()
+		u := middleware.User(m, breaker.Middleware)
+		m.ShouldErr("a", retryable)
+		assert.Error(t, u.Charge("a", 100))
+		assert.NoError(t, u.Charge("b", 100))
+		m.ShouldErr("c", retryable)
+		assert.Error(t, u.Charge("c", 100))
+		assert.False(t, breaker.Open())
+	})
+	t.Run("Trial call after cooldown", func(t *testing.T) {
+		c := clock.NewMock(time.Now())
+		breaker := middleware.NewCircuitBreaker(1, time.Minute, c)
+		m := handlers.NewPartnerMock()
+		p := middleware.Partner(m, breaker.Middleware)
+		m.ShouldErr("a", retryable)
+		assert.Error(t, p.Deposit("a", 100))
+		c.Advance(time.Minute)
+		m.ShouldErr("b", retryable)
+		assert.Error(t, p.Deposit("b", 100))
+		assert.True(t, errors.Is(p.Deposit("c", 100), errors.ErrCircuitOpen), "A failed trial reopens the breaker")
+		c.Advance(time.Minute)
+		assert.NoError(t, p.Deposit("d", 100))
+		assert.False(t, breaker.Open(), "A successful trial closes the breaker")
+		assert.Equal(t, 100, m.Balance())
+	})
+	t.Run("Run marks refused commands as errors", func(t *testing.T) {
+		c := clock.NewMock(time.Now())
+		breaker := middleware.NewCircuitBreaker(1, time.Minute, c)
+		m := handlers.NewUserMock()
+		as := payments.ActualState{
+			DesiredState: resolver.DesiredState{
+				ID:         uuid.New(),
+				ExternalID: uuid.New(),
+				Bucket:     "test",
+			},
+		}
+		h := payments.NewHandler(&as, handlers.NewPartnerMock(), middleware.User(m, breaker.Middleware))
+		m.ShouldErr("a", retryable)
+		assert.Error(t, middleware.User(m, breaker.Middleware).Charge("a", 100))
+		cmds, errs := h.Run([]resolver.PaymentCommand{as.Charge(100)})
+		assert.Equal(t, 1, len(errs))
+		assert.Equal(t, consts.PaymentCommandStatusError, cmds[0].Status)
+		assert.Equal(t, 0, m.Balance())
+	})
+}
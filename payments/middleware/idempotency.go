@@ -0,0 +1,298 @@
+package middleware
+
+import (
+	"fmt"
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments"
+	"sort"
+	"sync"
+	"time"
+)
+
+const DefaultResultTTL = 24 * time.Hour
+
+// Result is the outcome of a provider call, kept so that it can be replayed
+type Result struct {
+	Amount  uint      `json:"amount"`
+	Error   string    `json:"error"`
+	Expires time.Time `json:"expires"`
+}
+
+func (r Result) err() error {
+	if r.Error == "" {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", errors.ErrReplayedFailure, r.Error)
+}
+
+// ResultStore persists Results by key.  It must be safe for concurrent use.
+type ResultStore interface {
+	Load(key string) (Result, bool, error)
+	Save(key string, result Result) error
+}
+
+type memoryResultStore struct {
+	lock    sync.Mutex
+	clock   clock.Clock
+	results map[string]Result
+}
+
+// NewMemoryResultStore returns a ResultStore which forgets results once they expire by c
+func NewMemoryResultStore(c clock.Clock) *memoryResultStore {
+	return &memoryResultStore{
+		clock:   c,
+		results: make(map[string]Result),
+	}
+}
+
+func (m *memoryResultStore) Load(key string) (Result, bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	result, ok := m.results[key]
+	if ok && !m.clock.Now().Before(result.Expires) {
+		delete(m.results, key)
+		return Result{}, false, nil
+	}
+	return result, ok, nil
+}
+
+func (m *memoryResultStore) Save(key string, result Result) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := m.clock.Now()
+	for k, r := range m.results {
+		if !now.Before(r.Expires) {
+			delete(m.results, k)
+		}
+	}
+	m.results[key] = result
+	return nil
+}
+
+// keyLocks serializes calls with the same key
+type keyLocks struct {
+	lock sync.Mutex
+	keys map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	users int
+}
+
+// acquire locks keys in order, and returns a function to unlock them
+func (k *keyLocks) acquire(keys ...string) (release func()) {
+	sort.Strings(keys)
+	var held []*keyLock
+	for _, key := range keys {
+		k.lock.Lock()
+		if k.keys == nil {
+			k.keys = make(map[string]*keyLock)
+		}
+		l, ok := k.keys[key]
+		if !ok {
+			l = &keyLock{}
+			k.keys[key] = l
+		}
+		l.users++
+		k.lock.Unlock()
+		l.Lock()
+		held = append(held, l)
+	}
+	return func() {
+		for i, l := range held {
+			l.Unlock()
+			k.lock.Lock()
+			l.users--
+			if l.users == 0 {
+				delete(k.keys, keys[i])
+			}
+			k.lock.Unlock()
+		}
+	}
+}
+
+// Idempotency keeps the result of every provider call made through a wrapped handler, and returns it again when a call
+// is retried with the same idempotency key, rather than relying on the provider to.  Providers do not always return the
+// original amount when a partly successful call is retried.
+//
+// Calls which fail with a retryable error are not kept, so they are made again.  Failures which are replayed match
+// errors.ErrReplayedFailure.
+type Idempotency struct {
+	store ResultStore
+	ttl   time.Duration
+	clock clock.Clock
+	locks keyLocks
+}
+
+// NewIdempotency keeps results in store for ttl
+func NewIdempotency(store ResultStore, ttl time.Duration, c clock.Clock) *Idempotency {
+	if ttl <= 0 {
+		ttl = DefaultResultTTL
+	}
+	return &Idempotency{
+		store: store,
+		ttl:   ttl,
+		clock: c,
+	}
+}
+
+// load returns the result kept for key, if it has not expired
+func (i *Idempotency) load(key string) (Result, bool, error) {
+	result, ok, err := i.store.Load(key)
+	if err != nil || !ok || !i.clock.Now().Before(result.Expires) {
+		return Result{}, false, err
+	}
+	return result, true, nil
+}
+
+// save keeps the result of a call, unless it can be retried.  The result is returned either way; if it cannot be kept,
+// the call will be made again if it is retried, as it would be without Idempotency.
+func (i *Idempotency) save(key string, amount uint, err error) {
+	if errors.Is(err, errors.ErrRetryable) {
+		return
+	}
+	result := Result{Amount: amount, Expires: i.clock.Now().Add(i.ttl)}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	_ = i.store.Save(key, result)
+}
+
+// do returns the result kept for key, or makes call and keeps its result
+func (i *Idempotency) do(key string, call func() (uint, error)) (uint, error) {
+	defer i.locks.acquire(key)()
+	result, ok, err := i.load(key)
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		return result.Amount, result.err()
+	}
+	amount, err := call()
+	i.save(key, amount, err)
+	return amount, err
+}
+
+// User wraps next so that its results are replayed
+func (i *Idempotency) User(next payments.UserHandler) payments.UserHandler {
+	return &idempotentUser{optional: optional{next}, next: next, idempotency: i}
+}
+
+// Partner wraps next so that its results are replayed
+func (i *Idempotency) Partner(next payments.PartnerHandler) payments.PartnerHandler {
+	return &idempotentPartner{next: next, idempotency: i}
+}
+
+type idempotentUser struct {
+	optional
+	next        payments.UserHandler
+	idempotency *Idempotency
+}
+
+type idempotentPartner struct {
+	next        payments.PartnerHandler
+	idempotency *Idempotency
+}
+
+// noAmount adapts a call which returns no amount
+func noAmount(call func() error) func() (uint, error) {
+	return func() (uint, error) {
+		return 0, call()
+	}
+}
+
+func (u *idempotentUser) Authorize(idempotencyKey string, amount uint) error {
+	_, err := u.idempotency.do("authorize:"+idempotencyKey, noAmount(func() error {
+		return u.next.Authorize(idempotencyKey, amount)
+	}))
+	return err
+}
+
+func (u *idempotentUser) IncrementAuthorization(idempotencyKey string, amount uint) error {
+	_, err := u.idempotency.do("authorize:"+idempotencyKey, noAmount(func() error {
+		return incrementAuthorization(u.next, idempotencyKey, amount)
+	}))
+	return err
+}
+
+func (u *idempotentUser) Capture(idempotencyKey string, amount uint) (uint, error) {
+	return u.idempotency.do("capture:"+idempotencyKey, func() (uint, error) {
+		return u.next.Capture(idempotencyKey, amount)
+	})
+}
+
+func (u *idempotentUser) MultiCapture(idempotencyKey string, amount uint) (uint, error) {
+	return u.idempotency.do("capture:"+idempotencyKey, func() (uint, error) {
+		return multiCapture(u.next, idempotencyKey, amount)
+	})
+}
+
+func (u *idempotentUser) Release(idempotencyKey string, amount uint) (uint, error) {
+	return u.idempotency.do("release:"+idempotencyKey, func() (uint, error) {
+		return u.next.Release(idempotencyKey, amount)
+	})
+}
+
+// CaptureRelease replays both results if both were kept.  Otherwise, both are made again, relying on the provider's own
+// idempotency for the one which was kept, whose kept result is returned.
+func (u *idempotentUser) CaptureRelease(captureKey string, capture uint, releaseKey string, release uint) (uint, error, uint, error) {
+	i := u.idempotency
+	captureResultKey, releaseResultKey := "capture:"+captureKey, "release:"+releaseKey
+	defer i.locks.acquire(captureResultKey, releaseResultKey)()
+	captureResult, captureOK, err := i.load(captureResultKey)
+	if err != nil {
+		return 0, err, 0, err
+	}
+	releaseResult, releaseOK, err := i.load(releaseResultKey)
+	if err != nil {
+		return 0, err, 0, err
+	}
+	if captureOK && releaseOK {
+		return captureResult.Amount, captureResult.err(), releaseResult.Amount, releaseResult.err()
+	}
+	captured, captureErr, released, releaseErr := u.next.CaptureRelease(captureKey, capture, releaseKey, release)
+	if captureOK {
+		captured, captureErr = captureResult.Amount, captureResult.err()
+	} else {
+		i.save(captureResultKey, captured, captureErr)
+	}
+	if releaseOK {
+		released, releaseErr = releaseResult.Amount, releaseResult.err()
+	} else {
+		i.save(releaseResultKey, released, releaseErr)
+	}
+	return captured, captureErr, released, releaseErr
+}
+
+func (u *idempotentUser) Charge(idempotencyKey string, amount uint) error {
+	_, err := u.idempotency.do("charge:"+idempotencyKey, noAmount(func() error {
+		return u.next.Charge(idempotencyKey, amount)
+	}))
+	return err
+}
+
+func (u *idempotentUser) Refund(idempotencyKey string, amount uint) (uint, error) {
+	return u.idempotency.do("refund:"+idempotencyKey, func() (uint, error) {
+		return u.next.Refund(idempotencyKey, amount)
+	})
+}
+
+func (p *idempotentPartner) Deposit(idempotencyKey string, amount uint) error {
+	_, err := p.idempotency.do("deposit:"+idempotencyKey, noAmount(func() error {
+		return p.next.Deposit(idempotencyKey, amount)
+	}))
+	return err
+}
+
+func (p *idempotentPartner) Withdraw(idempotencyKey string, amount uint) error {
+	_, err := p.idempotency.do("withdraw:"+idempotencyKey, noAmount(func() error {
+		return p.next.Withdraw(idempotencyKey, amount)
+	}))
+	return err
+}
+
+func (p *idempotentPartner) Annotate(idempotencyKey string, metadata map[string]string) {
+	annotatePartner(p.next, idempotencyKey, metadata)
+}
@@ -0,0 +1,139 @@
+package middleware_test
+
+import (
+	"fmt"
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments"
+	"github.com/davidjwilkins/declarative-payments/payments/handlers"
+	"github.com/davidjwilkins/declarative-payments/payments/middleware"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+// forgetfulUser is a provider which reports nothing captured or released when a call is retried
+type forgetfulUser struct {
+	payments.UserHandler
+	lock  sync.Mutex
+	calls map[string]int
+}
+
+func (f *forgetfulUser) called(key string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls[key]++
+	return f.calls[key] > 1
+}
+
+func (f *forgetfulUser) Capture(idempotencyKey string, amount uint) (uint, error) {
+	captured, err := f.UserHandler.Capture(idempotencyKey, amount)
+	if f.called(idempotencyKey) {
+		return 0, err
+	}
+	return captured, err
+}
+
+func (f *forgetfulUser) CaptureRelease(captureKey string, capture uint, releaseKey string, release uint) (uint, error, uint, error) {
+	captured, captureErr, released, releaseErr := f.UserHandler.CaptureRelease(captureKey, capture, releaseKey, release)
+	if f.called(captureKey) {
+		return 0, captureErr, 0, releaseErr
+	}
+	return captured, captureErr, released, releaseErr
+}
+
+type mockUser interface {
+	payments.UserHandler
+	ShouldErr(key string, err error)
+	Balance() int
+}
+
+func TestIdempotency(t *testing.T) {
+	setup := func() (*clock.Mock, mockUser, payments.UserHandler) {
+		c := clock.NewMock(time.Now())
+		m := handlers.NewUserMock()
+		f := &forgetfulUser{UserHandler: m, calls: make(map[string]int)}
+		idempotency := middleware.NewIdempotency(middleware.NewMemoryResultStore(c), time.Hour, c)
+		return c, m, idempotency.User(f)
+	}
+	t.Run("Replays the original amount", func(t *testing.T) {
+		_, m, u := setup()
+		assert.NoError(t, u.Authorize("authorize", 1000))
+		captured, err := u.Capture("capture", 400)
+		assert.NoError(t, err)
+		assert.Equal(t, uint(400), captured)
+		captured, err = u.Capture("capture", 400)
+		assert.NoError(t, err)
+		assert.Equal(t, uint(400), captured, "The provider would report 0")
+		assert.Equal(t, 400, m.Balance())
+	})
+	t.Run("Replays failures", func(t *testing.T) {
+		_, m, u := setup()
+		m.ShouldErr("charge", errors.ErrChargeFailed)
+		assert.Error(t, u.Charge("charge", 100))
+		err := u.Charge("charge", 100)
+		assert.True(t, errors.Is(err, errors.ErrReplayedFailure))
+		assert.Contains(t, err.Error(), errors.ErrChargeFailed.Error())
+		assert.Equal(t, 0, m.Balance(), "The call is not made again")
+	})
+	t.Run("Retryable failures are made again", func(t *testing.T) {
+		_, m, u := setup()
+		m.ShouldErr("charge", fmt.Errorf("Internal Server Error - %w", errors.ErrRetryable))
+		assert.Error(t, u.Charge("charge", 100))
+		assert.NoError(t, u.Charge("charge", 100))
+		assert.Equal(t, 100, m.Balance())
+	})
+	t.Run("Results expire", func(t *testing.T) {
+		c, _, u := setup()
+		assert.NoError(t, u.Authorize("authorize", 1000))
+		_, err := u.Capture("capture", 400)
+		assert.NoError(t, err)
+		c.Advance(time.Hour)
+		captured, err := u.Capture("capture", 400)
+		assert.NoError(t, err)
+		assert.Equal(t, uint(0), captured, "Once expired, the provider is relied on")
+	})
+	t.Run("Keys are kept apart by action", func(t *testing.T) {
+		_, _, u := setup()
+		assert.NoError(t, u.Charge("key", 100))
+		refunded, err := u.Refund("key", 100)
+		assert.NoError(t, err)
+		assert.Equal(t, uint(100), refunded, "The charge's result is not replayed for the refund")
+	})
+	t.Run("Replays capture-releases", func(t *testing.T) {
+		_, _, u := setup()
+		assert.NoError(t, u.Authorize("authorize", 1000))
+		captured, captureErr, released, releaseErr := u.CaptureRelease("capture", 400, "release", 100)
+		assert.NoError(t, captureErr)
+		assert.NoError(t, releaseErr)
+		captured, captureErr, released, releaseErr = u.CaptureRelease("capture", 400, "release", 100)
+		assert.NoError(t, captureErr)
+		assert.NoError(t, releaseErr)
+		assert.Equal(t, uint(400), captured)
+		assert.Equal(t, uint(100), released)
+	})
+	t.Run("Replays a partner's failures", func(t *testing.T) {
+		c := clock.NewMock(time.Now())
+		m := handlers.NewPartnerMock()
+		p := middleware.NewIdempotency(middleware.NewMemoryResultStore(c), 0, c).Partner(m)
+		m.ShouldErr("deposit", errors.ErrChargeFailed)
+		assert.Error(t, p.Deposit("deposit", 100))
+		assert.True(t, errors.Is(p.Deposit("deposit", 100), errors.ErrReplayedFailure))
+		assert.Equal(t, 0, m.Balance())
+	})
+}
+
+func TestMemoryResultStore(t *testing.T) {
+	c := clock.NewMock(time.Now())
+	store := middleware.NewMemoryResultStore(c)
+	assert.NoError(t, store.Save("a", middleware.Result{Amount: 1, Expires: c.Now().Add(time.Minute)}))
+	result, ok, err := store.Load("a")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, uint(1), result.Amount)
+	c.Advance(time.Minute)
+	_, ok, err = store.Load("a")
+	assert.NoError(t, err)
+	assert.False(t, ok, "Expired results are forgotten")
+}
@@ -0,0 +1,175 @@
+package middleware
+
+import (
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/payments"
+)
+
+// Middleware wraps every provider call made through a wrapped handler
+type Middleware func(call func() error) error
+
+type user struct {
+	optional
+	next       payments.UserHandler
+	middleware Middleware
+}
+
+type partner struct {
+	next       payments.PartnerHandler
+	middleware Middleware
+}
+
+// optional passes on the optional interfaces of a wrapped UserHandler, so that wrapping it does not change how commands
+// are planned for it, or what it is told about them
+type optional struct {
+	next payments.UserHandler
+}
+
+func (o optional) Capabilities() []consts.Capability {
+	return payments.Capabilities(o.next)
+}
+
+func (o optional) Annotate(idempotencyKey string, metadata map[string]string) {
+	if annotator, ok := o.next.(payments.Annotator); ok {
+		annotator.Annotate(idempotencyKey, metadata)
+	}
+}
+
+// incrementAuthorization increments with next if it can, and authorizes otherwise
+func incrementAuthorization(next payments.UserHandler, idempotencyKey string, amount uint) error {
+	if incremental, ok := next.(payments.IncrementalAuthorizer); ok {
+		return incremental.IncrementAuthorization(idempotencyKey, amount)
+	}
+	return next.Authorize(idempotencyKey, amount)
+}
+
+// multiCapture multicaptures with next if it can, and captures otherwise
+func multiCapture(next payments.UserHandler, idempotencyKey string, amount uint) (uint, error) {
+	if multi, ok := next.(payments.MultiCapturer); ok {
+		return multi.MultiCapture(idempotencyKey, amount)
+	}
+	return next.Capture(idempotencyKey, amount)
+}
+
+// annotatePartner passes metadata on to next, if it takes it
+func annotatePartner(next payments.PartnerHandler, idempotencyKey string, metadata map[string]string) {
+	if annotator, ok := next.(payments.Annotator); ok {
+		annotator.Annotate(idempotencyKey, metadata)
+	}
+}
+
+// chain applies middleware in order, so the first is outermost
+func chain(middleware []Middleware) Middleware {
+	return func(call func() error) error {
+		wrapped := call
+		for i := len(middleware) - 1; i >= 0; i-- {
+			mw, next := middleware[i], wrapped
+			wrapped = func() error {
+				return mw(next)
+			}
+		}
+		return wrapped()
+	}
+}
+
+func User(next payments.UserHandler, middleware ...Middleware) payments.UserHandler {
+	return &user{
+		optional:   optional{next},
+		next:       next,
+		middleware: chain(middleware),
+	}
+}
+
+func Partner(next payments.PartnerHandler, middleware ...Middleware) payments.PartnerHandler {
+	return &partner{
+		next:       next,
+		middleware: chain(middleware),
+	}
+}
+
+func (u *user) Authorize(idempotencyKey string, amount uint) error {
+	return u.middleware(func() error {
+		return u.next.Authorize(idempotencyKey, amount)
+	})
+}
+
+func (u *user) IncrementAuthorization(idempotencyKey string, amount uint) error {
+	return u.middleware(func() error {
+		return incrementAuthorization(u.next, idempotencyKey, amount)
+	})
+}
+
+func (u *user) Capture(idempotencyKey string, amount uint) (uint, error) {
+	var captured uint
+	err := u.middleware(func() (err error) {
+		captured, err = u.next.Capture(idempotencyKey, amount)
+		return err
+	})
+	return captured, err
+}
+
+func (u *user) MultiCapture(idempotencyKey string, amount uint) (uint, error) {
+	var captured uint
+	err := u.middleware(func() (err error) {
+		captured, err = multiCapture(u.next, idempotencyKey, amount)
+		return err
+	})
+	return captured, err
+}
+
+func (u *user) Release(idempotencyKey string, amount uint) (uint, error) {
+	var released uint
+	err := u.middleware(func() (err error) {
+		released, err = u.next.Release(idempotencyKey, amount)
+		return err
+	})
+	return released, err
+}
+
+func (u *user) CaptureRelease(captureKey string, capture uint, releaseKey string, release uint) (uint, error, uint, error) {
+	var captured, released uint
+	var captureErr, releaseErr error
+	err := u.middleware(func() error {
+		captured, captureErr, released, releaseErr = u.next.CaptureRelease(captureKey, capture, releaseKey, release)
+		if captureErr != nil {
+			return captureErr
+		}
+		return releaseErr
+	})
+	// The call was never made
+	if err != nil && captureErr == nil && releaseErr == nil {
+		return 0, err, 0, err
+	}
+	return captured, captureErr, released, releaseErr
+}
+
+func (u *user) Charge(idempotencyKey string, amount uint) error {
+	return u.middleware(func() error {
+		return u.next.Charge(idempotencyKey, amount)
+	})
+}
+
+func (u *user) Refund(idempotencyKey string, amount uint) (uint, error) {
+	var refunded uint
+	err := u.middleware(func() (err error) {
+		refunded, err = u.next.Refund(idempotencyKey, amount)
+		return err
+	})
+	return refunded, err
+}
+
+func (p *partner) Deposit(idempotencyKey string, amount uint) error {
+	return p.middleware(func() error {
+		return p.next.Deposit(idempotencyKey, amount)
+	})
+}
+
+func (p *partner) Withdraw(idempotencyKey string, amount uint) error {
+	return p.middleware(func() error {
+		return p.next.Withdraw(idempotencyKey, amount)
+	})
+}
+
+func (p *partner) Annotate(idempotencyKey string, metadata map[string]string) {
+	annotatePartner(p.next, idempotencyKey, metadata)
+}
@@ -0,0 +1,71 @@
+package middleware_test
+
+import (
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/payments"
+	"github.com/davidjwilkins/declarative-payments/payments/handlers"
+	"github.com/davidjwilkins/declarative-payments/payments/middleware"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestUser(t *testing.T) {
+	var calls []string
+	recorder := func(name string) middleware.Middleware {
+		return func(call func() error) error {
+			calls = append(calls, name)
+			return call()
+		}
+	}
+	m := handlers.NewUserMock()
+	u := middleware.User(m, recorder("outer"), recorder("inner"))
+	assert.NoError(t, u.Authorize("authorize", 1000))
+	assert.Equal(t, []string{"outer", "inner"}, calls, "Middleware is applied in order")
+	captured, err := u.Capture("capture", 400)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(400), captured)
+	released, err := u.Release("release", 100)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(100), released)
+	captured, captureErr, released, releaseErr := u.CaptureRelease("capture2", 100, "release2", 100)
+	assert.NoError(t, captureErr)
+	assert.NoError(t, releaseErr)
+	assert.Equal(t, uint(100), captured)
+	assert.Equal(t, uint(100), released)
+	assert.NoError(t, u.Charge("charge", 500))
+	refunded, err := u.Refund("refund", 200)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(200), refunded)
+	assert.Equal(t, 800, m.Balance())
+	assert.Equal(t, uint(300), m.AuthorizedBalance())
+	assert.Equal(t, 12, len(calls), "Every call goes through the middleware")
+}
+
+func TestPartner(t *testing.T) {
+	calls := 0
+	m := handlers.NewPartnerMock()
+	p := middleware.Partner(m, func(call func() error) error {
+		calls++
+		return call()
+	})
+	assert.NoError(t, p.Deposit("deposit", 1000))
+	assert.NoError(t, p.Withdraw("withdraw", 400))
+	assert.Equal(t, 600, m.Balance())
+	assert.Equal(t, 2, calls)
+}
+
+func TestUser_Capabilities(t *testing.T) {
+	t.Run("Wrapped handlers keep their capabilities", func(t *testing.T) {
+		m := handlers.NewIncrementalUserMock()
+		u := middleware.User(m)
+		assert.Equal(t, payments.Capabilities(m), payments.Capabilities(u))
+		assert.NoError(t, u.(payments.IncrementalAuthorizer).IncrementAuthorization("a", 100))
+		increments, _, _ := m.Calls()
+		assert.Equal(t, 1, increments)
+	})
+	t.Run("Capabilities are not gained by wrapping", func(t *testing.T) {
+		m := handlers.NewUserMock()
+		m.SetCapabilities(consts.CapabilityIncrementalAuthorization)
+		assert.Empty(t, payments.Capabilities(middleware.User(m)), "The mock cannot increment")
+	})
+}
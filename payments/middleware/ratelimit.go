@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket for a single provider account.  Share one between every handler using the account.
+type RateLimiter struct {
+	lock    sync.Mutex
+	clock   clock.Clock
+	rate    float64
+	burst   float64
+	maxWait time.Duration
+	tokens  float64
+	last    time.Time
+}
+
+// NewRateLimiter allows rate calls per second, in bursts of up to burst calls.  Calls wait up to maxWait for a token,
+// after which they fail with errors.ErrRateLimited.
+func NewRateLimiter(rate float64, burst int, maxWait time.Duration, c clock.Clock) *RateLimiter {
+	return &RateLimiter{
+		clock:   c,
+		rate:    rate,
+		burst:   float64(burst),
+		maxWait: maxWait,
+		tokens:  float64(burst),
+		last:    c.Now(),
+	}
+}
+
+// reserve takes a token, returning how long to wait before it can be used
+func (r *RateLimiter) reserve() (time.Duration, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := r.clock.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+	if r.tokens >= 1 {
+		r.tokens--
+		return 0, nil
+	}
+	wait := time.Duration((1 - r.tokens) / r.rate * float64(time.Second))
+	if wait > r.maxWait {
+		return 0, errors.ErrRateLimited
+	}
+	r.tokens--
+	return wait, nil
+}
+
+// Middleware waits for a token before each call, sleeping on the limiter's clock
+func (r *RateLimiter) Middleware(call func() error) error {
+	wait, err := r.reserve()
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		clock.Sleep(r.clock, wait)
+	}
+	return call()
+}
@@ -0,0 +1,58 @@
+package middleware_test
+
+import (
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments/handlers"
+	"github.com/davidjwilkins/declarative-payments/payments/middleware"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	t.Run("Allows bursts", func(t *testing.T) {
+		c := clock.NewMock(time.Now())
+		limiter := middleware.NewRateLimiter(1, 3, 0, c)
+		u := middleware.User(handlers.NewUserMock(), limiter.Middleware)
+		for i := 0; i < 3; i++ {
+			assert.NoError(t, u.Charge(uuid.New().String(), 100))
+		}
+		err := u.Charge(uuid.New().String(), 100)
+		assert.True(t, errors.Is(err, errors.ErrRateLimited), "Calls beyond the burst are limited")
+		assert.True(t, errors.Is(err, errors.ErrRetryable), "Rate limited calls can be retried")
+	})
+	t.Run("Refills over time", func(t *testing.T) {
+		c := clock.NewMock(time.Now())
+		limiter := middleware.NewRateLimiter(2, 1, 0, c)
+		u := middleware.User(handlers.NewUserMock(), limiter.Middleware)
+		assert.NoError(t, u.Charge(uuid.New().String(), 100))
+		assert.Error(t, u.Charge(uuid.New().String(), 100))
+		c.Advance(500 * time.Millisecond)
+		assert.NoError(t, u.Charge(uuid.New().String(), 100), "A token is added every 1/rate seconds")
+		c.Advance(time.Hour)
+		assert.NoError(t, u.Charge(uuid.New().String(), 100))
+		assert.Error(t, u.Charge(uuid.New().String(), 100), "Tokens do not accumulate beyond the burst")
+	})
+	t.Run("Waits for a token", func(t *testing.T) {
+		limiter := middleware.NewRateLimiter(100, 1, time.Second, clock.System)
+		p := middleware.Partner(handlers.NewPartnerMock(), limiter.Middleware)
+		start := time.Now()
+		assert.NoError(t, p.Deposit(uuid.New().String(), 100))
+		assert.NoError(t, p.Deposit(uuid.New().String(), 100))
+		assert.NoError(t, p.Deposit(uuid.New().String(), 100))
+		assert.True(t, time.Since(start) >= 15*time.Millisecond, "Calls wait for the next token")
+	})
+	t.Run("Waits on its clock", func(t *testing.T) {
+		start := time.Now()
+		c := clock.NewMock(start)
+		limiter := middleware.NewRateLimiter(1, 1, time.Hour, c)
+		p := middleware.Partner(handlers.NewPartnerMock(), limiter.Middleware)
+		assert.NoError(t, p.Deposit(uuid.New().String(), 100))
+		assert.NoError(t, p.Deposit(uuid.New().String(), 100))
+		assert.NoError(t, p.Deposit(uuid.New().String(), 100))
+		assert.Equal(t, start.Add(2*time.Second), c.Now(), "Each call waits a second for its token")
+		assert.True(t, time.Since(start) < time.Second, "Without waiting on the wall clock")
+	})
+}
@@ -0,0 +1,250 @@
+package policy
+
+import (
+	"fmt"
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments"
+	"github.com/davidjwilkins/declarative-payments/payments/resolver"
+	"github.com/google/uuid"
+	"sync"
+	"time"
+)
+
+// Limit caps how much a user can be charged or authorized over a rolling window
+type Limit struct {
+	Name    string
+	Actions []consts.PaymentCommandAction
+	// Bucket restricts the limit to a single bucket.  If empty, the limit is across all buckets.
+	Bucket string
+	Window time.Duration
+	Max    uint
+	// Trim reduces commands to what is left of the limit, instead of holding them
+	Trim bool
+}
+
+// Daily limits charges and authorizations to max per user per day
+func Daily(name string, bucket string, max uint, trim bool) Limit {
+	return Limit{
+		Name:    name,
+		Actions: []consts.PaymentCommandAction{consts.PaymentCommandActionCharge, consts.PaymentCommandActionAuthorize},
+		Bucket:  bucket,
+		Window:  24 * time.Hour,
+		Max:     max,
+		Trim:    trim,
+	}
+}
+
+func (l Limit) applies(bucket string, action consts.PaymentCommandAction) bool {
+	if l.Bucket != "" && l.Bucket != bucket {
+		return false
+	}
+	for _, a := range l.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// Engine enforces limits using the history of completed commands.  It is both a payments.Policy and a
+// payments.CommandObserver, and should be shared between every handler so limits apply across them.
+//
+// Commands it allows are reserved against the limits until they are observed, so handlers evaluating at the same time
+// cannot both use what is left of a limit.  Reservations which are never observed lapse with the window.
+type Engine struct {
+	lock     sync.Mutex
+	history  History
+	clock    clock.Clock
+	limits   []Limit
+	reserved map[uuid.UUID]Entry
+}
+
+func NewEngine(history History, c clock.Clock, limits ...Limit) *Engine {
+	return &Engine{
+		history:  history,
+		clock:    c,
+		limits:   limits,
+		reserved: make(map[uuid.UUID]Entry),
+	}
+}
+
+// used returns how much of l the user has used since the start of its window
+func (e *Engine) used(l Limit, entries []Entry, now time.Time) uint {
+	start := now.Add(-l.Window)
+	var total uint
+	for _, entry := range entries {
+		if entry.Date.After(start) && l.applies(entry.Bucket, entry.Action) {
+			total += entry.Amount
+		}
+	}
+	return total
+}
+
+// limited reports whether any limit applies to cmd
+func (e *Engine) limited(bucket string, cmd resolver.PaymentCommand) bool {
+	for _, l := range e.limits {
+		if l.applies(bucket, cmd.Action) {
+			return true
+		}
+	}
+	return false
+}
+
+// trimCaptures cuts the captures planned along with an authorization by what a limit cut from the authorization.  A
+// capture is only planned with an authorization when it is made from the increase, so they are limited as a unit:
+// captures which would be left with nothing are held along with it.
+func trimCaptures(cmds []resolver.PaymentCommand, auth resolver.PaymentCommand, cut uint) {
+	for i := range cmds {
+		if cmds[i].Action != consts.PaymentCommandActionCapture || cmds[i].DesiredStateID != auth.DesiredStateID ||
+			cmds[i].Status != consts.PaymentCommandStatusPending {
+			continue
+		}
+		if cut >= cmds[i].Amount {
+			cmds[i].Policy = resolver.PolicyDecision{
+				Name:    auth.Policy.Name,
+				Outcome: consts.PolicyOutcomeHeld,
+				Reason:  auth.Policy.Reason,
+			}
+			// Only pending commands are trimmed, and they can always be held
+			_ = cmds[i].Transition(consts.PaymentCommandStatusHeld)
+			continue
+		}
+		cmds[i].Policy = resolver.PolicyDecision{
+			Name:            auth.Policy.Name,
+			Outcome:         consts.PolicyOutcomeTrimmed,
+			Reason:          auth.Policy.Reason,
+			RequestedAmount: cmds[i].Amount,
+		}
+		cmds[i].Amount -= cut
+	}
+}
+
+// Evaluate holds or trims pending commands which would take the user over a limit
+func (e *Engine) Evaluate(state payments.ActualState, cmds []resolver.PaymentCommand) []resolver.PaymentCommand {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	now := e.clock.Now()
+	var longest time.Duration
+	for _, l := range e.limits {
+		if l.Window > longest {
+			longest = l.Window
+		}
+	}
+	entries := e.history.Since(state.UserID, now.Add(-longest))
+	evaluating := make(map[uuid.UUID]bool, len(cmds))
+	for _, cmd := range cmds {
+		evaluating[cmd.ID] = true
+	}
+	for id, r := range e.reserved {
+		if !r.Date.After(now.Add(-longest)) {
+			delete(e.reserved, id)
+		} else if r.UserID == state.UserID && !evaluating[id] {
+			// A command evaluated again, as when it is released, replaces its reservation
+			entries = append(entries, r)
+		}
+	}
+	for i := range cmds {
+		if cmds[i].Status != consts.PaymentCommandStatusPending {
+			continue
+		}
+		cmds[i].Policy = resolver.PolicyDecision{}
+		requested := cmds[i].Amount
+		for _, l := range e.limits {
+			if !l.applies(state.Bucket, cmds[i].Action) {
+				continue
+			}
+			used := e.used(l, entries, now)
+			remaining := uint(0)
+			if used < l.Max {
+				remaining = l.Max - used
+			}
+			if cmds[i].Amount <= remaining {
+				// Don't hide that an earlier limit trimmed the command
+				if cmds[i].Policy.Outcome == "" {
+					cmds[i].Policy = resolver.PolicyDecision{
+						Name:    l.Name,
+						Outcome: consts.PolicyOutcomeAllowed,
+					}
+				}
+				continue
+			}
+			reason := fmt.Sprintf("%d of %d used in the last %s", used, l.Max, l.Window)
+			if l.Trim && remaining > 0 {
+				cmds[i].Policy = resolver.PolicyDecision{
+					Name:            l.Name,
+					Outcome:         consts.PolicyOutcomeTrimmed,
+					Reason:          reason,
+					RequestedAmount: requested,
+				}
+				cmds[i].Amount = remaining
+				continue
+			}
+			cmds[i].Policy = resolver.PolicyDecision{
+				Name:    l.Name,
+				Outcome: consts.PolicyOutcomeHeld,
+				Reason:  reason,
+			}
+			// Only pending commands are evaluated, and they can always be held
+			_ = cmds[i].Transition(consts.PaymentCommandStatusHeld)
+			break
+		}
+		if cmds[i].Action == consts.PaymentCommandActionAuthorize {
+			if cmds[i].Status == consts.PaymentCommandStatusHeld {
+				trimCaptures(cmds, cmds[i], requested)
+			} else if cmds[i].Amount < requested {
+				trimCaptures(cmds, cmds[i], requested-cmds[i].Amount)
+			}
+		}
+		if cmds[i].Status == consts.PaymentCommandStatusPending && e.limited(state.Bucket, cmds[i]) {
+			r := e.entry(state, cmds[i], now)
+			e.reserved[cmds[i].ID] = r
+			entries = append(entries, r)
+		} else {
+			delete(e.reserved, cmds[i].ID)
+		}
+	}
+	return cmds
+}
+
+// Release evaluates a held command again, such as once its window has passed, and returns it pending so it can be run.
+// If it is still over a limit, it is returned held, with errors.ErrOverLimit.
+func (e *Engine) Release(state payments.ActualState, cmd resolver.PaymentCommand) (resolver.PaymentCommand, error) {
+	if err := cmd.Transition(consts.PaymentCommandStatusPending); err != nil {
+		return cmd, err
+	}
+	cmd = e.Evaluate(state, []resolver.PaymentCommand{cmd})[0]
+	if cmd.Status == consts.PaymentCommandStatusHeld {
+		return cmd, fmt.Errorf("%w: %s", errors.ErrOverLimit, cmd.Policy.Reason)
+	}
+	return cmd, nil
+}
+
+func (e *Engine) entry(state payments.ActualState, cmd resolver.PaymentCommand, now time.Time) Entry {
+	return Entry{
+		CommandID:  cmd.ID,
+		ExternalID: state.ExternalID,
+		UserID:     state.UserID,
+		Bucket:     state.Bucket,
+		Action:     cmd.Action,
+		Amount:     cmd.Amount,
+		Date:       now,
+	}
+}
+
+// Observe records completed commands in the history, and lets go of the reservations of commands which will not run
+// again
+func (e *Engine) Observe(state payments.ActualState, cmds []resolver.PaymentCommand) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	now := e.clock.Now()
+	for _, cmd := range cmds {
+		if cmd.Status == consts.PaymentCommandStatusComplete {
+			e.history.Record(e.entry(state, cmd, now))
+		}
+		if cmd.Status.Terminal() {
+			delete(e.reserved, cmd.ID)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package policy_test
+
+import (
+	"context"
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments"
+	"github.com/davidjwilkins/declarative-payments/payments/handlers"
+	"github.com/davidjwilkins/declarative-payments/payments/policy"
+	"github.com/davidjwilkins/declarative-payments/payments/resolver"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+type Handler interface {
+	Run(cmds []resolver.PaymentCommand) ([]resolver.PaymentCommand, []error)
+	Resolve(ctx context.Context, d resolver.DesiredState) ([]resolver.PaymentCommand, []error)
+	CurrentState() payments.ActualState
+}
+
+func policyHandler(engine *policy.Engine, userID uuid.UUID, bucket string) (Handler, resolver.DesiredState) {
+	as := payments.ActualState{
+		DesiredState: resolver.DesiredState{
+			ID:         uuid.New(),
+			ExternalID: uuid.New(),
+			UserID:     userID,
+			PartnerID:  uuid.New(),
+			Date:       time.Now().Add(-time.Hour),
+			Bucket:     bucket,
+		},
+	}
+	h := payments.NewHandler(&as, handlers.NewPartnerMock(), handlers.NewUserMock(), payments.WithPolicy(engine), payments.WithObserver(engine))
+	return h, resolver.DesiredState{
+		ID:         uuid.New(),
+		ExternalID: as.ExternalID,
+		UserID:     as.UserID,
+		PartnerID:  as.PartnerID,
+		Date:       time.Now(),
+		Bucket:     as.Bucket,
+	}
+}
+
+func TestEngine(t *testing.T) {
+	ctx := context.Background()
+	t.Run("Allows commands within the limit", func(t *testing.T) {
+		engine := policy.NewEngine(policy.NewMemoryHistory(), clock.System, policy.Daily("daily", "", 1000, false))
+		h, ds := policyHandler(engine, uuid.New(), "test")
+		ds.Amount = 1000
+		cmds, errs := h.Resolve(ctx, ds)
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, consts.PaymentCommandStatusComplete, cmds[0].Status)
+		assert.Equal(t, resolver.PolicyDecision{Name: "daily", Outcome: consts.PolicyOutcomeAllowed}, cmds[0].Policy)
+		assert.Equal(t, 1000, h.CurrentState().Amount)
+	})
+	t.Run("Holds commands over the limit", func(t *testing.T) {
+		engine := policy.NewEngine(policy.NewMemoryHistory(), clock.System, policy.Daily("daily", "", 1000, false))
+		h, ds := policyHandler(engine, uuid.New(), "test")
+		ds.Amount = 1500
+		ds.PartnerAmount = 100
+		cmds, errs := h.Resolve(ctx, ds)
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, consts.PaymentCommandStatusHeld, cmds[0].Status)
+		assert.Equal(t, consts.PolicyOutcomeHeld, cmds[0].Policy.Outcome)
+		assert.Equal(t, "0 of 1000 used in the last 24h0m0s", cmds[0].Policy.Reason)
+		assert.Equal(t, uint(1500), cmds[0].Amount)
+		assert.Equal(t, uint(0), cmds[0].Attempts, "Held commands are not run")
+		assert.Equal(t, consts.PaymentCommandStatusComplete, cmds[1].Status, "Other commands are run")
+		assert.Equal(t, 0, h.CurrentState().Amount)
+		assert.Equal(t, 100, h.CurrentState().PartnerAmount)
+	})
+	t.Run("Trims commands to the limit", func(t *testing.T) {
+		engine := policy.NewEngine(policy.NewMemoryHistory(), clock.System, policy.Daily("daily", "", 1000, true))
+		h, ds := policyHandler(engine, uuid.New(), "test")
+		ds.Amount = 1500
+		cmds, errs := h.Resolve(ctx, ds)
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, consts.PaymentCommandStatusComplete, cmds[0].Status)
+		assert.Equal(t, consts.PolicyOutcomeTrimmed, cmds[0].Policy.Outcome)
+		assert.Equal(t, uint(1500), cmds[0].Policy.RequestedAmount)
+		assert.Equal(t, uint(1000), cmds[0].Amount)
+		assert.Equal(t, 1000, h.CurrentState().Amount)
+	})
+	t.Run("Limits apply across handlers over a rolling window", func(t *testing.T) {
+		c := clock.NewMock(time.Now())
+		engine := policy.NewEngine(policy.NewMemoryHistory(), c, policy.Daily("daily", "", 1000, false))
+		userID := uuid.New()
+		first, ds := policyHandler(engine, userID, "test")
+		ds.AuthorizedAmount = 600
+		_, errs := first.Resolve(ctx, ds)
+		assert.Equal(t, 0, len(errs))
+		second, ds := policyHandler(engine, userID, "other")
+		ds.Amount = 600
+		cmds, errs := second.Resolve(ctx, ds)
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, consts.PaymentCommandStatusHeld, cmds[0].Status, "Authorizations on other handlers count")
+		c.Advance(24 * time.Hour)
+		cmds, errs = second.Resolve(ctx, ds)
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, consts.PaymentCommandStatusComplete, cmds[0].Status, "Older commands fall out of the window")
+	})
+	t.Run("Bucket limits only apply to their bucket", func(t *testing.T) {
+		engine := policy.NewEngine(policy.NewMemoryHistory(), clock.System, policy.Daily("test-daily", "test", 1000, false))
+		userID := uuid.New()
+		h, ds := policyHandler(engine, userID, "other")
+		ds.Amount = 1500
+		cmds, _ := h.Resolve(ctx, ds)
+		assert.Equal(t, consts.PaymentCommandStatusComplete, cmds[0].Status)
+		assert.Equal(t, resolver.PolicyDecision{}, cmds[0].Policy)
+		h, ds = policyHandler(engine, userID, "test")
+		ds.Amount = 500
+		ds.AuthorizedAmount = 600
+		cmds, _ = h.Resolve(ctx, ds)
+		assert.Equal(t, consts.PaymentCommandActionAuthorize, cmds[0].Action)
+		assert.Equal(t, consts.PaymentCommandStatusComplete, cmds[0].Status)
+		assert.Equal(t, consts.PaymentCommandActionCharge, cmds[1].Action)
+		assert.Equal(t, consts.PaymentCommandStatusHeld, cmds[1].Status, "Earlier commands in the same plan count")
+	})
+	t.Run("Held commands can be released once the limit allows them", func(t *testing.T) {
+		c := clock.NewMock(time.Now())
+		engine := policy.NewEngine(policy.NewMemoryHistory(), c, policy.Daily("daily", "", 1000, false))
+		userID := uuid.New()
+		first, ds := policyHandler(engine, userID, "test")
+		ds.Amount = 600
+		_, errs := first.Resolve(ctx, ds)
+		assert.Equal(t, 0, len(errs))
+		h, ds := policyHandler(engine, userID, "test")
+		ds.Amount = 600
+		cmds, _ := h.Resolve(ctx, ds)
+		assert.Equal(t, consts.PaymentCommandStatusHeld, cmds[0].Status)
+		held, err := engine.Release(h.CurrentState(), cmds[0])
+		assert.True(t, errors.Is(err, errors.ErrOverLimit))
+		assert.Equal(t, consts.PaymentCommandStatusHeld, held.Status)
+		c.Advance(24 * time.Hour)
+		released, err := engine.Release(h.CurrentState(), held)
+		assert.NoError(t, err)
+		assert.Equal(t, consts.PaymentCommandStatusPending, released.Status)
+		assert.Equal(t, cmds[0].ID, released.ID, "The command keeps its idempotency key")
+		ran, errs := h.Run([]resolver.PaymentCommand{released})
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, consts.PaymentCommandStatusComplete, ran[0].Status)
+		assert.Equal(t, 600, h.CurrentState().Amount)
+		_, err = engine.Release(h.CurrentState(), ran[0])
+		assert.True(t, errors.Is(err, errors.ErrIllegalTransition), "Only held commands can be released")
+	})
+	t.Run("Allowed commands are reserved until they are observed", func(t *testing.T) {
+		engine := policy.NewEngine(policy.NewMemoryHistory(), clock.System, policy.Daily("daily", "", 1000, false))
+		state := payments.ActualState{DesiredState: resolver.DesiredState{ExternalID: uuid.New(), UserID: uuid.New(), Bucket: "test"}}
+		ds := resolver.DesiredState{ID: uuid.New(), ExternalID: state.ExternalID, UserID: state.UserID, Bucket: "test"}
+		first := engine.Evaluate(state, []resolver.PaymentCommand{ds.Charge(600)})
+		assert.Equal(t, consts.PaymentCommandStatusPending, first[0].Status)
+		second := engine.Evaluate(state, []resolver.PaymentCommand{ds.Charge(600)})
+		assert.Equal(t, consts.PaymentCommandStatusHeld, second[0].Status, "The first command has not run, but it is allowed to")
+		assert.NoError(t, first[0].Transition(consts.PaymentCommandStatusFailed))
+		engine.Observe(state, first)
+		third := engine.Evaluate(state, []resolver.PaymentCommand{ds.Charge(600)})
+		assert.Equal(t, consts.PaymentCommandStatusPending, third[0].Status, "Commands which failed let go of their reservation")
+
+		userID := uuid.New()
+		var wg sync.WaitGroup
+		var lock sync.Mutex
+		allowed := 0
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				state := payments.ActualState{DesiredState: resolver.DesiredState{ExternalID: uuid.New(), UserID: userID, Bucket: "test"}}
+				cmds := engine.Evaluate(state, []resolver.PaymentCommand{ds.Charge(100)})
+				if cmds[0].Status == consts.PaymentCommandStatusPending {
+					lock.Lock()
+					allowed++
+					lock.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, 10, allowed, "Concurrent evaluations cannot both use what is left")
+	})
+	t.Run("Captures from an increased authorization are limited with it", func(t *testing.T) {
+		state := payments.ActualState{DesiredState: resolver.DesiredState{ExternalID: uuid.New(), UserID: uuid.New(), Bucket: "test"}}
+		ds := resolver.DesiredState{ID: uuid.New(), ExternalID: state.ExternalID, UserID: state.UserID, Bucket: "test"}
+		engine := policy.NewEngine(policy.NewMemoryHistory(), clock.System, policy.Daily("daily", "", 700, true))
+		cmds := engine.Evaluate(state, []resolver.PaymentCommand{ds.Capture(500), ds.Authorize(1000)})
+		assert.Equal(t, uint(700), cmds[1].Amount)
+		assert.Equal(t, consts.PolicyOutcomeTrimmed, cmds[0].Policy.Outcome)
+		assert.Equal(t, uint(500), cmds[0].Policy.RequestedAmount)
+		assert.Equal(t, uint(200), cmds[0].Amount, "The capture is cut by what was cut from the authorization")
+
+		engine = policy.NewEngine(policy.NewMemoryHistory(), clock.System, policy.Daily("daily", "", 700, false))
+		cmds = engine.Evaluate(state, []resolver.PaymentCommand{ds.Capture(500), ds.Authorize(1000)})
+		assert.Equal(t, consts.PaymentCommandStatusHeld, cmds[1].Status)
+		assert.Equal(t, consts.PaymentCommandStatusHeld, cmds[0].Status, "Captures are held with the authorization they need")
+		assert.Equal(t, uint(500), cmds[0].Amount)
+
+		other := resolver.DesiredState{ID: uuid.New(), ExternalID: state.ExternalID, UserID: state.UserID, Bucket: "test"}
+		cmds = engine.Evaluate(state, []resolver.PaymentCommand{other.Capture(500), ds.Authorize(1000)})
+		assert.Equal(t, consts.PaymentCommandStatusPending, cmds[0].Status, "Captures planned for other states are not")
+	})
+}
@@ -0,0 +1,61 @@
+package policy
+
+import (
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/google/uuid"
+	"sync"
+	"time"
+)
+
+// Entry is a command which completed
+type Entry struct {
+	CommandID  uuid.UUID
+	ExternalID uuid.UUID
+	UserID     uuid.UUID
+	Bucket     string
+	Action     consts.PaymentCommandAction
+	Amount     uint
+	Date       time.Time
+}
+
+// History is the record of completed commands, across every handler
+type History interface {
+	Record(e Entry)
+	// Since returns the entries for a user dated at or after since
+	Since(userID uuid.UUID, since time.Time) []Entry
+}
+
+type memoryHistory struct {
+	lock     sync.RWMutex
+	recorded map[uuid.UUID]struct{}
+	entries  map[uuid.UUID][]Entry
+}
+
+func NewMemoryHistory() *memoryHistory {
+	return &memoryHistory{
+		recorded: make(map[uuid.UUID]struct{}),
+		entries:  make(map[uuid.UUID][]Entry),
+	}
+}
+
+func (m *memoryHistory) Record(e Entry) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.recorded[e.CommandID]; ok {
+		return
+	}
+	m.recorded[e.CommandID] = struct{}{}
+	m.entries[e.UserID] = append(m.entries[e.UserID], e)
+}
+
+func (m *memoryHistory) Since(userID uuid.UUID, since time.Time) []Entry {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var entries []Entry
+	for _, e := range m.entries[userID] {
+		if !e.Date.Before(since) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
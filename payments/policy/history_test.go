@@ -0,0 +1,29 @@
+package policy_test
+
+import (
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/payments/policy"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMemoryHistory(t *testing.T) {
+	h := policy.NewMemoryHistory()
+	userID := uuid.New()
+	now := time.Now()
+	entry := policy.Entry{
+		CommandID: uuid.New(),
+		UserID:    userID,
+		Bucket:    "test",
+		Action:    consts.PaymentCommandActionCharge,
+		Amount:    100,
+		Date:      now.Add(-time.Hour),
+	}
+	h.Record(entry)
+	h.Record(entry)
+	assert.Equal(t, []policy.Entry{entry}, h.Since(userID, now.Add(-2*time.Hour)), "Commands are only recorded once")
+	assert.Equal(t, 0, len(h.Since(userID, now)), "Older entries are not returned")
+	assert.Equal(t, 0, len(h.Since(uuid.New(), now.Add(-2*time.Hour))), "Entries are per user")
+}
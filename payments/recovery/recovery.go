@@ -0,0 +1,220 @@
+// Package recovery rebuilds actual states from what their providers hold, for when the state store has lost them.
+//
+// Run annotates every command with the identifiers of its payment, so handlers which keep metadata at their provider
+// leave enough behind to attribute each charge, refund and transfer to a payment again.  Recover groups provider
+// records by those identifiers, and adopts the balances they add up to, as drift.Adopt would.
+package recovery
+
+import (
+	"fmt"
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments"
+	"github.com/davidjwilkins/declarative-payments/payments/drift"
+	"github.com/google/uuid"
+	"sort"
+	"time"
+)
+
+// Record is something a provider did for a payment, such as a charge, a refund or a transfer, described by the command
+// action which would have the same effect.  CaptureRelease is recorded as a Capture and a Release.
+type Record struct {
+	ID       string
+	Action   consts.PaymentCommandAction
+	Amount   uint
+	Metadata map[string]string
+	Date     time.Time
+}
+
+// Unattributed is a record which could not be used, and why
+type Unattributed struct {
+	Record Record
+	Err    error
+}
+
+// Report is the outcome of a recovery
+type Report struct {
+	// Recovered compares the balances stored for each payment with those recovered for it
+	Recovered []drift.Report
+	// Unattributed are the records which were not counted towards any payment
+	Unattributed []Unattributed
+}
+
+// payment is the records of one payment, and the identifiers they agree on
+type payment struct {
+	state   payments.ActualState
+	records []Record
+	// amount and authorized are signed while adding up, so that records out of order do not overflow
+	amount     int
+	authorized int
+	partner    int
+}
+
+func unattributed(record Record, format string, args ...interface{}) Unattributed {
+	return Unattributed{Record: record, Err: fmt.Errorf("%w: "+format, append([]interface{}{errors.ErrUnattributed}, args...)...)}
+}
+
+// parseID returns the identifier in metadata under key, or uuid.Nil if there is none
+func parseID(metadata map[string]string, key string) (uuid.UUID, error) {
+	value, ok := metadata[key]
+	if !ok || value == "" {
+		return uuid.Nil, nil
+	}
+	return uuid.Parse(value)
+}
+
+// add counts record towards p, unless it conflicts with the payment's identifiers
+func (p *payment) add(record Record, userID, partnerID uuid.UUID, bucket string) *Unattributed {
+	if userID != uuid.Nil && p.state.UserID != uuid.Nil && userID != p.state.UserID {
+		u := unattributed(record, "user %s does not match %s", userID, p.state.UserID)
+		return &u
+	}
+	if partnerID != uuid.Nil && p.state.PartnerID != uuid.Nil && partnerID != p.state.PartnerID {
+		u := unattributed(record, "partner %s does not match %s", partnerID, p.state.PartnerID)
+		return &u
+	}
+	if bucket != "" && p.state.Bucket != "" && bucket != p.state.Bucket {
+		u := unattributed(record, "bucket %s does not match %s", bucket, p.state.Bucket)
+		return &u
+	}
+	amount := int(record.Amount)
+	switch record.Action {
+	case consts.PaymentCommandActionAuthorize:
+		p.authorized += amount
+	case consts.PaymentCommandActionCapture:
+		p.authorized -= amount
+		p.amount += amount
+	case consts.PaymentCommandActionRelease:
+		p.authorized -= amount
+	case consts.PaymentCommandActionCharge:
+		p.amount += amount
+	case consts.PaymentCommandActionRefund:
+		p.amount -= amount
+	case consts.PaymentCommandActionDeposit:
+		p.partner += amount
+	case consts.PaymentCommandActionWithdraw:
+		p.partner -= amount
+	default:
+		u := unattributed(record, "unknown action %s", record.Action)
+		return &u
+	}
+	if userID != uuid.Nil {
+		p.state.UserID = userID
+	}
+	if partnerID != uuid.Nil {
+		p.state.PartnerID = partnerID
+	}
+	if bucket != "" {
+		p.state.Bucket = bucket
+	}
+	if record.Date.After(p.state.Date) {
+		p.state.Date = record.Date
+	}
+	p.records = append(p.records, record)
+	return nil
+}
+
+// group attributes records to the payments named in their metadata
+func group(records []Record) (map[uuid.UUID]*payment, []Unattributed) {
+	sorted := make([]Record, len(records))
+	copy(sorted, records)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Date.Before(sorted[j].Date)
+	})
+	grouped := make(map[uuid.UUID]*payment)
+	var rejected []Unattributed
+	for _, record := range sorted {
+		externalID, err := parseID(record.Metadata, payments.MetadataExternalID)
+		if err != nil || externalID == uuid.Nil {
+			rejected = append(rejected, unattributed(record, "no valid %s", payments.MetadataExternalID))
+			continue
+		}
+		userID, err := parseID(record.Metadata, payments.MetadataUserID)
+		if err != nil {
+			rejected = append(rejected, unattributed(record, "invalid %s: %v", payments.MetadataUserID, err))
+			continue
+		}
+		partnerID, err := parseID(record.Metadata, payments.MetadataPartnerID)
+		if err != nil {
+			rejected = append(rejected, unattributed(record, "invalid %s: %v", payments.MetadataPartnerID, err))
+			continue
+		}
+		p, ok := grouped[externalID]
+		if !ok {
+			p = &payment{}
+			p.state.ExternalID = externalID
+			grouped[externalID] = p
+		}
+		if u := p.add(record, userID, partnerID, record.Metadata[payments.MetadataBucket]); u != nil {
+			rejected = append(rejected, *u)
+		}
+	}
+	return grouped, rejected
+}
+
+// Recover rebuilds the balances of every payment records are attributed to, and saves them to store.  Payments which
+// are not stored are saved as complete states with the identifiers from the records; stored payments adopt the
+// recovered balances as their next version, as drift.Adopt does.  Payments whose records add up to a negative
+// authorization, as when an authorization is missing, are not saved, and their records are reported as unattributed.
+//
+// An error is returned if the store fails, along with the report of what was recovered until then.
+func Recover(store payments.StateStore, records []Record, c clock.Clock) (Report, error) {
+	grouped, rejected := group(records)
+	report := Report{Unattributed: rejected}
+	ids := make([]uuid.UUID, 0, len(grouped))
+	for id := range grouped {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].String() < ids[j].String()
+	})
+	for _, id := range ids {
+		p := grouped[id]
+		if p.authorized < 0 {
+			for _, record := range p.records {
+				report.Unattributed = append(report.Unattributed,
+					unattributed(record, "authorizations of %s add up to %d", id, p.authorized))
+			}
+			continue
+		}
+		state, err := store.Load(id)
+		stored := err == nil
+		if errors.Is(err, errors.ErrStateNotFound) {
+			state, err = p.state, nil
+		}
+		if err != nil {
+			return report, err
+		}
+		recovered := drift.Report{
+			ExternalID: id,
+			Version:    state.Version,
+			Actual: drift.Balances{
+				Amount:           p.amount,
+				AuthorizedAmount: uint(p.authorized),
+				PartnerAmount:    p.partner,
+			},
+			Date: c.Now(),
+		}
+		if stored {
+			recovered.Expected = drift.Balances{
+				Amount:           state.Amount,
+				AuthorizedAmount: state.AuthorizedAmount,
+				PartnerAmount:    state.PartnerAmount,
+			}
+		}
+		if stored && !recovered.Drifted() {
+			report.Recovered = append(report.Recovered, recovered)
+			continue
+		}
+		adopted := drift.Adopt(state, recovered)
+		if !stored {
+			adopted.Status = consts.PaymentStatusComplete
+		}
+		if err := store.Save(adopted, state.Version); err != nil {
+			return report, err
+		}
+		report.Recovered = append(report.Recovered, recovered)
+	}
+	return report, nil
+}
@@ -0,0 +1,147 @@
+package recovery_test
+
+import (
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments"
+	"github.com/davidjwilkins/declarative-payments/payments/drift"
+	"github.com/davidjwilkins/declarative-payments/payments/recovery"
+	"github.com/davidjwilkins/declarative-payments/payments/resolver"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/stripe-go/v72"
+	"testing"
+	"time"
+)
+
+func TestRecover(t *testing.T) {
+	externalID, userID, partnerID := uuid.New(), uuid.New(), uuid.New()
+	metadata := map[string]string{
+		payments.MetadataBucket:     "test",
+		payments.MetadataExternalID: externalID.String(),
+		payments.MetadataUserID:     userID.String(),
+		payments.MetadataPartnerID:  partnerID.String(),
+	}
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	records := []recovery.Record{
+		{ID: "ch_1", Action: consts.PaymentCommandActionCharge, Amount: 1000, Metadata: metadata, Date: start.Add(time.Hour)},
+		{ID: "ch_2", Action: consts.PaymentCommandActionAuthorize, Amount: 500, Metadata: metadata, Date: start},
+		{ID: "ch_2:capture", Action: consts.PaymentCommandActionCapture, Amount: 200, Metadata: metadata, Date: start.Add(2 * time.Hour)},
+		{ID: "ch_1:refund", Action: consts.PaymentCommandActionRefund, Amount: 100, Metadata: metadata, Date: start.Add(3 * time.Hour)},
+		{ID: "tr_1", Action: consts.PaymentCommandActionDeposit, Amount: 900, Metadata: metadata, Date: start.Add(time.Hour)},
+		{ID: "tr_1:reversal", Action: consts.PaymentCommandActionWithdraw, Amount: 50, Metadata: metadata, Date: start.Add(3 * time.Hour)},
+	}
+	t.Run("Lost states are rebuilt from the records", func(t *testing.T) {
+		store := payments.NewMemoryStateStore()
+		report, err := recovery.Recover(store, records, clock.System)
+		assert.NoError(t, err)
+		assert.Empty(t, report.Unattributed)
+		assert.Equal(t, 1, len(report.Recovered))
+		assert.Equal(t, drift.Balances{Amount: 1100, AuthorizedAmount: 300, PartnerAmount: 850}, report.Recovered[0].Actual)
+		state, err := store.Load(externalID)
+		assert.NoError(t, err)
+		assert.Equal(t, 1100, state.Amount)
+		assert.Equal(t, uint(300), state.AuthorizedAmount)
+		assert.Equal(t, 850, state.PartnerAmount)
+		assert.Equal(t, userID, state.UserID)
+		assert.Equal(t, partnerID, state.PartnerID)
+		assert.Equal(t, "test", state.Bucket)
+		assert.Equal(t, start.Add(3*time.Hour), state.Date, "The state dates from its last record")
+		assert.Equal(t, consts.PaymentStatusComplete, state.Status)
+		assert.Equal(t, uint64(1), state.Version)
+	})
+	t.Run("Lost states date from their latest record in any order", func(t *testing.T) {
+		store := payments.NewMemoryStateStore()
+		reversed := make([]recovery.Record, len(records))
+		for i, record := range records {
+			reversed[len(records)-1-i] = record
+		}
+		_, err := recovery.Recover(store, reversed, clock.System)
+		assert.NoError(t, err)
+		state, err := store.Load(externalID)
+		assert.NoError(t, err)
+		assert.Equal(t, start.Add(3*time.Hour), state.Date)
+		assert.Equal(t, 1100, state.Amount)
+	})
+	t.Run("Stored states adopt the recovered balances", func(t *testing.T) {
+		store := payments.NewMemoryStateStore()
+		stored := payments.ActualState{
+			DesiredState: resolver.DesiredState{ExternalID: externalID, UserID: userID, PartnerID: partnerID, Bucket: "test", Amount: 1000},
+			Status:       consts.PaymentStatusComplete,
+			Version:      3,
+		}
+		stored.LastDesiredState = stored.DesiredState
+		stored.LastDesiredState.ID = uuid.New()
+		assert.NoError(t, store.Save(stored, 0))
+		report, err := recovery.Recover(store, records, clock.System)
+		assert.NoError(t, err)
+		assert.Equal(t, drift.Balances{Amount: 1000}, report.Recovered[0].Expected)
+		assert.Equal(t, uint64(3), report.Recovered[0].Version)
+		state, err := store.Load(externalID)
+		assert.NoError(t, err)
+		assert.Equal(t, 1100, state.Amount)
+		assert.Equal(t, uint64(4), state.Version)
+		assert.Equal(t, consts.PaymentStatusPending, state.Status, "The last desired state is no longer reached")
+		_, err = recovery.Recover(store, records, clock.System)
+		assert.NoError(t, err)
+		state, err = store.Load(externalID)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(4), state.Version, "States which match are not saved again")
+	})
+	t.Run("Records which cannot be attributed are reported", func(t *testing.T) {
+		store := payments.NewMemoryStateStore()
+		otherUser := map[string]string{
+			payments.MetadataExternalID: externalID.String(),
+			payments.MetadataUserID:     uuid.New().String(),
+		}
+		missing := uuid.New()
+		report, err := recovery.Recover(store, append([]recovery.Record{
+			{ID: "ch_none", Action: consts.PaymentCommandActionCharge, Amount: 100},
+			{ID: "ch_bad", Action: consts.PaymentCommandActionCharge, Amount: 100, Metadata: map[string]string{payments.MetadataExternalID: "bad"}},
+			{ID: "ch_other", Action: consts.PaymentCommandActionCharge, Amount: 100, Metadata: otherUser, Date: start.Add(time.Hour)},
+			{ID: "ch_unknown", Action: consts.PaymentCommandActionCaptureRelease, Amount: 100, Metadata: metadata, Date: start.Add(time.Hour)},
+			{ID: "ch_missing", Action: consts.PaymentCommandActionCapture, Amount: 100, Date: start,
+				Metadata: map[string]string{payments.MetadataExternalID: missing.String()}},
+		}, records...), clock.System)
+		assert.NoError(t, err)
+		var ids []string
+		for _, u := range report.Unattributed {
+			assert.True(t, errors.Is(u.Err, errors.ErrUnattributed))
+			ids = append(ids, u.Record.ID)
+		}
+		assert.ElementsMatch(t, []string{"ch_none", "ch_bad", "ch_other", "ch_unknown", "ch_missing"}, ids)
+		assert.Equal(t, 1, len(report.Recovered))
+		state, err := store.Load(externalID)
+		assert.NoError(t, err)
+		assert.Equal(t, 1100, state.Amount)
+		_, err = store.Load(missing)
+		assert.True(t, errors.Is(err, errors.ErrStateNotFound), "Payments missing an authorization are not saved")
+	})
+}
+
+func TestStripeRecords(t *testing.T) {
+	externalID := uuid.New()
+	metadata := map[string]string{payments.MetadataExternalID: externalID.String()}
+	records := recovery.StripeRecords([]stripe.Charge{
+		{ID: "charged", Amount: 1000, AmountRefunded: 300, Captured: true, Paid: true, Metadata: metadata},
+		{ID: "authorized", Amount: 500, Paid: true, Metadata: metadata},
+		{ID: "released", Amount: 400, AmountRefunded: 400, Paid: true, Metadata: metadata},
+		{ID: "failed", Amount: 700, Metadata: metadata},
+		{ID: "partly-captured", Amount: 800, AmountCaptured: 200, Captured: true, Paid: true, Metadata: metadata,
+			PaymentIntent: &stripe.PaymentIntent{ID: "pi", Status: stripe.PaymentIntentStatusRequiresCapture}},
+	}, []stripe.Transfer{
+		{ID: "transfer", Amount: 900, AmountReversed: 100, Metadata: metadata},
+	})
+	var ids []string
+	for _, record := range records {
+		ids = append(ids, record.ID)
+	}
+	assert.Equal(t, []string{"charged", "charged:refund", "authorized", "released", "released:release", "partly-captured",
+		"partly-captured:capture", "transfer", "transfer:reversal"}, ids)
+	store := payments.NewMemoryStateStore()
+	report, err := recovery.Recover(store, records, clock.System)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Unattributed)
+	assert.Equal(t, drift.Balances{Amount: 900, AuthorizedAmount: 1100, PartnerAmount: 800}, report.Recovered[0].Actual)
+}
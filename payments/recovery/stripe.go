@@ -0,0 +1,52 @@
+package recovery
+
+import (
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/stripe/stripe-go/v72"
+	"time"
+)
+
+// StripeRecords describes Stripe charges made for users, and transfers made to partners, as records.  Charges which
+// were not paid are left out.
+func StripeRecords(charges []stripe.Charge, transfers []stripe.Transfer) []Record {
+	var records []Record
+	add := func(id string, action consts.PaymentCommandAction, amount int64, metadata map[string]string, created int64) {
+		if amount <= 0 {
+			return
+		}
+		records = append(records, Record{
+			ID:       id,
+			Action:   action,
+			Amount:   uint(amount),
+			Metadata: metadata,
+			Date:     time.Unix(created, 0),
+		})
+	}
+	for _, ch := range charges {
+		if !ch.Paid {
+			continue
+		}
+		if !ch.Captured {
+			add(ch.ID, consts.PaymentCommandActionAuthorize, ch.Amount, ch.Metadata, ch.Created)
+			add(ch.ID+":release", consts.PaymentCommandActionRelease, ch.AmountRefunded, ch.Metadata, ch.Created)
+			continue
+		}
+		captured := ch.AmountCaptured
+		if captured == 0 {
+			captured = ch.Amount
+		}
+		if ch.PaymentIntent != nil && ch.PaymentIntent.Status == stripe.PaymentIntentStatusRequiresCapture {
+			// The rest of the authorization can still be captured
+			add(ch.ID, consts.PaymentCommandActionAuthorize, ch.Amount, ch.Metadata, ch.Created)
+			add(ch.ID+":capture", consts.PaymentCommandActionCapture, captured, ch.Metadata, ch.Created)
+		} else {
+			add(ch.ID, consts.PaymentCommandActionCharge, captured, ch.Metadata, ch.Created)
+		}
+		add(ch.ID+":refund", consts.PaymentCommandActionRefund, ch.AmountRefunded, ch.Metadata, ch.Created)
+	}
+	for _, tr := range transfers {
+		add(tr.ID, consts.PaymentCommandActionDeposit, tr.Amount, tr.Metadata, tr.Created)
+		add(tr.ID+":reversal", consts.PaymentCommandActionWithdraw, tr.AmountReversed, tr.Metadata, tr.Created)
+	}
+	return records
+}
@@ -1,31 +1,96 @@
 package resolver
 
 import (
-	"github.com/google/uuid"
+	"fmt"
 	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/google/uuid"
 	"time"
 )
 
 type DesiredState struct {
-	ID               uuid.UUID
-	ExternalID       uuid.UUID
-	UserID           uuid.UUID
-	PartnerID        uuid.UUID
-	Date             time.Time
-	Bucket           string
-	Amount           int
-	AuthorizedAmount uint
-	PartnerAmount    int
+	ID               uuid.UUID `json:"id"`
+	ExternalID       uuid.UUID `json:"external_id"`
+	UserID           uuid.UUID `json:"user_id"`
+	PartnerID        uuid.UUID `json:"partner_id"`
+	Date             time.Time `json:"date"`
+	Bucket           string    `json:"bucket"`
+	Amount           int       `json:"amount"`
+	AuthorizedAmount uint      `json:"authorized_amount"`
+	PartnerAmount    int       `json:"partner_amount"`
+	// PartnerAmountNetOfFees sets PartnerAmount to what is left of Amount once the fees of the bucket are taken, when
+	// the desired state is resolved
+	PartnerAmountNetOfFees bool `json:"partner_amount_net_of_fees,omitempty"`
+	// Actor is who requested the change, Source is the system it came from, and Reason is a code for why
+	Actor  string `json:"actor"`
+	Source string `json:"source"`
+	Reason string `json:"reason"`
+	// Metadata is passed on to the provider objects made for the desired state, such as the order it is for
+	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
 type PaymentCommand struct {
-	ID             uuid.UUID
-	DesiredStateID uuid.UUID
-	Action         consts.PaymentCommandAction
-	Amount         uint
-	Attempts       uint
-	Status         consts.PaymentCommandStatus
-	Error          string
+	ID             uuid.UUID                   `json:"id"`
+	DesiredStateID uuid.UUID                   `json:"desired_state_id"`
+	Action         consts.PaymentCommandAction `json:"action"`
+	Amount         uint                        `json:"amount"`
+	Attempts       uint                        `json:"attempts"`
+	Status         consts.PaymentCommandStatus `json:"status"`
+	Error          string                      `json:"error"`
+	// Settled is the amount the provider moved when the command completed, which may be less than Amount for
+	// captures, releases and refunds
+	Settled uint `json:"settled,omitempty"`
+	// ProviderFee is what the provider is estimated to have taken of the amount settled
+	ProviderFee uint `json:"provider_fee,omitempty"`
+	// StateVersion is the version of the actual state the command was generated from
+	StateVersion uint64 `json:"state_version"`
+	// Policy is the decision of the policy which evaluated the command, if any
+	Policy PolicyDecision `json:"policy"`
+	// Review is the approval or rejection of a command which needed one
+	Review Review `json:"review"`
+	// Metadata is passed on to the provider objects made for the command, over the metadata of its desired state
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// TransitionError is returned when a command cannot move from its status to another
+type TransitionError struct {
+	CommandID uuid.UUID
+	From      consts.PaymentCommandStatus
+	To        consts.PaymentCommandStatus
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("command %s cannot move from %q to %q", e.CommandID, e.From, e.To)
+}
+
+func (e *TransitionError) Is(target error) bool {
+	return target == errors.ErrIllegalTransition
+}
+
+// Transition moves the command to status to, or returns a *TransitionError if the transition table does not allow it
+func (c *PaymentCommand) Transition(to consts.PaymentCommandStatus) error {
+	if !c.Status.CanTransitionTo(to) {
+		return &TransitionError{CommandID: c.ID, From: c.Status, To: to}
+	}
+	c.Status = to
+	return nil
+}
+
+// PolicyDecision records why a policy allowed, trimmed or held a command
+type PolicyDecision struct {
+	Name    string               `json:"name"`
+	Outcome consts.PolicyOutcome `json:"outcome"`
+	Reason  string               `json:"reason"`
+	// RequestedAmount is the amount of the command before it was trimmed
+	RequestedAmount uint `json:"requested_amount"`
+}
+
+// Review records who approved or rejected a command, and why
+type Review struct {
+	Actor    string    `json:"actor"`
+	Reason   string    `json:"reason"`
+	Date     time.Time `json:"date"`
+	Approved bool      `json:"approved"`
 }
 
 func (d DesiredState) generateCommand(cmd consts.PaymentCommandAction, amount uint) PaymentCommand {
@@ -2,6 +2,7 @@ package resolver_test
 
 import (
 	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/errors"
 	"github.com/davidjwilkins/declarative-payments/payments/resolver"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
@@ -39,3 +40,40 @@ func TestDesiredState(t *testing.T) {
 		})
 	}
 }
+
+func TestPaymentCommand_Transition(t *testing.T) {
+	d := resolver.DesiredState{ID: uuid.New()}
+	t.Run("Legal transitions", func(t *testing.T) {
+		cmd := d.Charge(100)
+		assert.NoError(t, cmd.Transition(consts.PaymentCommandStatusError))
+		assert.NoError(t, cmd.Transition(consts.PaymentCommandStatusPending), "Errored commands are retried")
+		assert.NoError(t, cmd.Transition(consts.PaymentCommandStatusAwaitingApproval))
+		assert.NoError(t, cmd.Transition(consts.PaymentCommandStatusPending))
+		assert.NoError(t, cmd.Transition(consts.PaymentCommandStatusComplete))
+		assert.Equal(t, consts.PaymentCommandStatusComplete, cmd.Status)
+	})
+	t.Run("Illegal transitions", func(t *testing.T) {
+		cmd := d.Charge(100)
+		assert.NoError(t, cmd.Transition(consts.PaymentCommandStatusFailed))
+		err := cmd.Transition(consts.PaymentCommandStatusPending)
+		assert.True(t, errors.Is(err, errors.ErrIllegalTransition), "Final statuses are final")
+		var transitionErr *resolver.TransitionError
+		assert.ErrorAs(t, err, &transitionErr)
+		assert.Equal(t, resolver.TransitionError{CommandID: cmd.ID, From: consts.PaymentCommandStatusFailed, To: consts.PaymentCommandStatusPending}, *transitionErr)
+		assert.Equal(t, consts.PaymentCommandStatusFailed, cmd.Status, "Status is unchanged")
+
+		cmd = d.Charge(100)
+		assert.NoError(t, cmd.Transition(consts.PaymentCommandStatusHeld))
+		assert.True(t, errors.Is(cmd.Transition(consts.PaymentCommandStatusComplete), errors.ErrIllegalTransition), "Held commands must be released first")
+		assert.NoError(t, cmd.Transition(consts.PaymentCommandStatusPending))
+		assert.True(t, errors.Is(cmd.Transition(consts.PaymentCommandStatusRejected), errors.ErrIllegalTransition), "Only commands awaiting approval can be rejected")
+	})
+	t.Run("Terminal statuses", func(t *testing.T) {
+		for _, status := range []consts.PaymentCommandStatus{consts.PaymentCommandStatusComplete, consts.PaymentCommandStatusFailed, consts.PaymentCommandStatusRejected} {
+			assert.True(t, status.Terminal(), status)
+		}
+		for _, status := range []consts.PaymentCommandStatus{consts.PaymentCommandStatusPending, consts.PaymentCommandStatusError, consts.PaymentCommandStatusHeld, consts.PaymentCommandStatusAwaitingApproval} {
+			assert.False(t, status.Terminal(), status)
+		}
+	})
+}
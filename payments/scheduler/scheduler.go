@@ -0,0 +1,171 @@
+package scheduler
+
+import (
+	"context"
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments/resolver"
+	"github.com/google/uuid"
+	"sync"
+	"time"
+)
+
+// Applier resolves a desired state.  A *payments.Manager is an Applier.
+type Applier interface {
+	Apply(ctx context.Context, d resolver.DesiredState) ([]resolver.PaymentCommand, []error)
+}
+
+// Entry is a desired state waiting for its date
+type Entry struct {
+	State    resolver.DesiredState
+	Status   consts.ScheduledStateStatus
+	Attempts uint
+	Errors   []string
+	// ReplacedBy is the ID of the desired state which replaced this one, if any
+	ReplacedBy uuid.UUID
+}
+
+func (e Entry) pending() bool {
+	return e.Status == consts.ScheduledStateStatusPending
+}
+
+// Scheduler holds desired states dated in the future, and applies them once their date arrives
+type Scheduler struct {
+	// lock stops an entry being cancelled or replaced while it is being applied
+	lock    sync.Mutex
+	store   Store
+	applier Applier
+	clock   clock.Clock
+}
+
+func New(store Store, applier Applier, c clock.Clock) *Scheduler {
+	return &Scheduler{
+		store:   store,
+		applier: applier,
+		clock:   c,
+	}
+}
+
+// Schedule stores d to be applied once its date has arrived
+func (s *Scheduler) Schedule(d resolver.DesiredState) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.store.Save(Entry{
+		State:  d,
+		Status: consts.ScheduledStateStatusPending,
+	})
+}
+
+func (s *Scheduler) cancel(id uuid.UUID, replacedBy uuid.UUID) error {
+	e, err := s.store.Get(id)
+	if err != nil {
+		return err
+	}
+	if !e.pending() {
+		return errors.ErrScheduledStateNotPending
+	}
+	e.Status = consts.ScheduledStateStatusCancelled
+	e.ReplacedBy = replacedBy
+	return s.store.Save(e)
+}
+
+// Cancel stops a pending desired state from being applied
+func (s *Scheduler) Cancel(id uuid.UUID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.cancel(id, uuid.Nil)
+}
+
+// Replace cancels a pending desired state, and schedules d in its place
+func (s *Scheduler) Replace(id uuid.UUID, d resolver.DesiredState) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.cancel(id, d.ID); err != nil {
+		return err
+	}
+	return s.store.Save(Entry{
+		State:  d,
+		Status: consts.ScheduledStateStatusPending,
+	})
+}
+
+// Get returns the entry for a scheduled desired state
+func (s *Scheduler) Get(id uuid.UUID) (Entry, error) {
+	return s.store.Get(id)
+}
+
+// Pending returns the desired states waiting to be applied for externalID, earliest first
+func (s *Scheduler) Pending(externalID uuid.UUID) ([]Entry, error) {
+	pending, err := s.store.Pending()
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	for _, e := range pending {
+		if e.State.ExternalID == externalID {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// retryable reports whether the errors from applying a desired state may go away if it is applied again
+func retryable(errs []error) bool {
+	for _, err := range errs {
+		if errors.Is(err, errors.ErrRetryable) || errors.Is(err, errors.ErrLockHeld) || errors.Is(err, errors.ErrStaleState) {
+			return true
+		}
+	}
+	return false
+}
+
+// Tick applies every pending desired state whose date has arrived, earliest first, and returns the entries it applied.
+// Desired states which fail with retryable errors stay pending, to be tried again on the next tick.
+func (s *Scheduler) Tick(ctx context.Context) ([]Entry, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	pending, err := s.store.Pending()
+	if err != nil {
+		return nil, err
+	}
+	now := s.clock.Now()
+	var applied []Entry
+	for _, e := range pending {
+		if e.State.Date.After(now) {
+			break
+		}
+		_, errs := s.applier.Apply(ctx, e.State)
+		e.Attempts++
+		e.Errors = nil
+		for _, err := range errs {
+			e.Errors = append(e.Errors, err.Error())
+		}
+		if len(errs) == 0 {
+			e.Status = consts.ScheduledStateStatusApplied
+		} else if !retryable(errs) {
+			e.Status = consts.ScheduledStateStatusFailed
+		}
+		if err := s.store.Save(e); err != nil {
+			return applied, err
+		}
+		applied = append(applied, e)
+	}
+	return applied, nil
+}
+
+// Run ticks every interval until ctx is done
+func (s *Scheduler) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if _, err := s.Tick(ctx); err != nil {
+				return err
+			}
+		}
+	}
+}
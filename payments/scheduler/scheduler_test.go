@@ -0,0 +1,147 @@
+package scheduler_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments"
+	"github.com/davidjwilkins/declarative-payments/payments/handlers"
+	"github.com/davidjwilkins/declarative-payments/payments/resolver"
+	"github.com/davidjwilkins/declarative-payments/payments/scheduler"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type applierFunc func(ctx context.Context, d resolver.DesiredState) ([]resolver.PaymentCommand, []error)
+
+func (f applierFunc) Apply(ctx context.Context, d resolver.DesiredState) ([]resolver.PaymentCommand, []error) {
+	return f(ctx, d)
+}
+
+func TestScheduler(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	managed := func() (*scheduler.Scheduler, payments.StateStore, *clock.Mock, func()) {
+		c := clock.NewMock(now)
+		store := payments.NewMemoryStateStore()
+		m := payments.NewManager(store, func(state payments.ActualState) (payments.PartnerHandler, payments.UserHandler, error) {
+			return handlers.NewPartnerMock(), handlers.NewUserMock(), nil
+		}, payments.WithHandlerOptions(payments.WithClock(c)))
+		return scheduler.New(scheduler.NewMemoryStore(), m, c), store, c, m.Close
+	}
+	desired := func(externalID uuid.UUID, date time.Time, amount int) resolver.DesiredState {
+		return resolver.DesiredState{
+			ID:         uuid.New(),
+			ExternalID: externalID,
+			UserID:     uuid.New(),
+			PartnerID:  uuid.New(),
+			Date:       date,
+			Bucket:     "test",
+			Amount:     amount,
+		}
+	}
+	t.Run("Applies states once they are due", func(t *testing.T) {
+		s, store, c, done := managed()
+		defer done()
+		d := desired(uuid.New(), now.Add(24*time.Hour), 1000)
+		assert.NoError(t, s.Schedule(d))
+		applied, err := s.Tick(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(applied), "States are not applied early")
+		pending, err := s.Pending(d.ExternalID)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(pending))
+		c.Advance(24 * time.Hour)
+		applied, err = s.Tick(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(applied))
+		assert.Equal(t, consts.ScheduledStateStatusApplied, applied[0].Status)
+		stored, err := store.Load(d.ExternalID)
+		assert.NoError(t, err)
+		assert.Equal(t, 1000, stored.Amount)
+		applied, err = s.Tick(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(applied), "States are only applied once")
+	})
+	t.Run("Applies states in date order", func(t *testing.T) {
+		s, store, c, done := managed()
+		defer done()
+		externalID := uuid.New()
+		later := desired(externalID, now.Add(2*time.Hour), 500)
+		earlier := later
+		earlier.ID = uuid.New()
+		earlier.Date = now.Add(time.Hour)
+		earlier.Amount = 1000
+		assert.NoError(t, s.Schedule(later))
+		assert.NoError(t, s.Schedule(earlier))
+		c.Advance(2 * time.Hour)
+		applied, err := s.Tick(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(applied))
+		assert.Equal(t, earlier.ID, applied[0].State.ID)
+		stored, err := store.Load(externalID)
+		assert.NoError(t, err)
+		assert.Equal(t, 500, stored.Amount)
+	})
+	t.Run("Cancelled states are not applied", func(t *testing.T) {
+		s, store, c, done := managed()
+		defer done()
+		d := desired(uuid.New(), now.Add(time.Hour), 1000)
+		assert.NoError(t, s.Schedule(d))
+		assert.NoError(t, s.Cancel(d.ID))
+		assert.True(t, errors.Is(s.Cancel(d.ID), errors.ErrScheduledStateNotPending))
+		assert.True(t, errors.Is(s.Cancel(uuid.New()), errors.ErrScheduledStateNotFound))
+		c.Advance(time.Hour)
+		applied, err := s.Tick(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(applied))
+		_, err = store.Load(d.ExternalID)
+		assert.True(t, errors.Is(err, errors.ErrStateNotFound))
+	})
+	t.Run("Replaced states are not applied", func(t *testing.T) {
+		s, store, c, done := managed()
+		defer done()
+		d := desired(uuid.New(), now.Add(time.Hour), 1000)
+		assert.NoError(t, s.Schedule(d))
+		replacement := d
+		replacement.ID = uuid.New()
+		replacement.Amount = 1500
+		assert.NoError(t, s.Replace(d.ID, replacement))
+		entry, err := s.Get(d.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, consts.ScheduledStateStatusCancelled, entry.Status)
+		assert.Equal(t, replacement.ID, entry.ReplacedBy)
+		c.Advance(time.Hour)
+		applied, err := s.Tick(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(applied))
+		assert.Equal(t, replacement.ID, applied[0].State.ID)
+		stored, err := store.Load(d.ExternalID)
+		assert.NoError(t, err)
+		assert.Equal(t, 1500, stored.Amount)
+		assert.True(t, errors.Is(s.Replace(replacement.ID, d), errors.ErrScheduledStateNotPending), "Applied states cannot be replaced")
+	})
+	t.Run("Retryable failures stay pending", func(t *testing.T) {
+		c := clock.NewMock(now)
+		var errs []error
+		s := scheduler.New(scheduler.NewMemoryStore(), applierFunc(func(ctx context.Context, d resolver.DesiredState) ([]resolver.PaymentCommand, []error) {
+			return nil, errs
+		}), c)
+		d := desired(uuid.New(), now, 1000)
+		assert.NoError(t, s.Schedule(d))
+		errs = []error{fmt.Errorf("timeout - %w", errors.ErrRetryable)}
+		applied, err := s.Tick(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, consts.ScheduledStateStatusPending, applied[0].Status)
+		assert.Equal(t, []string{"timeout - retryable"}, applied[0].Errors)
+		errs = []error{errors.ErrChargeFailed}
+		applied, err = s.Tick(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, consts.ScheduledStateStatusFailed, applied[0].Status)
+		assert.Equal(t, uint(2), applied[0].Attempts)
+	})
+}
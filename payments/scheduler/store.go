@@ -0,0 +1,59 @@
+package scheduler
+
+import (
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/google/uuid"
+	"sort"
+	"sync"
+)
+
+type Store interface {
+	Save(e Entry) error
+	// Get returns the entry for a desired state, or errors.ErrScheduledStateNotFound
+	Get(id uuid.UUID) (Entry, error)
+	// Pending returns the pending entries, earliest first
+	Pending() ([]Entry, error)
+}
+
+type memoryStore struct {
+	lock    sync.RWMutex
+	entries map[uuid.UUID]Entry
+}
+
+func NewMemoryStore() *memoryStore {
+	return &memoryStore{
+		entries: make(map[uuid.UUID]Entry),
+	}
+}
+
+func (m *memoryStore) Save(e Entry) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.entries[e.State.ID] = e
+	return nil
+}
+
+func (m *memoryStore) Get(id uuid.UUID) (Entry, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	e, ok := m.entries[id]
+	if !ok {
+		return Entry{}, errors.ErrScheduledStateNotFound
+	}
+	return e, nil
+}
+
+func (m *memoryStore) Pending() ([]Entry, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var pending []Entry
+	for _, e := range m.entries {
+		if e.pending() {
+			pending = append(pending, e)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].State.Date.Before(pending[j].State.Date)
+	})
+	return pending, nil
+}
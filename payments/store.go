@@ -0,0 +1,79 @@
+package payments
+
+import (
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/google/uuid"
+	"sort"
+	"sync"
+)
+
+// StateStore persists actual states, keyed by ExternalID
+type StateStore interface {
+	// Load returns the stored state, or errors.ErrStateNotFound
+	Load(externalID uuid.UUID) (ActualState, error)
+	// Save stores state, provided the stored version is still previousVersion (or nothing is stored yet and
+	// previousVersion is 0).  Otherwise, it returns errors.ErrStaleState.
+	Save(state ActualState, previousVersion uint64) error
+	// Find returns the stored states with any of the given statuses, oldest first
+	Find(statuses ...consts.PaymentStatus) ([]ActualState, error)
+}
+
+// NeedsAttention returns the stored states which errored or failed, and those still running, which include any whose
+// run never finished
+func NeedsAttention(store StateStore) ([]ActualState, error) {
+	return store.Find(consts.PaymentStatusError, consts.PaymentStatusFailed, consts.PaymentStatusRunning)
+}
+
+type memoryStateStore struct {
+	lock   sync.RWMutex
+	states map[uuid.UUID]ActualState
+}
+
+func NewMemoryStateStore() *memoryStateStore {
+	return &memoryStateStore{
+		states: make(map[uuid.UUID]ActualState),
+	}
+}
+
+func (m *memoryStateStore) Load(externalID uuid.UUID) (ActualState, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	state, ok := m.states[externalID]
+	if !ok {
+		return ActualState{}, errors.ErrStateNotFound
+	}
+	return state, nil
+}
+
+func (m *memoryStateStore) Save(state ActualState, previousVersion uint64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	stored, ok := m.states[state.ExternalID]
+	if (ok && stored.Version != previousVersion) || (!ok && previousVersion != 0) {
+		return errors.ErrStaleState
+	}
+	m.states[state.ExternalID] = state
+	return nil
+}
+
+func (m *memoryStateStore) Find(statuses ...consts.PaymentStatus) ([]ActualState, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var found []ActualState
+	for _, state := range m.states {
+		for _, status := range statuses {
+			if state.Status == status {
+				found = append(found, state)
+				break
+			}
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if !found[i].Date.Equal(found[j].Date) {
+			return found[i].Date.Before(found[j].Date)
+		}
+		return found[i].ExternalID.String() < found[j].ExternalID.String()
+	})
+	return found, nil
+}
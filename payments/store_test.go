@@ -0,0 +1,69 @@
+package payments_test
+
+import (
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments"
+	"github.com/davidjwilkins/declarative-payments/payments/resolver"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMemoryStateStore(t *testing.T) {
+	state := payments.ActualState{
+		DesiredState: resolver.DesiredState{
+			ID:         uuid.New(),
+			ExternalID: uuid.New(),
+			Amount:     100,
+		},
+	}
+	t.Run("Missing state is not found", func(t *testing.T) {
+		store := payments.NewMemoryStateStore()
+		_, err := store.Load(state.ExternalID)
+		assert.True(t, errors.Is(err, errors.ErrStateNotFound))
+	})
+	t.Run("Can save and load", func(t *testing.T) {
+		store := payments.NewMemoryStateStore()
+		assert.NoError(t, store.Save(state, 0))
+		loaded, err := store.Load(state.ExternalID)
+		assert.NoError(t, err)
+		assert.Equal(t, state, loaded)
+	})
+	t.Run("Save must be from the stored version", func(t *testing.T) {
+		store := payments.NewMemoryStateStore()
+		next := state
+		next.Version = 1
+		assert.True(t, errors.Is(store.Save(next, 1), errors.ErrStaleState), "Cannot save from a version which was never stored")
+		assert.NoError(t, store.Save(next, 0))
+		next.Version = 2
+		assert.True(t, errors.Is(store.Save(next, 0), errors.ErrStaleState), "Cannot save from an old version")
+		assert.NoError(t, store.Save(next, 1))
+		loaded, err := store.Load(state.ExternalID)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(2), loaded.Version)
+	})
+	t.Run("Can find states needing attention", func(t *testing.T) {
+		store := payments.NewMemoryStateStore()
+		now := time.Now()
+		save := func(status consts.PaymentStatus, age time.Duration) payments.ActualState {
+			s := payments.ActualState{
+				DesiredState: resolver.DesiredState{ExternalID: uuid.New(), Date: now.Add(-age)},
+				Status:       status,
+			}
+			assert.NoError(t, store.Save(s, 0))
+			return s
+		}
+		save(consts.PaymentStatusComplete, time.Hour)
+		save(consts.PaymentStatusPending, time.Hour)
+		errored := save(consts.PaymentStatusError, time.Minute)
+		failed := save(consts.PaymentStatusFailed, time.Hour)
+		found, err := payments.NeedsAttention(store)
+		assert.NoError(t, err)
+		assert.Equal(t, []payments.ActualState{failed, errored}, found, "Oldest first")
+		found, err = store.Find(consts.PaymentStatusPending)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(found))
+	})
+}
@@ -0,0 +1,238 @@
+package subscription
+
+import (
+	"fmt"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments/resolver"
+	"github.com/davidjwilkins/declarative-payments/payments/scheduler"
+	"github.com/google/uuid"
+	"math"
+	"time"
+)
+
+// Interval is the length of a billing period
+type Interval struct {
+	Years  int
+	Months int
+	Days   int
+}
+
+var Weekly = Interval{Days: 7}
+var Monthly = Interval{Months: 1}
+var Yearly = Interval{Years: 1}
+
+// advances reports whether every period ends after it starts.  Negative parts are rejected even when the others
+// outweigh them, since months and years vary in length.
+func (i Interval) advances() bool {
+	return i.Years >= 0 && i.Months >= 0 && i.Days >= 0 && i != (Interval{})
+}
+
+// after returns the start of the nth period after start
+func (i Interval) after(start time.Time, n int) time.Time {
+	return start.AddDate(i.Years*n, i.Months*n, i.Days*n)
+}
+
+type Plan struct {
+	// Amount is charged at the start of every period
+	Amount   int
+	Interval Interval
+	// PartnerShare is the partner's share of what the user pays, in basis points
+	PartnerShare uint
+	// Trial is how long after the subscription starts the first period begins
+	Trial time.Duration
+}
+
+func (p Plan) validate() error {
+	if p.Amount < 0 || p.PartnerShare > 10000 || !p.Interval.advances() || p.Trial < 0 {
+		return errors.ErrInvalidPlan
+	}
+	return nil
+}
+
+func (p Plan) partnerShare(amount int) int {
+	return int(math.Round(float64(amount) * float64(p.PartnerShare) / 10000))
+}
+
+type change struct {
+	at   time.Time
+	plan Plan
+}
+
+type cancellation struct {
+	at     time.Time
+	refund bool
+}
+
+// Subscription generates the cumulative desired states of a recurring payment
+type Subscription struct {
+	ExternalID uuid.UUID
+	UserID     uuid.UUID
+	PartnerID  uuid.UUID
+	Bucket     string
+	Start      time.Time
+	changes    []change
+	cancelled  *cancellation
+}
+
+func New(externalID, userID, partnerID uuid.UUID, bucket string, start time.Time, plan Plan) (*Subscription, error) {
+	if err := plan.validate(); err != nil {
+		return nil, err
+	}
+	return &Subscription{
+		ExternalID: externalID,
+		UserID:     userID,
+		PartnerID:  partnerID,
+		Bucket:     bucket,
+		Start:      start,
+		changes:    []change{{at: start, plan: plan}},
+	}, nil
+}
+
+// ChangePlan switches to plan at the given time.  The unused part of the current period is credited, and if the
+// interval is unchanged, the rest of the period is charged at the new plan's rate.  Otherwise, a new period starts.
+func (s *Subscription) ChangePlan(at time.Time, plan Plan) error {
+	if err := plan.validate(); err != nil {
+		return err
+	}
+	if s.cancelled != nil {
+		return errors.ErrSubscriptionCancelled
+	}
+	if !at.After(s.changes[len(s.changes)-1].at) {
+		return errors.ErrChangeOutOfOrder
+	}
+	s.changes = append(s.changes, change{at: at, plan: plan})
+	return nil
+}
+
+// Cancel ends the subscription at the given time, refunding the unused part of the current period if refund is true
+func (s *Subscription) Cancel(at time.Time, refund bool) error {
+	if s.cancelled != nil {
+		return errors.ErrSubscriptionCancelled
+	}
+	if !at.After(s.changes[len(s.changes)-1].at) {
+		return errors.ErrChangeOutOfOrder
+	}
+	s.cancelled = &cancellation{at: at, refund: refund}
+	return nil
+}
+
+// event is a change in what the user has paid
+type event struct {
+	kind    string
+	at      time.Time
+	amount  int
+	partner int
+}
+
+// events returns every change in what the user has paid, up to and including until
+func (s *Subscription) events(until time.Time) []event {
+	var events []event
+	plan := s.changes[0].plan
+	trialEnd := s.Start.Add(plan.Trial)
+	periodStart := trialEnd
+	// period is the number of periods since periodStart which have been charged
+	period := 0
+	for i := 0; ; i++ {
+		end := time.Time{}
+		if i+1 < len(s.changes) {
+			end = s.changes[i+1].at
+		} else if s.cancelled != nil {
+			end = s.cancelled.at
+		}
+		for {
+			charge := plan.Interval.after(periodStart, period)
+			if charge.After(until) || (!end.IsZero() && !charge.Before(end)) {
+				break
+			}
+			events = append(events, event{"period", charge, plan.Amount, plan.partnerShare(plan.Amount)})
+			period++
+		}
+		if end.IsZero() || end.After(until) {
+			return events
+		}
+		// unused is the fraction of the current period after end, and credit is what was paid for it
+		unused := 0.0
+		if period > 0 {
+			from, to := plan.Interval.after(periodStart, period-1), plan.Interval.after(periodStart, period)
+			unused = to.Sub(end).Seconds() / to.Sub(from).Seconds()
+		}
+		credit := int(math.Round(float64(plan.Amount) * unused))
+		if i+1 >= len(s.changes) {
+			if s.cancelled.refund && credit > 0 {
+				events = append(events, event{"cancel", end, -credit, -plan.partnerShare(credit)})
+			}
+			return events
+		}
+		next := s.changes[i+1].plan
+		switch {
+		case end.Before(trialEnd):
+			// Nothing has been paid yet, so the new plan just starts when the trial ends
+		case next.Interval == plan.Interval:
+			charge := int(math.Round(float64(next.Amount) * unused))
+			if charge != credit {
+				events = append(events, event{"change", end, charge - credit, next.partnerShare(charge) - plan.partnerShare(credit)})
+			}
+		default:
+			events = append(events, event{"change", end, next.Amount - credit, next.partnerShare(next.Amount) - plan.partnerShare(credit)})
+			periodStart = end
+			period = 1
+		}
+		plan = next
+	}
+}
+
+// States returns the cumulative desired states of the subscription, up to and including until.  Their IDs are derived
+// from their contents, so generating them again gives the same IDs unless the subscription changed.
+func (s *Subscription) States(until time.Time) []resolver.DesiredState {
+	var states []resolver.DesiredState
+	amount, partner := 0, 0
+	for _, e := range s.events(until) {
+		amount += e.amount
+		partner += e.partner
+		key := fmt.Sprintf("subscription:%s:%d:%d:%d", e.kind, e.at.UnixNano(), amount, partner)
+		states = append(states, resolver.DesiredState{
+			ID:            uuid.NewSHA1(s.ExternalID, []byte(key)),
+			ExternalID:    s.ExternalID,
+			UserID:        s.UserID,
+			PartnerID:     s.PartnerID,
+			Date:          e.at,
+			Bucket:        s.Bucket,
+			Amount:        amount,
+			PartnerAmount: partner,
+			Source:        "subscription",
+			Reason:        e.kind,
+		})
+	}
+	return states
+}
+
+// Sync schedules the desired states up to until which are not already scheduled, and cancels any pending ones which no
+// longer apply because the subscription changed.
+func (s *Subscription) Sync(sch *scheduler.Scheduler, until time.Time) error {
+	states := s.States(until)
+	wanted := make(map[uuid.UUID]struct{}, len(states))
+	for _, d := range states {
+		wanted[d.ID] = struct{}{}
+	}
+	pending, err := sch.Pending(s.ExternalID)
+	if err != nil {
+		return err
+	}
+	for _, e := range pending {
+		if _, ok := wanted[e.State.ID]; !ok {
+			if err := sch.Cancel(e.State.ID); err != nil {
+				return err
+			}
+		}
+	}
+	for _, d := range states {
+		_, err := sch.Get(d.ID)
+		if errors.Is(err, errors.ErrScheduledStateNotFound) {
+			err = sch.Schedule(d)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
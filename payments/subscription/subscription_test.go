@@ -0,0 +1,151 @@
+package subscription_test
+
+import (
+	"context"
+	"github.com/davidjwilkins/declarative-payments/clock"
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments/resolver"
+	"github.com/davidjwilkins/declarative-payments/payments/scheduler"
+	"github.com/davidjwilkins/declarative-payments/payments/subscription"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type applierFunc func(ctx context.Context, d resolver.DesiredState) ([]resolver.PaymentCommand, []error)
+
+func (f applierFunc) Apply(ctx context.Context, d resolver.DesiredState) ([]resolver.PaymentCommand, []error) {
+	return f(ctx, d)
+}
+
+func TestSubscription(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	weekly := subscription.Plan{Amount: 700, Interval: subscription.Weekly, PartnerShare: 2000}
+	subscribe := func(plan subscription.Plan) *subscription.Subscription {
+		s, err := subscription.New(uuid.New(), uuid.New(), uuid.New(), "test", start, plan)
+		assert.NoError(t, err)
+		return s
+	}
+	amounts := func(states []resolver.DesiredState) ([]int, []int) {
+		var amounts, partner []int
+		for _, d := range states {
+			amounts = append(amounts, d.Amount)
+			partner = append(partner, d.PartnerAmount)
+		}
+		return amounts, partner
+	}
+	t.Run("Charges at the start of each period", func(t *testing.T) {
+		s := subscribe(subscription.Plan{Amount: 1000, Interval: subscription.Monthly, PartnerShare: 2000})
+		states := s.States(time.Date(2021, 3, 15, 0, 0, 0, 0, time.UTC))
+		amount, partner := amounts(states)
+		assert.Equal(t, []int{1000, 2000, 3000}, amount, "Amounts are cumulative")
+		assert.Equal(t, []int{200, 400, 600}, partner)
+		assert.Equal(t, time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC), states[1].Date)
+		for _, d := range states {
+			assert.Equal(t, s.ExternalID, d.ExternalID)
+			assert.Equal(t, "test", d.Bucket)
+		}
+		assert.Equal(t, states, s.States(time.Date(2021, 3, 15, 0, 0, 0, 0, time.UTC)), "IDs are deterministic")
+	})
+	t.Run("First period starts after the trial", func(t *testing.T) {
+		plan := weekly
+		plan.Trial = 14 * day
+		states := subscribe(plan).States(start.Add(20 * day))
+		assert.Equal(t, 1, len(states))
+		assert.Equal(t, start.Add(14*day), states[0].Date)
+	})
+	t.Run("Plan changes are prorated", func(t *testing.T) {
+		s := subscribe(weekly)
+		upgraded := weekly
+		upgraded.Amount = 1400
+		assert.NoError(t, s.ChangePlan(start.Add(4*day), upgraded))
+		states := s.States(start.Add(7 * day))
+		amount, partner := amounts(states)
+		assert.Equal(t, []int{700, 1000, 2400}, amount, "Unused 3/7 of the period is credited 300 and charged 600")
+		assert.Equal(t, []int{140, 200, 480}, partner)
+		assert.Equal(t, start.Add(4*day), states[1].Date)
+	})
+	t.Run("Changing interval starts a new period", func(t *testing.T) {
+		s := subscribe(weekly)
+		assert.NoError(t, s.ChangePlan(start.Add(4*day), subscription.Plan{Amount: 3000, Interval: subscription.Monthly}))
+		states := s.States(start.Add(4*day).AddDate(0, 1, 0))
+		amount, partner := amounts(states)
+		assert.Equal(t, []int{700, 3400, 6400}, amount)
+		assert.Equal(t, []int{140, 80, 80}, partner)
+		assert.Equal(t, start.Add(4*day).AddDate(0, 1, 0), states[2].Date)
+	})
+	t.Run("Changes during the trial are not prorated", func(t *testing.T) {
+		plan := weekly
+		plan.Trial = 7 * day
+		s := subscribe(plan)
+		upgraded := weekly
+		upgraded.Amount = 1400
+		assert.NoError(t, s.ChangePlan(start.Add(3*day), upgraded))
+		amount, _ := amounts(s.States(start.Add(14 * day)))
+		assert.Equal(t, []int{1400, 2800}, amount)
+	})
+	t.Run("Cancellation refunds the unused period", func(t *testing.T) {
+		s := subscribe(weekly)
+		assert.NoError(t, s.Cancel(start.Add(11*day), true))
+		amount, partner := amounts(s.States(start.Add(30 * day)))
+		assert.Equal(t, []int{700, 1400, 1100}, amount)
+		assert.Equal(t, []int{140, 280, 220}, partner)
+
+		s = subscribe(weekly)
+		assert.NoError(t, s.Cancel(start.Add(11*day), false))
+		amount, _ = amounts(s.States(start.Add(30 * day)))
+		assert.Equal(t, []int{700, 1400}, amount, "Nothing is charged after cancellation")
+	})
+	t.Run("Changes are validated", func(t *testing.T) {
+		_, err := subscription.New(uuid.New(), uuid.New(), uuid.New(), "test", start, subscription.Plan{Amount: 100})
+		assert.True(t, errors.Is(err, errors.ErrInvalidPlan), "Interval is required")
+		_, err = subscription.New(uuid.New(), uuid.New(), uuid.New(), "test", start, subscription.Plan{Amount: 100, Interval: subscription.Weekly, PartnerShare: 10001})
+		assert.True(t, errors.Is(err, errors.ErrInvalidPlan), "Partner cannot get more than the user pays")
+		for _, interval := range []subscription.Interval{{Days: -7}, {Months: 1, Days: -40}, {Years: -1, Months: 13}} {
+			_, err = subscription.New(uuid.New(), uuid.New(), uuid.New(), "test", start, subscription.Plan{Amount: 100, Interval: interval})
+			assert.True(t, errors.Is(err, errors.ErrInvalidPlan), "Interval %v must advance", interval)
+		}
+		_, err = subscription.New(uuid.New(), uuid.New(), uuid.New(), "test", start, subscription.Plan{Amount: 100, Interval: subscription.Weekly, Trial: -day})
+		assert.True(t, errors.Is(err, errors.ErrInvalidPlan), "Trial cannot be negative")
+		s := subscribe(weekly)
+		assert.True(t, errors.Is(s.ChangePlan(start, weekly), errors.ErrChangeOutOfOrder))
+		assert.True(t, errors.Is(s.ChangePlan(start.Add(day), subscription.Plan{Amount: 100, Interval: subscription.Interval{Days: -7}}), errors.ErrInvalidPlan))
+		assert.NoError(t, s.ChangePlan(start.Add(day), weekly))
+		assert.True(t, errors.Is(s.Cancel(start, true), errors.ErrChangeOutOfOrder))
+		assert.NoError(t, s.Cancel(start.Add(2*day), true))
+		assert.True(t, errors.Is(s.ChangePlan(start.Add(3*day), weekly), errors.ErrSubscriptionCancelled))
+		assert.True(t, errors.Is(s.Cancel(start.Add(3*day), true), errors.ErrSubscriptionCancelled))
+	})
+	t.Run("Sync feeds the scheduler", func(t *testing.T) {
+		c := clock.NewMock(start)
+		var applied []resolver.DesiredState
+		sch := scheduler.New(scheduler.NewMemoryStore(), applierFunc(func(ctx context.Context, d resolver.DesiredState) ([]resolver.PaymentCommand, []error) {
+			applied = append(applied, d)
+			return nil, nil
+		}), c)
+		s := subscribe(weekly)
+		assert.NoError(t, s.Sync(sch, start.Add(14*day)))
+		assert.NoError(t, s.Sync(sch, start.Add(14*day)), "Syncing again is idempotent")
+		pending, err := sch.Pending(s.ExternalID)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, len(pending))
+
+		c.Advance(day)
+		_, err = sch.Tick(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(applied))
+
+		assert.NoError(t, s.Cancel(start.Add(11*day), true))
+		assert.NoError(t, s.Sync(sch, start.Add(14*day)))
+		pending, err = sch.Pending(s.ExternalID)
+		assert.NoError(t, err)
+		amount, _ := amounts([]resolver.DesiredState{pending[0].State, pending[1].State})
+		assert.Equal(t, []int{1400, 1100}, amount, "States which no longer apply are cancelled")
+		entry, err := sch.Get(applied[0].ID)
+		assert.NoError(t, err)
+		assert.Equal(t, consts.ScheduledStateStatusApplied, entry.Status, "Applied states are left alone")
+	})
+}
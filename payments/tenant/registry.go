@@ -0,0 +1,202 @@
+// Package tenant configures each bucket as a business line, with its own provider credentials, currency, limits and
+// fees.
+//
+// A Registry is loaded from a JSON config file:
+//
+//	{"tenants": [{
+//		"bucket": "retail",
+//		"provider": "stripe",
+//		"currency": "usd",
+//		"credentials": {"secret_key": "env:STRIPE_RETAIL_KEY"},
+//		"limits": {"amount": 100000},
+//		"descriptions": {"description": "Order {{.order}}", "statement_descriptor": "RETAIL {{.order}}"},
+//		"fees": {
+//			"platform": {"usd": {"basis_points": 1000}},
+//			"provider": {"usd": {"basis_points": 290, "fixed": 30}}
+//		}
+//	}]}
+//
+// Credentials of the form "env:NAME" are read from the environment, so secrets need not be kept in the file.
+package tenant
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments"
+	"github.com/davidjwilkins/declarative-payments/payments/fees"
+	"github.com/davidjwilkins/declarative-payments/payments/handlers"
+	"github.com/davidjwilkins/declarative-payments/payments/validation"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Tenant is the configuration of a bucket
+type Tenant struct {
+	Bucket string `json:"bucket"`
+	// Provider is the name of the registered Provider which builds the bucket's handlers
+	Provider    string            `json:"provider"`
+	Currency    string            `json:"currency"`
+	Credentials map[string]string `json:"credentials"`
+	Limits      validation.Limits `json:"limits"`
+	// Descriptions are the templates for what the provider shows of the bucket's payments
+	Descriptions handlers.Descriptions `json:"descriptions"`
+	// Fees are what the platform and provider take of the bucket's payments, which must include its currency
+	Fees fees.Schedules `json:"fees"`
+}
+
+// Provider builds the handlers for a payment in a tenant's bucket
+type Provider func(tenant Tenant, state payments.ActualState) (payments.PartnerHandler, payments.UserHandler, error)
+
+type config struct {
+	Tenants []Tenant `json:"tenants"`
+}
+
+var currency = regexp.MustCompile(`^[a-z]{3}$`)
+
+type Registry struct {
+	lock      sync.RWMutex
+	providers map[string]Provider
+	tenants   map[string]Tenant
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		providers: make(map[string]Provider),
+		tenants:   make(map[string]Tenant),
+	}
+}
+
+// RegisterProvider makes a provider available to tenants by name.  Providers must be registered before the tenants
+// which use them are added.
+func (r *Registry) RegisterProvider(name string, provider Provider) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.providers[name] = provider
+}
+
+// Add adds or replaces the tenant for t.Bucket, resolving any credentials read from the environment
+func (r *Registry) Add(t Tenant) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if t.Bucket == "" {
+		return fmt.Errorf("%w: bucket is required", errors.ErrInvalidTenant)
+	}
+	if !currency.MatchString(t.Currency) {
+		return fmt.Errorf("%w: %s has invalid currency %q", errors.ErrInvalidTenant, t.Bucket, t.Currency)
+	}
+	if _, ok := r.providers[t.Provider]; !ok {
+		return fmt.Errorf("%w: %s uses %q", errors.ErrUnknownProvider, t.Bucket, t.Provider)
+	}
+	if err := t.Descriptions.Parse(); err != nil {
+		return fmt.Errorf("%w: %s has invalid %v", errors.ErrInvalidTenant, t.Bucket, err)
+	}
+	if _, err := t.Fees.For(t.Currency); err != nil {
+		return fmt.Errorf("%w: %s has %v", errors.ErrInvalidTenant, t.Bucket, err)
+	}
+	credentials := make(map[string]string, len(t.Credentials))
+	for name, value := range t.Credentials {
+		if env := strings.TrimPrefix(value, "env:"); env != value {
+			var ok bool
+			if value, ok = os.LookupEnv(env); !ok {
+				return fmt.Errorf("%w: %s credential %s needs $%s", errors.ErrInvalidTenant, t.Bucket, name, env)
+			}
+		}
+		credentials[name] = value
+	}
+	t.Credentials = credentials
+	r.tenants[t.Bucket] = t
+	return nil
+}
+
+// Load adds every tenant in a JSON config.  Unknown fields are rejected, and nothing is added unless every tenant is
+// valid.
+func (r *Registry) Load(reader io.Reader) error {
+	decoder := json.NewDecoder(reader)
+	decoder.DisallowUnknownFields()
+	var c config
+	if err := decoder.Decode(&c); err != nil {
+		return fmt.Errorf("%w: %s", errors.ErrInvalidTenant, err)
+	}
+	staged := NewRegistry()
+	r.lock.RLock()
+	for name, provider := range r.providers {
+		staged.providers[name] = provider
+	}
+	r.lock.RUnlock()
+	for _, t := range c.Tenants {
+		if _, ok := staged.tenants[t.Bucket]; ok {
+			return fmt.Errorf("%w: %s is configured twice", errors.ErrInvalidTenant, t.Bucket)
+		}
+		if err := staged.Add(t); err != nil {
+			return err
+		}
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for bucket, t := range staged.tenants {
+		r.tenants[bucket] = t
+	}
+	return nil
+}
+
+// LoadFile loads the JSON config at path
+func (r *Registry) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return r.Load(f)
+}
+
+// Get returns the tenant for bucket, or errors.ErrUnknownBucket
+func (r *Registry) Get(bucket string) (Tenant, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	t, ok := r.tenants[bucket]
+	if !ok {
+		return Tenant{}, fmt.Errorf("%w: %q", errors.ErrUnknownBucket, bucket)
+	}
+	return t, nil
+}
+
+// Factory returns a payments.HandlerFactory which builds the handlers of a state with its bucket's provider
+func (r *Registry) Factory() payments.HandlerFactory {
+	return func(state payments.ActualState) (payments.PartnerHandler, payments.UserHandler, error) {
+		t, err := r.Get(state.Bucket)
+		if err != nil {
+			return nil, nil, err
+		}
+		r.lock.RLock()
+		provider := r.providers[t.Provider]
+		r.lock.RUnlock()
+		return provider(t, state)
+	}
+}
+
+// Limits returns every tenant's limits, keyed by bucket, for validation.MaxAmounts
+func (r *Registry) Limits() map[string]validation.Limits {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	limits := make(map[string]validation.Limits, len(r.tenants))
+	for bucket, t := range r.tenants {
+		limits[bucket] = t.Limits
+	}
+	return limits
+}
+
+// Fees returns every tenant's fees in its currency, keyed by bucket, for payments.WithFees
+func (r *Registry) Fees() map[string]fees.Fees {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	buckets := make(map[string]fees.Fees, len(r.tenants))
+	for bucket, t := range r.tenants {
+		// Tenants' fees are checked when they are added
+		buckets[bucket], _ = t.Fees.For(t.Currency)
+	}
+	return buckets
+}
@@ -0,0 +1,176 @@
+package tenant_test
+
+import (
+	"context"
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments"
+	"github.com/davidjwilkins/declarative-payments/payments/fees"
+	"github.com/davidjwilkins/declarative-payments/payments/handlers"
+	"github.com/davidjwilkins/declarative-payments/payments/resolver"
+	"github.com/davidjwilkins/declarative-payments/payments/tenant"
+	"github.com/davidjwilkins/declarative-payments/payments/validation"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const config = `{"tenants": [
+	{
+		"bucket": "retail",
+		"provider": "mock",
+		"currency": "usd",
+		"credentials": {"secret_key": "env:TENANT_TEST_KEY", "account": "acct_1"},
+		"limits": {"amount": 5000}
+	},
+	{"bucket": "travel", "provider": "mock", "currency": "eur"}
+]}`
+
+func TestRegistry(t *testing.T) {
+	registry := func() (*tenant.Registry, *[]tenant.Tenant) {
+		var built []tenant.Tenant
+		r := tenant.NewRegistry()
+		r.RegisterProvider("mock", func(t tenant.Tenant, state payments.ActualState) (payments.PartnerHandler, payments.UserHandler, error) {
+			built = append(built, t)
+			return handlers.NewPartnerMock(), handlers.NewUserMock(), nil
+		})
+		return r, &built
+	}
+	t.Run("Loads tenants from a config file", func(t *testing.T) {
+		t.Setenv("TENANT_TEST_KEY", "sk_test_123")
+		path := filepath.Join(t.TempDir(), "tenants.json")
+		assert.NoError(t, os.WriteFile(path, []byte(config), 0600))
+		r, _ := registry()
+		assert.NoError(t, r.LoadFile(path))
+		retail, err := r.Get("retail")
+		assert.NoError(t, err)
+		assert.Equal(t, "usd", retail.Currency)
+		assert.Equal(t, map[string]string{"secret_key": "sk_test_123", "account": "acct_1"}, retail.Credentials, "Credentials are read from the environment")
+		assert.Equal(t, validation.Limits{Amount: 5000}, retail.Limits)
+		travel, err := r.Get("travel")
+		assert.NoError(t, err)
+		assert.Equal(t, "eur", travel.Currency)
+		_, err = r.Get("food")
+		assert.True(t, errors.Is(err, errors.ErrUnknownBucket))
+	})
+	t.Run("Invalid configs are rejected", func(t *testing.T) {
+		t.Setenv("TENANT_TEST_KEY", "sk_test_123")
+		r, _ := registry()
+		load := func(config string) error {
+			return r.Load(strings.NewReader(config))
+		}
+		assert.True(t, errors.Is(load(`{"tenants": [{"bucket": "a", "provider": "mock", "currency": "usd", "colour": "red"}]}`), errors.ErrInvalidTenant), "Unknown fields are rejected")
+		assert.True(t, errors.Is(load(`{"tenants": [{"bucket": "a", "provider": "paypal", "currency": "usd"}]}`), errors.ErrUnknownProvider))
+		assert.True(t, errors.Is(load(`{"tenants": [{"bucket": "a", "provider": "mock", "currency": "USD"}]}`), errors.ErrInvalidTenant))
+		assert.True(t, errors.Is(load(`{"tenants": [{"provider": "mock", "currency": "usd"}]}`), errors.ErrInvalidTenant))
+		assert.True(t, errors.Is(load(`{"tenants": [{"bucket": "a", "provider": "mock", "currency": "usd", "credentials": {"key": "env:TENANT_TEST_MISSING"}}]}`), errors.ErrInvalidTenant))
+		assert.True(t, errors.Is(load(`{"tenants": [{"bucket": "a", "provider": "mock", "currency": "usd", "descriptions": {"description": "Order {{.order"}}]}`), errors.ErrInvalidTenant), "Templates must parse")
+		assert.True(t, errors.Is(load(`{"tenants": [{"bucket": "a", "provider": "mock", "currency": "usd", "fees": {"platform": {"eur": {"fixed": 10}}}}]}`), errors.ErrInvalidTenant), "Fees must include the tenant's currency")
+		assert.True(t, errors.Is(load(`{"tenants": [{"bucket": "a", "provider": "mock", "currency": "usd", "fees": {"provider": {"usd": {"basis_points": 10001}}}}]}`), errors.ErrInvalidTenant))
+		assert.True(t, errors.Is(load(`{"tenants": [
+			{"bucket": "a", "provider": "mock", "currency": "usd"},
+			{"bucket": "a", "provider": "mock", "currency": "eur"}
+		]}`), errors.ErrInvalidTenant), "Buckets are configured once")
+		assert.True(t, errors.Is(load(`{"tenants": [
+			{"bucket": "a", "provider": "mock", "currency": "usd"},
+			{"bucket": "b", "provider": "paypal", "currency": "usd"}
+		]}`), errors.ErrUnknownProvider))
+		_, err := r.Get("a")
+		assert.True(t, errors.Is(err, errors.ErrUnknownBucket), "Nothing is added from an invalid config")
+	})
+	t.Run("Manager builds handlers for each bucket", func(t *testing.T) {
+		t.Setenv("TENANT_TEST_KEY", "sk_test_123")
+		r, built := registry()
+		assert.NoError(t, r.Load(strings.NewReader(config)))
+		m := payments.NewManager(payments.NewMemoryStateStore(), r.Factory(), payments.WithWorkers(1),
+			payments.WithHandlerOptions(payments.WithValidator(validation.New(validation.MaxAmounts(r.Limits())))))
+		defer m.Close()
+		desired := func(bucket string, amount int) resolver.DesiredState {
+			return resolver.DesiredState{
+				ID:         uuid.New(),
+				ExternalID: uuid.New(),
+				UserID:     uuid.New(),
+				PartnerID:  uuid.New(),
+				Date:       time.Now(),
+				Bucket:     bucket,
+				Amount:     amount,
+			}
+		}
+		ctx := context.Background()
+		cmds, errs := m.Apply(ctx, desired("travel", 1000))
+		assert.Equal(t, 0, len(errs))
+		assert.Equal(t, 1, len(cmds))
+		assert.Equal(t, "travel", (*built)[0].Bucket)
+
+		_, errs = m.Apply(ctx, desired("retail", 6000))
+		assert.Equal(t, 1, len(errs))
+		assert.True(t, errors.Is(errs[0], errors.ErrInvalidDesiredState), "Tenant limits are enforced")
+
+		_, errs = m.Apply(ctx, desired("food", 1000))
+		assert.Equal(t, 1, len(errs))
+		assert.True(t, errors.Is(errs[0], errors.ErrUnknownBucket))
+	})
+	t.Run("Fees are taken in each tenant's currency", func(t *testing.T) {
+		r, _ := registry()
+		assert.NoError(t, r.Load(strings.NewReader(`{"tenants": [
+			{"bucket": "retail", "provider": "mock", "currency": "usd", "fees": {
+				"platform": {"usd": {"basis_points": 1000}, "eur": {"basis_points": 2000}},
+				"provider": {"usd": {"basis_points": 290, "fixed": 30}}
+			}},
+			{"bucket": "travel", "provider": "mock", "currency": "eur"}
+		]}`)))
+		assert.Equal(t, map[string]fees.Fees{
+			"retail": {Platform: fees.Fee{BasisPoints: 1000}, Provider: fees.Fee{BasisPoints: 290, Fixed: 30}},
+			"travel": {},
+		}, r.Fees())
+		store := payments.NewMemoryStateStore()
+		m := payments.NewManager(store, r.Factory(), payments.WithWorkers(1),
+			payments.WithHandlerOptions(payments.WithFees(r.Fees())))
+		defer m.Close()
+		d := resolver.DesiredState{
+			ID:                     uuid.New(),
+			ExternalID:             uuid.New(),
+			Date:                   time.Now(),
+			Bucket:                 "retail",
+			Amount:                 1000,
+			PartnerAmountNetOfFees: true,
+		}
+		_, errs := m.Apply(context.Background(), d)
+		assert.Equal(t, 0, len(errs))
+		state, err := store.Load(d.ExternalID)
+		assert.NoError(t, err)
+		assert.Equal(t, 841, state.PartnerAmount, "The platform takes 100 and the provider 59")
+		assert.Equal(t, uint(59), state.ProviderFees)
+		assert.Equal(t, 100, state.PlatformRevenue)
+		assert.Equal(t, consts.PaymentStatusComplete, state.Status)
+
+		d.ID = uuid.New()
+		d.Amount = 1500
+		_, errs = m.Apply(context.Background(), d)
+		assert.Equal(t, 0, len(errs))
+		state, err = store.Load(d.ExternalID)
+		assert.NoError(t, err)
+		assert.Equal(t, 1246, state.PartnerAmount, "The provider's fee on the first charge is kept, and 45 is estimated on the next")
+		assert.Equal(t, uint(59+45), state.ProviderFees)
+		assert.Equal(t, 150, state.PlatformRevenue)
+	})
+	t.Run("Stripe provider uses the tenant's credentials", func(t *testing.T) {
+		r := tenant.NewRegistry()
+		var states []payments.ActualState
+		r.RegisterProvider("stripe", tenant.Stripe(func(state payments.ActualState) (string, handlers.StripeStorage, payments.PartnerHandler, error) {
+			states = append(states, state)
+			return "tok_visa", handlers.NewMockStripeStorage(state.Bucket), handlers.NewPartnerMock(), nil
+		}))
+		assert.NoError(t, r.Add(tenant.Tenant{Bucket: "retail", Provider: "stripe", Currency: "usd", Credentials: map[string]string{"secret_key": "sk_test_123"}}))
+		state := payments.ActualState{DesiredState: resolver.DesiredState{ExternalID: uuid.New(), Bucket: "retail"}}
+		partner, user, err := r.Factory()(state)
+		assert.NoError(t, err)
+		assert.NotNil(t, partner)
+		assert.NotNil(t, user)
+		assert.Equal(t, []payments.ActualState{state}, states)
+	})
+}
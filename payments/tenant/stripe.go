@@ -0,0 +1,28 @@
+package tenant
+
+import (
+	"github.com/davidjwilkins/declarative-payments/payments"
+	"github.com/davidjwilkins/declarative-payments/payments/handlers"
+	"github.com/stripe/stripe-go/v72/client"
+)
+
+// StripeAccount returns what is specific to the user and partner of a payment: the card to charge, the storage of its
+// charges, and the partner's handler.
+type StripeAccount func(state payments.ActualState) (cardID string, storage handlers.StripeStorage, partner payments.PartnerHandler, err error)
+
+// Stripe is a Provider which charges users with the tenant's "secret_key" credential and currency, describing charges
+// with the tenant's descriptions
+func Stripe(account StripeAccount) Provider {
+	return func(t Tenant, state payments.ActualState) (payments.PartnerHandler, payments.UserHandler, error) {
+		cardID, storage, partner, err := account(state)
+		if err != nil {
+			return nil, nil, err
+		}
+		api := client.New(t.Credentials["secret_key"], nil)
+		user := handlers.NewStripeHandler(api, cardID, t.Currency, t.Bucket, storage)
+		if err := user.Describe(t.Descriptions); err != nil {
+			return nil, nil, err
+		}
+		return partner, user, nil
+	}
+}
@@ -0,0 +1,124 @@
+package validation
+
+import (
+	"fmt"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments/resolver"
+	"math"
+	"strings"
+)
+
+// Violation is a single way in which a desired state broke a rule
+type Violation struct {
+	Rule    string
+	Field   string
+	Message string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s: %s (%s)", v.Field, v.Message, v.Rule)
+}
+
+// Error holds every violation found in a desired state.  It matches errors.ErrInvalidDesiredState.
+type Error struct {
+	Violations []Violation
+}
+
+func (e *Error) Error() string {
+	violations := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		violations[i] = v.String()
+	}
+	return errors.ErrInvalidDesiredState.Error() + ": " + strings.Join(violations, "; ")
+}
+
+func (e *Error) Is(target error) bool {
+	return target == errors.ErrInvalidDesiredState
+}
+
+type Rule interface {
+	Validate(d resolver.DesiredState) []Violation
+}
+
+type RuleFunc func(d resolver.DesiredState) []Violation
+
+func (f RuleFunc) Validate(d resolver.DesiredState) []Violation {
+	return f(d)
+}
+
+// Validator checks desired states against all of its rules
+type Validator struct {
+	rules []Rule
+}
+
+func New(rules ...Rule) *Validator {
+	return &Validator{rules: rules}
+}
+
+// Validate returns an *Error with the violations of every rule, or nil if there were none
+func (v *Validator) Validate(d resolver.DesiredState) error {
+	var violations []Violation
+	for _, rule := range v.rules {
+		violations = append(violations, rule.Validate(d)...)
+	}
+	if len(violations) > 0 {
+		return &Error{Violations: violations}
+	}
+	return nil
+}
+
+// NonNegative requires that no amount is negative
+func NonNegative() Rule {
+	return RuleFunc(func(d resolver.DesiredState) []Violation {
+		var violations []Violation
+		if d.Amount < 0 {
+			violations = append(violations, Violation{"non-negative", "Amount", "must not be negative"})
+		}
+		if d.AuthorizedAmount > math.MaxInt {
+			// A uint this large has almost certainly underflowed
+			violations = append(violations, Violation{"non-negative", "AuthorizedAmount", "must not be negative"})
+		}
+		if d.PartnerAmount < 0 {
+			violations = append(violations, Violation{"non-negative", "PartnerAmount", "must not be negative"})
+		}
+		return violations
+	})
+}
+
+// PartnerWithinUser requires that the partner is not paid more than the user has paid
+func PartnerWithinUser() Rule {
+	return RuleFunc(func(d resolver.DesiredState) []Violation {
+		if d.PartnerAmount > d.Amount {
+			return []Violation{{"partner-within-user", "PartnerAmount", fmt.Sprintf("must not exceed Amount of %d", d.Amount)}}
+		}
+		return nil
+	})
+}
+
+// Limits are the largest amounts allowed in a bucket.  Zero means no limit.
+type Limits struct {
+	Amount           int  `json:"amount"`
+	AuthorizedAmount uint `json:"authorized_amount"`
+	PartnerAmount    int  `json:"partner_amount"`
+}
+
+// MaxAmounts requires that amounts do not exceed the limits for their bucket.  Buckets without limits are not checked.
+func MaxAmounts(limits map[string]Limits) Rule {
+	return RuleFunc(func(d resolver.DesiredState) []Violation {
+		l, ok := limits[d.Bucket]
+		if !ok {
+			return nil
+		}
+		var violations []Violation
+		if l.Amount > 0 && d.Amount > l.Amount {
+			violations = append(violations, Violation{"max-amount", "Amount", fmt.Sprintf("must not exceed %d", l.Amount)})
+		}
+		if l.AuthorizedAmount > 0 && d.AuthorizedAmount > l.AuthorizedAmount {
+			violations = append(violations, Violation{"max-amount", "AuthorizedAmount", fmt.Sprintf("must not exceed %d", l.AuthorizedAmount)})
+		}
+		if l.PartnerAmount > 0 && d.PartnerAmount > l.PartnerAmount {
+			violations = append(violations, Violation{"max-amount", "PartnerAmount", fmt.Sprintf("must not exceed %d", l.PartnerAmount)})
+		}
+		return violations
+	})
+}
@@ -0,0 +1,74 @@
+package validation_test
+
+import (
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments/resolver"
+	"github.com/davidjwilkins/declarative-payments/payments/validation"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestValidator(t *testing.T) {
+	d := resolver.DesiredState{
+		ID:         uuid.New(),
+		ExternalID: uuid.New(),
+		UserID:     uuid.New(),
+		Date:       time.Now(),
+		Bucket:     "test",
+	}
+	t.Run("Valid state has no error", func(t *testing.T) {
+		v := validation.New(validation.NonNegative(), validation.PartnerWithinUser())
+		d := d
+		d.Amount = 1000
+		d.PartnerAmount = 800
+		assert.NoError(t, v.Validate(d))
+	})
+	t.Run("Returns every violation", func(t *testing.T) {
+		v := validation.New(validation.NonNegative(), validation.PartnerWithinUser())
+		d := d
+		d.Amount = -100
+		d.AuthorizedAmount = uint(math.MaxInt) + 1
+		d.PartnerAmount = 100
+		err := v.Validate(d)
+		assert.True(t, errors.Is(err, errors.ErrInvalidDesiredState))
+		verr, ok := err.(*validation.Error)
+		assert.True(t, ok)
+		assert.Equal(t, []validation.Violation{
+			{"non-negative", "Amount", "must not be negative"},
+			{"non-negative", "AuthorizedAmount", "must not be negative"},
+			{"partner-within-user", "PartnerAmount", "must not exceed Amount of -100"},
+		}, verr.Violations)
+		assert.Contains(t, err.Error(), "PartnerAmount: must not exceed Amount of -100 (partner-within-user)")
+	})
+	t.Run("Max amounts are per bucket", func(t *testing.T) {
+		v := validation.New(validation.MaxAmounts(map[string]validation.Limits{
+			"test": {Amount: 1000, AuthorizedAmount: 2000},
+		}))
+		d := d
+		d.Amount = 1001
+		d.AuthorizedAmount = 2000
+		d.PartnerAmount = 5000
+		err := v.Validate(d)
+		assert.True(t, errors.Is(err, errors.ErrInvalidDesiredState))
+		assert.Equal(t, []validation.Violation{
+			{"max-amount", "Amount", "must not exceed 1000"},
+		}, err.(*validation.Error).Violations, "Zero limits are not checked")
+		d.Bucket = "other"
+		assert.NoError(t, v.Validate(d), "Buckets without limits are not checked")
+	})
+	t.Run("Custom rules", func(t *testing.T) {
+		v := validation.New(validation.RuleFunc(func(d resolver.DesiredState) []validation.Violation {
+			if d.Bucket == "" {
+				return []validation.Violation{{"bucket", "Bucket", "is required"}}
+			}
+			return nil
+		}))
+		assert.NoError(t, v.Validate(d))
+		d := d
+		d.Bucket = ""
+		assert.True(t, errors.Is(v.Validate(d), errors.ErrInvalidDesiredState))
+	})
+}
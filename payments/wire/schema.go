@@ -0,0 +1,231 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// node is a parsed JSON Schema, or a part of one
+type node = map[string]interface{}
+
+var (
+	schema   = mustParse(Schema)
+	patterns = map[string]*regexp.Regexp{}
+)
+
+// mustParse parses a schema, compiling the patterns it uses
+func mustParse(data []byte) node {
+	var s node
+	if err := unmarshalNumbers(data, &s); err != nil {
+		panic(err)
+	}
+	compile(s)
+	return s
+}
+
+func compile(v interface{}) {
+	switch v := v.(type) {
+	case node:
+		if pattern, ok := v["pattern"].(string); ok {
+			patterns[pattern] = regexp.MustCompile(pattern)
+		}
+		for _, child := range v {
+			compile(child)
+		}
+	case []interface{}:
+		for _, child := range v {
+			compile(child)
+		}
+	}
+}
+
+// unmarshalNumbers decodes JSON keeping numbers as json.Number, so integers can be told from other numbers
+func unmarshalNumbers(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// Validate checks that data is an Envelope matching Schema.  Only the keywords Schema uses are supported.
+func Validate(data []byte) error {
+	var value interface{}
+	if err := unmarshalNumbers(data, &value); err != nil {
+		return err
+	}
+	_, err := validate(schema, value, "envelope")
+	return err
+}
+
+// validateData checks the data of an Envelope of kind against the part of Schema describing it
+func validateData(kind Kind, data []byte) error {
+	var value interface{}
+	if err := unmarshalNumbers(data, &value); err != nil {
+		return err
+	}
+	branches, _ := schema["oneOf"].([]interface{})
+	for _, branch := range branches {
+		properties, _ := branch.(node)["properties"].(node)
+		if properties["kind"].(node)["const"] == string(kind) {
+			_, err := validate(properties["data"].(node), value, "data")
+			return err
+		}
+	}
+	return fmt.Errorf("%w: %q", errors.ErrUnknownKind, kind)
+}
+
+func mismatch(path, format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s %s", errors.ErrSchemaMismatch, path, fmt.Sprintf(format, args...))
+}
+
+func resolve(ref string) node {
+	var s interface{} = schema
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		s = s.(node)[part]
+	}
+	return s.(node)
+}
+
+func isType(value interface{}, t string) bool {
+	switch t {
+	case "object":
+		_, ok := value.(node)
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "number":
+		_, ok := value.(json.Number)
+		return ok
+	case "integer":
+		n, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		_, err := n.Int64()
+		return err == nil
+	}
+	return false
+}
+
+func contains(values []interface{}, value interface{}) bool {
+	for _, v := range values {
+		if reflect.DeepEqual(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks value against s, returning the properties of value which s evaluated, for unevaluatedProperties
+func validate(s node, value interface{}, path string) (map[string]bool, error) {
+	evaluated := map[string]bool{}
+	if ref, ok := s["$ref"].(string); ok {
+		more, err := validate(resolve(ref), value, path)
+		if err != nil {
+			return nil, err
+		}
+		for k := range more {
+			evaluated[k] = true
+		}
+	}
+	if c, ok := s["const"]; ok && !reflect.DeepEqual(c, value) {
+		return nil, mismatch(path, "must be %v", c)
+	}
+	if enum, ok := s["enum"].([]interface{}); ok && !contains(enum, value) {
+		return nil, mismatch(path, "must be one of %v", enum)
+	}
+	if t, ok := s["type"].(string); ok && !isType(value, t) {
+		return nil, mismatch(path, "must be of type %s", t)
+	}
+	switch v := value.(type) {
+	case string:
+		if pattern, ok := s["pattern"].(string); ok && !patterns[pattern].MatchString(v) {
+			return nil, mismatch(path, "must match %s", pattern)
+		}
+	case json.Number:
+		if minimum, ok := s["minimum"].(json.Number); ok {
+			n, _ := v.Float64()
+			min, _ := minimum.Float64()
+			if n < min {
+				return nil, mismatch(path, "must be at least %s", minimum)
+			}
+		}
+	case []interface{}:
+		if items, ok := s["items"].(node); ok {
+			for i, item := range v {
+				if _, err := validate(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return nil, err
+				}
+			}
+		}
+	case node:
+		required, _ := s["required"].([]interface{})
+		for _, key := range required {
+			if _, ok := v[key.(string)]; !ok {
+				return nil, mismatch(path+"."+key.(string), "is required")
+			}
+		}
+		properties, _ := s["properties"].(node)
+		for key, property := range v {
+			child := path + "." + key
+			if p, ok := properties[key]; ok {
+				if _, err := validate(p.(node), property, child); err != nil {
+					return nil, err
+				}
+				evaluated[key] = true
+				continue
+			}
+			switch additional := s["additionalProperties"].(type) {
+			case bool:
+				if !additional {
+					return nil, mismatch(child, "is not allowed")
+				}
+				evaluated[key] = true
+			case node:
+				if _, err := validate(additional, property, child); err != nil {
+					return nil, err
+				}
+				evaluated[key] = true
+			}
+		}
+	}
+	if oneOf, ok := s["oneOf"].([]interface{}); ok {
+		matched := 0
+		var reasons []string
+		for _, branch := range oneOf {
+			more, err := validate(branch.(node), value, path)
+			if err != nil {
+				reasons = append(reasons, err.Error())
+				continue
+			}
+			matched++
+			for k := range more {
+				evaluated[k] = true
+			}
+		}
+		if matched != 1 {
+			return nil, mismatch(path, "matches %d of oneOf rather than 1: %s", matched, strings.Join(reasons, "; "))
+		}
+	}
+	if unevaluated, ok := s["unevaluatedProperties"].(bool); ok && !unevaluated {
+		if v, ok := value.(node); ok {
+			for key := range v {
+				if !evaluated[key] {
+					return nil, mismatch(path+"."+key, "is not allowed")
+				}
+			}
+		}
+	}
+	return evaluated, nil
+}
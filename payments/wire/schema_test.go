@@ -0,0 +1,71 @@
+package wire_test
+
+import (
+	"encoding/json"
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments"
+	"github.com/davidjwilkins/declarative-payments/payments/resolver"
+	"github.com/davidjwilkins/declarative-payments/payments/wire"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	d := resolver.DesiredState{
+		ID:                     uuid.New(),
+		ExternalID:             uuid.New(),
+		UserID:                 uuid.New(),
+		PartnerID:              uuid.New(),
+		Date:                   time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC),
+		Bucket:                 "test",
+		Amount:                 -100,
+		AuthorizedAmount:       500,
+		PartnerAmount:          90,
+		PartnerAmountNetOfFees: true,
+		Actor:                  "ops@example.com",
+		Source:                 "bookings",
+		Reason:                 "booking-created",
+		Metadata:               map[string]string{"order": "A-100"},
+	}
+	cmd := d.Charge(100)
+	cmd.Status = consts.PaymentCommandStatusComplete
+	cmd.Settled = 100
+	cmd.ProviderFee = 33
+	cmd.StateVersion = 3
+	cmd.Policy = resolver.PolicyDecision{Name: "daily", Outcome: consts.PolicyOutcomeTrimmed, Reason: "limit", RequestedAmount: 200}
+	cmd.Review = resolver.Review{Actor: "ops", Reason: "ok", Date: d.Date, Approved: true}
+	cmd.Metadata = map[string]string{"line": "2"}
+	state := payments.ActualState{
+		DesiredState:     d,
+		Status:           consts.PaymentStatusComplete,
+		LastDesiredState: d,
+		Version:          4,
+		ProviderFees:     33,
+		PlatformRevenue:  -23,
+	}
+	t.Run("Encoded values match the schema", func(t *testing.T) {
+		for _, v := range []interface{}{d, cmd, []resolver.PaymentCommand{cmd, d.Deposit(90)}, state, payments.ActualState{}} {
+			data, err := wire.Marshal(v)
+			assert.NoError(t, err)
+			assert.NoError(t, wire.Validate(data), "%T", v)
+		}
+	})
+	t.Run("Envelopes which do not match are rejected", func(t *testing.T) {
+		data, err := json.Marshal(cmd)
+		assert.NoError(t, err)
+		for _, envelope := range []string{
+			`{"version": 1, "kind": "payment-command"}`,
+			`{"version": 2, "kind": "payment-command", "data": {}}`,
+			`{"version": 1, "kind": "payment-command", "data": {}, "extra": true}`,
+			`{"version": 1, "kind": "payment-command", "data": {}}`,
+			`{"version": 1, "kind": "desired-state", "data": ` + string(data) + `}`,
+			`{"version": 1, "kind": "payment-commands", "data": [{"id": "not-a-uuid"}]}`,
+		} {
+			assert.True(t, errors.Is(wire.Validate([]byte(envelope)), errors.ErrSchemaMismatch), envelope)
+		}
+		assert.Error(t, wire.Validate([]byte(`{`)))
+	})
+}
@@ -0,0 +1,107 @@
+// Package wire is the versioned JSON encoding of desired states, payment commands and actual states, for exchanging
+// them between services and storing them durably.
+//
+// Every value is wrapped in an Envelope naming its kind and the version of the format:
+//
+//	{"version": 1, "kind": "desired-state", "data": {"id": "...", "external_id": "...", ...}}
+//
+// Fields are snake_case, amounts are integers in the smallest currency unit, dates are RFC 3339 and IDs are UUIDs.
+// Decoding is strict: unknown fields, missing fields, unknown or empty enum values and unsupported versions are
+// rejected.  Schema is the JSON Schema of the format, and Validate checks an encoded Envelope against it.
+package wire
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments"
+	"github.com/davidjwilkins/declarative-payments/payments/resolver"
+)
+
+// Version is the version of the format written by Marshal
+const Version = 1
+
+type Kind string
+
+const (
+	KindDesiredState    Kind = "desired-state"
+	KindPaymentCommand  Kind = "payment-command"
+	KindPaymentCommands Kind = "payment-commands"
+	KindActualState     Kind = "actual-state"
+)
+
+// Schema is the JSON Schema of an Envelope
+//
+//go:embed schema.json
+var Schema []byte
+
+type Envelope struct {
+	Version int             `json:"version"`
+	Kind    Kind            `json:"kind"`
+	Data    json.RawMessage `json:"data"`
+}
+
+func kindOf(v interface{}) (Kind, error) {
+	switch v.(type) {
+	case resolver.DesiredState, *resolver.DesiredState:
+		return KindDesiredState, nil
+	case resolver.PaymentCommand, *resolver.PaymentCommand:
+		return KindPaymentCommand, nil
+	case []resolver.PaymentCommand, *[]resolver.PaymentCommand:
+		return KindPaymentCommands, nil
+	case payments.ActualState, *payments.ActualState:
+		return KindActualState, nil
+	}
+	return "", fmt.Errorf("%w: %T", errors.ErrUnknownKind, v)
+}
+
+// Marshal encodes a resolver.DesiredState, resolver.PaymentCommand, []resolver.PaymentCommand or payments.ActualState
+// in an Envelope
+func Marshal(v interface{}) ([]byte, error) {
+	kind, err := kindOf(v)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(Envelope{Version: Version, Kind: kind, Data: data})
+}
+
+func strict(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return fmt.Errorf("unexpected data after %T", v)
+	}
+	return nil
+}
+
+// Unmarshal decodes an Envelope into v, which must be a pointer to the kind of value it holds
+func Unmarshal(data []byte, v interface{}) error {
+	kind, err := kindOf(v)
+	if err != nil {
+		return err
+	}
+	var envelope Envelope
+	if err := strict(data, &envelope); err != nil {
+		return err
+	}
+	if envelope.Version != Version {
+		return fmt.Errorf("%w: %d", errors.ErrUnsupportedVersion, envelope.Version)
+	}
+	if envelope.Kind != kind {
+		return fmt.Errorf("%w: %q cannot be decoded into %T", errors.ErrUnknownKind, envelope.Kind, v)
+	}
+	if err := strict(envelope.Data, v); err != nil {
+		return err
+	}
+	// Decoding cannot tell a missing field from a zero one, so required fields are checked against the schema
+	return validateData(kind, envelope.Data)
+}
@@ -0,0 +1,174 @@
+package wire_test
+
+import (
+	"encoding/json"
+	"github.com/davidjwilkins/declarative-payments/consts"
+	"github.com/davidjwilkins/declarative-payments/errors"
+	"github.com/davidjwilkins/declarative-payments/payments"
+	"github.com/davidjwilkins/declarative-payments/payments/resolver"
+	"github.com/davidjwilkins/declarative-payments/payments/wire"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestWire(t *testing.T) {
+	d := resolver.DesiredState{
+		ID:               uuid.New(),
+		ExternalID:       uuid.New(),
+		UserID:           uuid.New(),
+		PartnerID:        uuid.New(),
+		Date:             time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC),
+		Bucket:           "test",
+		Amount:           -100,
+		AuthorizedAmount: 500,
+		PartnerAmount:    90,
+		Actor:            "ops@example.com",
+		Source:           "bookings",
+		Reason:           "booking-created",
+		Metadata:         map[string]string{"order": "A-100"},
+	}
+	cmd := d.Charge(100)
+	cmd.Status = consts.PaymentCommandStatusError
+	cmd.Error = "card declined"
+	cmd.Attempts = 2
+	cmd.StateVersion = 3
+	cmd.Policy = resolver.PolicyDecision{Name: "daily", Outcome: consts.PolicyOutcomeTrimmed, Reason: "limit", RequestedAmount: 200}
+	cmd.Review = resolver.Review{Actor: "ops", Reason: "ok", Date: d.Date, Approved: true}
+	cmd.Metadata = map[string]string{"line": "2"}
+	t.Run("Values round trip", func(t *testing.T) {
+		data, err := wire.Marshal(d)
+		assert.NoError(t, err)
+		var decoded resolver.DesiredState
+		assert.NoError(t, wire.Unmarshal(data, &decoded))
+		assert.Equal(t, d, decoded)
+
+		data, err = wire.Marshal(cmd)
+		assert.NoError(t, err)
+		var decodedCmd resolver.PaymentCommand
+		assert.NoError(t, wire.Unmarshal(data, &decodedCmd))
+		assert.Equal(t, cmd, decodedCmd)
+
+		cmds := []resolver.PaymentCommand{cmd, d.Deposit(90)}
+		data, err = wire.Marshal(cmds)
+		assert.NoError(t, err)
+		var decodedCmds []resolver.PaymentCommand
+		assert.NoError(t, wire.Unmarshal(data, &decodedCmds))
+		assert.Equal(t, cmds, decodedCmds)
+
+		state := payments.ActualState{DesiredState: d, Status: consts.PaymentStatusFailed, LastDesiredState: d, Version: 4}
+		data, err = wire.Marshal(&state)
+		assert.NoError(t, err)
+		var decodedState payments.ActualState
+		assert.NoError(t, wire.Unmarshal(data, &decodedState))
+		assert.Equal(t, state, decodedState)
+	})
+	t.Run("Encoding is stable", func(t *testing.T) {
+		last := d
+		last.ID = uuid.New()
+		last.Amount = 100
+		data, err := wire.Marshal(payments.ActualState{DesiredState: d, Status: consts.PaymentStatusPending, LastDesiredState: last, Version: 1})
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"version": 1, "kind": "actual-state", "data": {
+			"id": "`+d.ID.String()+`",
+			"external_id": "`+d.ExternalID.String()+`",
+			"user_id": "`+d.UserID.String()+`",
+			"partner_id": "`+d.PartnerID.String()+`",
+			"date": "2021-06-01T12:00:00Z",
+			"bucket": "test",
+			"amount": -100,
+			"authorized_amount": 500,
+			"partner_amount": 90,
+			"actor": "ops@example.com",
+			"source": "bookings",
+			"reason": "booking-created",
+			"metadata": {"order": "A-100"},
+			"status": "pending",
+			"last_desired_state": {
+				"id": "`+last.ID.String()+`",
+				"external_id": "`+d.ExternalID.String()+`",
+				"user_id": "`+d.UserID.String()+`",
+				"partner_id": "`+d.PartnerID.String()+`",
+				"date": "2021-06-01T12:00:00Z",
+				"bucket": "test",
+				"amount": 100,
+				"authorized_amount": 500,
+				"partner_amount": 90,
+				"actor": "ops@example.com",
+				"source": "bookings",
+				"reason": "booking-created",
+				"metadata": {"order": "A-100"}
+			},
+			"version": 1
+		}}`, string(data))
+	})
+	t.Run("Decoding is strict", func(t *testing.T) {
+		var decoded resolver.PaymentCommand
+		decode := func(envelope string) error {
+			return wire.Unmarshal([]byte(envelope), &decoded)
+		}
+		assert.True(t, errors.Is(decode(`{"version": 1, "kind": "payment-command", "data": {"action": "steal"}}`), errors.ErrInvalidEnum))
+		assert.True(t, errors.Is(decode(`{"version": 1, "kind": "payment-command", "data": {"status": "done"}}`), errors.ErrInvalidEnum))
+		assert.True(t, errors.Is(decode(`{"version": 2, "kind": "payment-command", "data": {}}`), errors.ErrUnsupportedVersion))
+		assert.True(t, errors.Is(decode(`{"version": 1, "kind": "desired-state", "data": {}}`), errors.ErrUnknownKind), "Kind must match")
+		assert.Error(t, decode(`{"version": 1, "kind": "payment-command", "data": {"colour": "red"}}`), "Unknown fields are rejected")
+		assert.Error(t, decode(`{"version": 1, "kind": "payment-command", "data": {}, "extra": true}`))
+		assert.Error(t, decode(`{"version": 1, "kind": "payment-command", "data": {}} {}`), "Trailing data is rejected")
+		assert.True(t, errors.Is(decode(`{"version": 1, "kind": "payment-command", "data": {}}`), errors.ErrSchemaMismatch), "Required fields must be present")
+
+		data, err := wire.Marshal(cmd)
+		assert.NoError(t, err)
+		assert.NoError(t, wire.Unmarshal(data, &decoded))
+		var fields map[string]interface{}
+		assert.NoError(t, json.Unmarshal(data, &fields))
+		command := fields["data"].(map[string]interface{})
+		for _, field := range []string{"action", "status", "id", "amount"} {
+			missing := map[string]interface{}{}
+			for k, v := range command {
+				if k != field {
+					missing[k] = v
+				}
+			}
+			fields["data"] = missing
+			data, _ := json.Marshal(fields)
+			assert.True(t, errors.Is(decode(string(data)), errors.ErrSchemaMismatch), "%s is required", field)
+		}
+		for _, field := range []string{"action", "status"} {
+			empty := map[string]interface{}{}
+			for k, v := range command {
+				empty[k] = v
+			}
+			empty[field] = ""
+			fields["data"] = empty
+			data, _ := json.Marshal(fields)
+			assert.True(t, errors.Is(decode(string(data)), errors.ErrInvalidEnum), "%s cannot be empty", field)
+		}
+
+		_, err = wire.Marshal(map[string]string{})
+		assert.True(t, errors.Is(err, errors.ErrUnknownKind))
+	})
+	t.Run("Schema matches the enums", func(t *testing.T) {
+		var schema struct {
+			Defs struct {
+				PaymentCommand struct {
+					Properties struct {
+						Action struct{ Enum []string }
+						Status struct{ Enum []string }
+					}
+				}
+			} `json:"$defs"`
+		}
+		assert.NoError(t, json.Unmarshal(wire.Schema, &schema))
+		for _, action := range schema.Defs.PaymentCommand.Properties.Action.Enum {
+			var decoded consts.PaymentCommandAction
+			assert.NoError(t, json.Unmarshal([]byte(`"`+action+`"`), &decoded))
+		}
+		for _, status := range schema.Defs.PaymentCommand.Properties.Status.Enum {
+			var decoded consts.PaymentCommandStatus
+			assert.NoError(t, json.Unmarshal([]byte(`"`+status+`"`), &decoded))
+		}
+		assert.Equal(t, 8, len(schema.Defs.PaymentCommand.Properties.Action.Enum))
+		assert.Equal(t, 7, len(schema.Defs.PaymentCommand.Properties.Status.Enum))
+	})
+}